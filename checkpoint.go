@@ -0,0 +1,246 @@
+package m3u8
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	checkpointSuffix = ".checkpoint.json"
+	// 两次写入检查点文件的最小间隔, 下载结束时会强制写入一次
+	checkpointSaveInterval = time.Second
+)
+
+// checkpoint 断点续传使用的检查点, 以json格式保存在FileDir下, 文件名为TsFilePrefix + checkpointSuffix.
+// 检查点中不保存秘钥本身, 仅保存秘钥的sha256, 续传时按需重新获取秘钥并校验其未发生变化.
+type checkpoint struct {
+	M3u8Url    string
+	MediaUrl   string
+	MastPlay   *checkpointM3u8
+	Variant    *PlayInfo
+	Renditions []Media // 选中的备选媒体, 备选媒体各自使用独立的检查点
+	Media      *checkpointM3u8
+	Keys       map[string]string // SecretKeyUrl -> 最后一次使用的秘钥的sha256
+	Segments   []segmentCheckpoint
+}
+
+// checkpointM3u8 没有M3u8的方法, 使json按字段保存播放列表而不是使用MarshalText编码为m3u8文本
+type checkpointM3u8 M3u8
+
+type segmentCheckpoint struct {
+	Sequence int64
+	Done     bool
+	Size     int64
+	Sha256   string
+}
+
+type checkpointWriter struct {
+	lock     sync.Mutex
+	path     string
+	lastSave time.Time
+	segments []segmentCheckpoint
+	keys     map[string]string // SecretKeyUrl -> 秘钥的sha256, 包含检查点中记录的和本次下载使用的秘钥
+	verify   map[string]string // 续传后尚未校验的秘钥, 每个SecretKeyUrl只校验续传后第一次获取的秘钥
+}
+
+func (md *m3u8Downloader) checkpointPath() string {
+	return md.fullPath(md.tsFilePrefix + checkpointSuffix)
+}
+
+func loadCheckpoint(path string) (*checkpoint, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read checkpoint %s error, %w", path, err)
+	}
+	cp := &checkpoint{}
+	if err = json.Unmarshal(body, cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %s is illegal, %w", path, err)
+	}
+	if cp.Media == nil {
+		return nil, fmt.Errorf("checkpoint %s has no media playlist", path)
+	}
+	return cp, nil
+}
+
+// restore 从检查点恢复下载状态, 检查点不存在时返回false. 已完成且文件大小和sha256均匹配的分片不会重新下载.
+func (md *m3u8Downloader) restore(m3u8Url string) (bool, error) {
+	cp, err := loadCheckpoint(md.checkpointPath())
+	if err != nil || cp == nil {
+		return false, err
+	}
+
+	if !sameResource(cp.M3u8Url, m3u8Url) {
+		return false, fmt.Errorf("checkpoint %s belongs to %s, not %s", md.checkpointPath(), cp.M3u8Url, m3u8Url)
+	}
+
+	md.m3u8 = (*M3u8)(cp.Media)
+	md.mediaUrl = cp.MediaUrl
+	md.m3u8Copy.MastPlay = (*M3u8)(cp.MastPlay)
+	if md.m3u8Copy.MastPlay != nil {
+		md.imports = md.m3u8Copy.MastPlay.Variables
+	}
+	md.variant = cp.Variant
+	md.medias = cp.Renditions
+	md.cp.segments = make([]segmentCheckpoint, len(md.m3u8.Segments))
+	md.cp.keys = make(map[string]string)
+	md.cp.verify = make(map[string]string)
+	for u, sum := range cp.Keys {
+		md.cp.keys[u], md.cp.verify[u] = sum, sum
+	}
+
+	for i := range md.m3u8.Segments {
+		md.m3u8.Segments[i].Idx = i
+		md.m3u8.Segments[i].ErrMsg = ""
+		if i < len(cp.Segments) && cp.Segments[i].Done && md.verifySegment(i, cp.Segments[i]) {
+			md.cp.segments[i] = cp.Segments[i]
+		}
+	}
+
+	md.markUnsupported(md.m3u8.Segments)
+	return true, nil
+}
+
+// verifySegment 校验已下载分片文件的大小和sha256与检查点记录一致
+func (md *m3u8Downloader) verifySegment(idx int, sc segmentCheckpoint) bool {
+	f, err := os.Open(md.fullPath(md.tsName(idx)))
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil || n != sc.Size {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == sc.Sha256
+}
+
+// segmentCompleted 判断分片是否已在之前的下载中完成
+func (md *m3u8Downloader) segmentCompleted(idx int) bool {
+	md.cp.lock.Lock()
+	defer md.cp.lock.Unlock()
+	return idx < len(md.cp.segments) && md.cp.segments[idx].Done
+}
+
+// recordSegment 记录索引为idx的分片已保存到磁盘
+func (md *m3u8Downloader) recordSegment(idx int, seq int64, size int64, sum string) {
+	md.cp.lock.Lock()
+	defer md.cp.lock.Unlock()
+	for len(md.cp.segments) <= idx {
+		md.cp.segments = append(md.cp.segments, segmentCheckpoint{})
+	}
+	md.cp.segments[idx] = segmentCheckpoint{
+		Sequence: seq,
+		Done:     true,
+		Size:     size,
+		Sha256:   sum,
+	}
+}
+
+// saveCheckpoint 将当前下载状态写入检查点文件, force为false时距上次写入不足checkpointSaveInterval则跳过
+func (md *m3u8Downloader) saveCheckpoint(force bool) error {
+	md.cp.lock.Lock()
+	defer md.cp.lock.Unlock()
+	if md.cp.path == "" {
+		// 写入Output时不保存检查点
+		return nil
+	}
+	if !force && time.Since(md.cp.lastSave) < checkpointSaveInterval {
+		return nil
+	}
+	md.cp.lastSave = time.Now()
+
+	md.segLock.RLock()
+	media := md.m3u8.Copy()
+	md.segLock.RUnlock()
+
+	cp := checkpoint{
+		M3u8Url:    md.m3u8Url,
+		MediaUrl:   md.mediaUrl,
+		MastPlay:   (*checkpointM3u8)(md.m3u8Copy.MastPlay),
+		Variant:    md.variant,
+		Renditions: md.medias,
+		Media:      (*checkpointM3u8)(media),
+		Keys:       make(map[string]string),
+		Segments:   make([]segmentCheckpoint, len(media.Segments)),
+	}
+	copy(cp.Segments, md.cp.segments)
+	for u, sum := range md.cp.keys {
+		cp.Keys[u] = sum
+	}
+	for i := range media.Segments {
+		media.Segments[i].EncryptMeta.SecretKey = ""
+		media.Segments[i].ErrMsg = ""
+	}
+
+	body, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("json.Marshal checkpoint error, %w", err)
+	}
+
+	tmp := md.cp.path + ".tmp"
+	if err = os.WriteFile(tmp, body, os.ModePerm); err != nil {
+		return fmt.Errorf("write checkpoint error, %w", err)
+	}
+	if err = os.Rename(tmp, md.cp.path); err != nil {
+		return fmt.Errorf("rename checkpoint error, %w", err)
+	}
+	return nil
+}
+
+// verifyKey 记录分片解密使用的秘钥. 续传后第一次获取的秘钥与检查点中记录的不一致时, 内容可能已经重新加密,
+// 与之前下载的分片混合会导致输出损坏, 返回错误使使用该秘钥的分片下载失败.
+func (md *m3u8Downloader) verifyKey(u string, key []byte) error {
+	if md.cp == nil {
+		return nil
+	}
+	sum := sha256.Sum256(key)
+	digest := hex.EncodeToString(sum[:])
+
+	md.cp.lock.Lock()
+	defer md.cp.lock.Unlock()
+	if expect, ok := md.cp.verify[u]; ok {
+		if expect != digest {
+			return Permanent(fmt.Errorf("secret key %s changed since checkpoint", u))
+		}
+		delete(md.cp.verify, u)
+	}
+	if md.cp.keys == nil {
+		md.cp.keys = make(map[string]string)
+	}
+	md.cp.keys[u] = digest
+	return nil
+}
+
+func (md *m3u8Downloader) removeCheckpoint() {
+	if md.cp.path == "" {
+		return
+	}
+	_ = os.Remove(md.cp.path)
+}
+
+// sameResource 忽略查询参数比较两个url, 签名url过期后可用新的签名url续传
+func sameResource(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return a == b
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return a == b
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host && ua.Path == ub.Path
+}
@@ -0,0 +1,161 @@
+package m3u8
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheckpoint(t *testing.T) {
+	Convey("TestCheckpoint", t, func() {
+		media, err := Parse([]byte(`#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x000102030405060708090a0b0c0d0e0f
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXT-X-PROGRAM-DATE-TIME:2020-10-08T10:00:00.000Z
+#EXTINF:2.5,title
+#EXT-X-BYTERANGE:100@720
+a.m4s
+#EXT-X-DISCONTINUITY
+#EXTINF:2,
+b.m4s
+#EXT-X-ENDLIST
+`), "http://example.com/v.m3u8")
+		So(err, ShouldEqual, nil)
+		mast, err := Parse([]byte("#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"English\",URI=\"en.m3u8\"\n#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=640x360,AUDIO=\"aac\"\nv.m3u8\n"), "http://example.com/index.m3u8")
+		So(err, ShouldEqual, nil)
+
+		md := &m3u8Downloader{
+			fileDir:      t.TempDir(),
+			tsFilePrefix: "out",
+			m3u8Url:      "http://example.com/v.m3u8",
+			m3u8:         media,
+			variant:      &mast.MastPlayList[0],
+			medias:       []Media{{Type: MediaTypeAudio, GroupId: "aac", Name: "English", Url: "http://example.com/en.m3u8"}},
+			cp:           &checkpointWriter{},
+		}
+		md.m3u8Copy.MastPlay = mast
+		md.cp.path = md.checkpointPath()
+		So(md.verifyKey(media.Segments[0].EncryptMeta.SecretKeyUrl, []byte("0123456789abcdef")), ShouldEqual, nil)
+		So(md.saveCheckpoint(true), ShouldEqual, nil)
+
+		cp, err := loadCheckpoint(md.checkpointPath())
+		So(err, ShouldEqual, nil)
+		So((*M3u8)(cp.Media), ShouldResemble, media)
+		So((*M3u8)(cp.MastPlay), ShouldResemble, mast)
+		So(cp.Variant, ShouldResemble, &mast.MastPlayList[0])
+		So(cp.Renditions, ShouldResemble, md.medias)
+		So(len(cp.Segments), ShouldEqual, 2)
+		So(cp.Keys, ShouldResemble, md.cp.keys)
+		So(cp.Keys, ShouldContainKey, "http://example.com/key.bin")
+	})
+
+	Convey("TestResume", t, func() {
+		// 合并后的文件写入当前目录
+		wd, err := os.Getwd()
+		So(err, ShouldEqual, nil)
+		dir := t.TempDir()
+		So(os.Chdir(dir), ShouldEqual, nil)
+		defer func() {
+			_ = os.Chdir(wd)
+		}()
+
+		var (
+			lock sync.Mutex
+			fail = true
+			hits = make(map[string]int)
+		)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if r.URL.Path == "/index.m3u8" {
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\n0.ts\n#EXTINF:2,\n1.ts\n#EXTINF:2,\n2.ts\n#EXT-X-ENDLIST\n")
+				return
+			}
+			hits[r.URL.Path]++
+			if fail && r.URL.Path == "/1.ts" {
+				// 阻塞直到下载被取消
+				lock.Unlock()
+				<-r.Context().Done()
+				lock.Lock()
+				return
+			}
+			fmt.Fprint(w, r.URL.Path)
+		}))
+		defer s.Close()
+
+		download := func(ctx context.Context, cancel func(Status)) *Result {
+			opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, filepath.Join(dir, "ts"), "out", 2)
+			opt.Resume = true
+			st, err := DownloadWithOpt(ctx, opt)
+			So(err, ShouldEqual, nil)
+			if cancel != nil {
+				cancel(st)
+			}
+			select {
+			case <-st.Done():
+			case <-time.After(5 * time.Second):
+				So("download not finished", ShouldBeEmpty)
+			}
+			return GenResult(st, false)
+		}
+
+		// 第一次下载在0.ts和2.ts完成后被取消
+		ctx, cancel := context.WithCancel(context.Background())
+		ret := download(ctx, func(st Status) {
+			for st.TsComplete() < 2 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			cancel()
+		})
+		So(ret.Merged, ShouldBeFalse)
+		So(ret.CheckpointErr, ShouldEqual, "")
+		_, err = os.Stat(filepath.Join(dir, "ts", "out"+checkpointSuffix))
+		So(err, ShouldEqual, nil)
+
+		// 续传时只下载未完成的分片和被破坏的分片
+		So(os.WriteFile(filepath.Join(dir, "ts", "out_2.ts"), []byte("broken"), os.ModePerm), ShouldEqual, nil)
+		lock.Lock()
+		fail, hits = false, make(map[string]int)
+		lock.Unlock()
+		ret = download(context.Background(), nil)
+		So(ret.Merged, ShouldBeTrue)
+		lock.Lock()
+		So(hits, ShouldResemble, map[string]int{"/1.ts": 1, "/2.ts": 1})
+		lock.Unlock()
+		body, err := os.ReadFile(filepath.Join(dir, ret.MergedFilePath))
+		So(err, ShouldEqual, nil)
+		So(string(body), ShouldEqual, "/0.ts/1.ts/2.ts")
+	})
+
+	Convey("TestCheckpointErr", t, func() {
+		media, err := Parse([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\na.ts\n"), "http://example.com/v.m3u8")
+		So(err, ShouldEqual, nil)
+		md := &m3u8Downloader{
+			fileDir:      t.TempDir(),
+			tsFilePrefix: "out",
+			m3u8:         media,
+			cp:           &checkpointWriter{},
+			eventChan:    make(chan Event, 1),
+		}
+		md.cp.path = md.checkpointPath()
+		// 临时文件的位置被目录占用, 无法写入检查点
+		So(os.Mkdir(md.cp.path+".tmp", os.ModePerm), ShouldEqual, nil)
+
+		md.segmentDone(0, nil)
+		ev := <-md.eventChan
+		So(ev.Segment, ShouldNotEqual, nil)
+		So(ev.CheckpointErr, ShouldContainSubstring, "write checkpoint error")
+	})
+}
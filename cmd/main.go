@@ -10,6 +10,11 @@ import (
 )
 
 func main() {
+	// m3u8 validate ${m3u8Url或本地文件}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+
 	// m3u8 ${m3u8Url} ${taskCnt} ${fileName}
 	const (
 		m3u8UrlIdx  = 1
@@ -51,3 +56,45 @@ func main() {
 		fmt.Printf("任务执行出错! 错误信息:%v\n", err)
 	}
 }
+
+// validate 校验播放列表并输出问题, 返回进程的退出码, 存在错误级别的问题时返回1
+func validate(args []string) int {
+	if len(args) == 0 {
+		fmt.Printf("请输入命令 形如: m3u8 validate ${m3u8Url}\n")
+		return 2
+	}
+
+	m3u8Url := args[0]
+	var (
+		issues []m3u8.Issue
+		err    error
+	)
+	if _, statErr := os.Stat(m3u8Url); statErr == nil {
+		// 本地文件, 相对地址按文件所在目录解析
+		issues, err = m3u8.ValidateFile(m3u8Url)
+	} else {
+		var content []byte
+		content, err = m3u8.NewFetcher(m3u8.NewDefaultOption(m3u8Url, m3u8.ModelMerged, "", "", 1)).Get(logs.NewCtxWithLogId(), m3u8Url)
+		if err != nil {
+			fmt.Printf("获取m3u8文件出错! 错误信息:%v\n", err)
+			return 2
+		}
+		issues, err = m3u8.ValidateContent(content, m3u8Url)
+	}
+	if err != nil {
+		fmt.Printf("解析m3u8文件出错! 错误信息:%v\n", err)
+		return 1
+	}
+
+	code := 0
+	for _, v := range issues {
+		fmt.Println(v)
+		if v.Severity == m3u8.SeverityError {
+			code = 1
+		}
+	}
+	if len(issues) == 0 {
+		fmt.Printf("未发现问题\n")
+	}
+	return code
+}
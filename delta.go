@@ -0,0 +1,30 @@
+package m3u8
+
+import "fmt"
+
+// ApplyDelta 将增量更新delta应用到之前获取的完整播放列表m上, 返回完整的播放列表.
+// delta中EXT-X-SKIP代替的分片按媒体序列号从m中取得, m中缺少这些分片时返回错误. delta不是增量更新时返回delta的拷贝.
+func (m *M3u8) ApplyDelta(delta *M3u8) (*M3u8, error) {
+	ret := delta.Copy()
+	if delta.Skip == nil {
+		return ret, nil
+	}
+
+	from, to := delta.MediaSequence, delta.MediaSequence+delta.Skip.SkippedSegments
+	var segs []Segment
+	for _, v := range m.Segments {
+		if v.Sequence >= from && v.Sequence < to {
+			segs = append(segs, v)
+		}
+	}
+	if int64(len(segs)) != delta.Skip.SkippedSegments {
+		return nil, fmt.Errorf("delta update skips segments [%d, %d) but only %d of them are in the previous playlist", from, to, len(segs))
+	}
+
+	segs = append(segs, ret.Segments...)
+	for i := range segs {
+		segs[i].Idx = i
+	}
+	ret.Segments, ret.Skip = segs, nil
+	return ret, nil
+}
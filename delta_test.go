@@ -0,0 +1,185 @@
+package m3u8
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestApplyDelta(t *testing.T) {
+	Convey("TestApplyDelta", t, func() {
+		const full = `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=12
+#EXT-X-MEDIA-SEQUENCE:10
+#EXTINF:2,
+10.ts
+#EXTINF:2,
+11.ts
+#EXTINF:2,
+12.ts`
+		const delta = `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=12
+#EXT-X-MEDIA-SEQUENCE:11
+#EXT-X-SKIP:SKIPPED-SEGMENTS=1,RECENTLY-REMOVED-DATERANGES="ad1	ad2"
+#EXTINF:2,
+12.ts
+#EXTINF:2,
+13.ts`
+		prev, err := Parse([]byte(full), "http://example.com/live/index.m3u8")
+		So(err, ShouldEqual, nil)
+		d, err := Parse([]byte(delta), "http://example.com/live/index.m3u8")
+		So(err, ShouldEqual, nil)
+		So(*d.Skip, ShouldResemble, Skip{SkippedSegments: 1, RecentlyRemovedDateRanges: []string{"ad1", "ad2"}})
+		So(d.Segments[0].Sequence, ShouldEqual, 12)
+		So(d.Segments[0].Idx, ShouldEqual, 0)
+
+		encoded, err := Parse(d.Encode(), "http://example.com/live/index.m3u8")
+		So(err, ShouldEqual, nil)
+		So(encoded, ShouldResemble, d)
+
+		m, err := prev.ApplyDelta(d)
+		So(err, ShouldEqual, nil)
+		So(m.Skip, ShouldEqual, nil)
+		So(m.MediaSequence, ShouldEqual, 11)
+		So(len(m.Segments), ShouldEqual, 3)
+		for i, v := range m.Segments {
+			So(v.Idx, ShouldEqual, i)
+			So(v.Sequence, ShouldEqual, 11+i)
+			So(v.Url, ShouldEqual, fmt.Sprintf("http://example.com/live/%d.ts", 11+i))
+		}
+
+		// 之前的播放列表中没有被跳过的分片
+		d.MediaSequence, d.Skip.SkippedSegments = 5, 6
+		_, err = prev.ApplyDelta(d)
+		So(err, ShouldNotEqual, nil)
+
+		_, err = Parse([]byte("#EXTM3U\n#EXTINF:2,\na.ts\n#EXT-X-SKIP:SKIPPED-SEGMENTS=1\n"), "http://example.com/a.m3u8")
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("TestLiveDelta", t, func() {
+		// 每次刷新新增一个分片, 播放列表只保留最近3个分片, 第5个分片后结束
+		var (
+			lock   sync.Mutex
+			last   = 2
+			deltas int
+		)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if r.URL.Path != "/index.m3u8" {
+				fmt.Fprint(w, r.URL.Path)
+				return
+			}
+			first, skip := last-2, 0
+			if r.URL.Query().Get("_HLS_skip") == "YES" {
+				last++
+				first, skip = last-2, 2
+				deltas++
+			}
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=6\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+			if skip > 0 {
+				fmt.Fprintf(w, "#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skip)
+			}
+			for i := first + skip; i <= last; i++ {
+				fmt.Fprintf(w, "#EXTINF:0.01,\n/%d.ts\n", i)
+			}
+			if last == 4 {
+				fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			}
+		}))
+		defer s.Close()
+
+		var out bytes.Buffer
+		opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, t.TempDir(), "out", 2)
+		opt.Live, opt.Output = true, &out
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+		select {
+		case <-st.Done():
+		case <-time.After(10 * time.Second):
+			So("live download not finished", ShouldBeEmpty)
+		}
+		So(st.Err(), ShouldEqual, nil)
+		So(out.String(), ShouldEqual, "/0.ts/1.ts/2.ts/3.ts/4.ts")
+		lock.Lock()
+		defer lock.Unlock()
+		So(deltas, ShouldEqual, 2)
+	})
+	Convey("TestReloadUrl", t, func() {
+		md := &m3u8Downloader{mediaUrl: "http://example.com/index.m3u8?a=1"}
+		m := &M3u8{ServerControl: &ServerControl{CanSkipUntil: 6 * time.Second}}
+		// 距上一次请求的时间超过CAN-SKIP-UNTIL时请求完整的播放列表
+		md.lastReload = time.Now().Add(-7 * time.Second)
+		u, err := md.reloadUrl(m)
+		So(err, ShouldEqual, nil)
+		So(u, ShouldEqual, md.mediaUrl)
+
+		md.lastReload = time.Now()
+		u, err = md.reloadUrl(m)
+		So(err, ShouldEqual, nil)
+		So(u, ShouldEqual, "http://example.com/index.m3u8?_HLS_skip=YES&a=1")
+
+		u, err = md.reloadUrl(&M3u8{})
+		So(err, ShouldEqual, nil)
+		So(u, ShouldEqual, md.mediaUrl)
+	})
+
+	Convey("TestLiveDeltaFallback", t, func() {
+		// 增量更新跳过的分片不在之前的播放列表中, 每次都需要再请求一次完整的播放列表
+		var (
+			lock        sync.Mutex
+			last        int
+			deltas, all int
+		)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if r.URL.Path != "/index.m3u8" {
+				fmt.Fprint(w, r.URL.Path)
+				return
+			}
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=6\n")
+			if r.URL.Query().Get("_HLS_skip") == "YES" {
+				deltas++
+				fmt.Fprint(w, "#EXT-X-MEDIA-SEQUENCE:100\n#EXT-X-SKIP:SKIPPED-SEGMENTS=2\n#EXTINF:0.01,\n/102.ts\n")
+				return
+			}
+			all++
+			for i := 0; i <= last; i++ {
+				fmt.Fprintf(w, "#EXTINF:0.01,\n/%d.ts\n", i)
+			}
+			if last == 2 {
+				fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			}
+			last++
+		}))
+		defer s.Close()
+
+		var out bytes.Buffer
+		opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, t.TempDir(), "out", 2)
+		opt.Live, opt.Output = true, &out
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+		select {
+		case <-st.Done():
+		case <-time.After(10 * time.Second):
+			So("live download not finished", ShouldBeEmpty)
+		}
+		So(st.Err(), ShouldEqual, nil)
+		So(out.String(), ShouldEqual, "/0.ts/1.ts/2.ts")
+		lock.Lock()
+		defer lock.Unlock()
+		So(deltas, ShouldEqual, 2)
+		So(all, ShouldEqual, 3)
+	})
+}
@@ -1,20 +1,26 @@
 package m3u8
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gogokit/gpool"
+	"github.com/gogokit/m3u8/remux"
+	"github.com/gogokit/m3u8/subtitle"
 	"github.com/gogokit/util"
 	"golang.org/x/time/rate"
 )
@@ -24,6 +30,21 @@ type Model int
 const (
 	ModelMerged       = 0
 	ModelConvertToMP4 = 1
+	// ModelMirror 不合并分片, 在FileDir下生成可以直接播放的HLS目录: 主播放列表, 选中的码流和备选媒体的媒体播放列表,
+	// 分片, 初始化分片和秘钥, 其中的地址均改写为相对路径. Result.MergedFilePath为入口播放列表的路径.
+	ModelMirror = 2
+)
+
+// errFMP4NeedFFmpeg 内置remux只支持ts, fMP4需要与其他输入合并时只能使用ffmpeg
+var errFMP4NeedFFmpeg = errors.New("convert fMP4 with renditions or subtitles to mp4 needs ffmpeg, built-in remux only supports ts")
+
+// MP4Backend 指定ModelConvertToMP4时将ts转换为mp4的方式
+type MP4Backend int
+
+const (
+	MP4BackendAuto   MP4Backend = 0 // 优先使用内置的remux, 失败时若能找到ffmpeg则回退到ffmpeg
+	MP4BackendNative MP4Backend = 1 // 仅使用内置的remux, 支持H.264/H.265视频和AAC音频的ts, 不支持将fMP4与备选媒体或字幕合并
+	MP4BackendFFmpeg MP4Backend = 2 // 仅使用ffmpeg
 )
 
 func Download(ctx context.Context, m3u8Url string, model Model, fileDir string, tsFilePrefix string, workerCnt int, withBar bool) (*Result, error) {
@@ -60,6 +81,8 @@ func NewDefaultOption(m3u8Url string, model Model, fileDir string, tsFilePrefix
 }
 
 type Option struct {
+	// M3u8Url 入口播放列表的地址, 可以是http(s)地址, file:地址或者本地文件的路径.
+	// 仅入口播放列表或BaseUrl是本地文件, 或者设置了M3u8Content时允许读取播放列表中的file:地址.
 	M3u8Url             string
 	Model               Model
 	Qps                 int
@@ -69,11 +92,70 @@ type Option struct {
 	FileDir             string
 	TsFilePrefix        string
 	HttpRequestCallback func(r *http.Request) error
+	// Live为true时, 若媒体播放列表没有EXT-X-ENDLIST, 则按照RFC 8216规定的间隔持续刷新播放列表并下载新增的分片,
+	// 直到播放列表出现EXT-X-ENDLIST, ctx被取消或者调用了Status.Shutdown.
+	// 服务端支持增量更新(EXT-X-SERVER-CONTROL的CAN-SKIP-UNTIL)时通过_HLS_skip=YES只请求新增的部分.
+	// 直播的分片数未知, Status.Event的容量有限, 调用方需要持续读取事件(例如调用GenResult), 未及时读取时分片的事件被丢弃,
+	// 合并和转换的结果事件不会被丢弃. 播放列表暂时没有分片时等待下一次刷新.
+	Live bool
+	// Resume为true时, 若FileDir下存在TsFilePrefix对应的检查点文件, 则从检查点恢复, 仅下载缺失或损坏的分片.
+	// 续传需要FileDir和TsFilePrefix与中断前保持一致.
+	Resume bool
+	// MP4Backend 指定转换为mp4的方式, 默认为MP4BackendAuto
+	MP4Backend MP4Backend
+	// ChooseMedia 从主播放列表的EXT-X-MEDIA中选择与码流play一同下载的备选媒体, 为nil时使用DefaultRenditions.
+	// 选中的音频和视频在转换为mp4时与码流合并, 字幕合并为独立的文件.
+	ChooseMedia func(play PlayInfo, medias []Media) []Media
+	// SubtitleFormat 字幕备选媒体按照X-TIMESTAMP-MAP拼接后输出的格式, 默认为SubtitleFormatVTT
+	SubtitleFormat SubtitleFormat
+	// EmbedSubtitles为true时, 转换为mp4时将字幕作为文本轨道嵌入mp4, 字幕文件仍然保留
+	EmbedSubtitles bool
+	// KeyProvider 获取分片的解密秘钥, 为nil时通过HTTP GET请求EXT-X-KEY的URI.
+	// 设置后KEYFORMAT不为identity的秘钥也会交给KeyProvider获取.
+	KeyProvider KeyProvider
+	// KeyTTL 秘钥缓存的有效期, 过期后使用该秘钥的分片会重新获取秘钥, 为0表示不过期.
+	// 无论是否过期, 解密失败时都会重新获取一次秘钥.
+	KeyTTL time.Duration
+	// Output不为nil时, 分片下载到内存后按顺序直接写入Output, 不在FileDir中保存分片和合并后的文件.
+	// 仅输出主码流, 不下载备选媒体, 不支持ModelConvertToMP4和Resume. fMP4分片在EXT-X-MAP变化时会先写入初始化分片.
+	// 下载失败的分片不写入Output, 此时合并结果为失败.
+	Output io.Writer
+	// OutputBuffer 写入Output时内存中最多缓存的乱序完成的分片数, 默认为WorkerCnt的2倍
+	OutputBuffer int
+	// MirrorDecrypt为true时, ModelMirror保存解密后的分片和初始化分片, 播放列表中不再包含EXT-X-KEY.
+	// 为false时保存原始的加密数据, 秘钥保存为本地文件.
+	MirrorDecrypt bool
+	// RetryPolicy 请求失败时的重试策略, 零值使用默认策略, 404和403等永久失败不会重试
+	RetryPolicy RetryPolicy
+	// HTTPClient 请求播放列表, 秘钥和分片使用的客户端, 为nil时使用共享连接池, 等待响应头超时时间为30s的默认客户端.
+	// 可以通过Transport设置代理(支持socks5://), 自定义CA证书, 客户端证书和HTTP/2, 通过Jar携带登录得到的cookie.
+	HTTPClient *http.Client
+	// M3u8Content不为nil时作为入口播放列表的内容, 不再请求M3u8Url. 此时M3u8Url可以为空, 但直播模式下刷新仍然请求M3u8Url, 因此不能为空.
+	M3u8Content []byte
+	// BaseUrl 解析入口播放列表中的相对地址使用的地址, 为空时使用M3u8Url, M3u8Url也为空时使用当前目录.
+	// 可以是http(s)地址, file:地址或者本地路径, 本地目录按目录解析, 其他地址作为目录时需以/结尾.
+	BaseUrl string
+}
+
+// defaultHTTPClient 未设置Option.HTTPClient时使用, 所有下载任务共享同一个连接池.
+// 分片的响应体是流式读取的, 不设置整个请求的超时时间, 避免较大的分片在下载过程中被中断, 只限制等待响应头的时间.
+var defaultHTTPClient = &http.Client{
+	Transport: func() http.RoundTripper {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.MaxIdleConnsPerHost = 64
+		t.ResponseHeaderTimeout = 30 * time.Second
+		return t
+	}(),
 }
 
 func DownloadWithOpt(ctx context.Context, opt Option) (Status, error) {
-	return (&m3u8Downloader{
+	return newDownloader(opt).Download(ctx, opt.M3u8Url)
+}
+
+func newDownloader(opt Option) *m3u8Downloader {
+	md := &m3u8Downloader{
 		ChooseStream: opt.ChooseStream,
+		chooseMedia:  opt.ChooseMedia,
 		gp:           gpool.NewDefaultPool(opt.WorkerCnt),
 		qpsLimit: func() *rate.Limiter {
 			if opt.Qps <= 0 {
@@ -82,26 +164,57 @@ func DownloadWithOpt(ctx context.Context, opt Option) (Status, error) {
 			return rate.NewLimiter(rate.Limit(opt.Qps), opt.Qps)
 		}(),
 		doMerge:             opt.Model >= ModelMerged,
-		convToMP4:           opt.Model >= ModelConvertToMP4,
-		ffmpeg:              "ffmpeg",
+		convToMP4:           opt.Model == ModelConvertToMP4,
+		mirror:              opt.Model == ModelMirror,
+		mirrorDecrypt:       opt.MirrorDecrypt,
+		mp4Backend:          opt.MP4Backend,
+		subtitleFormat:      opt.SubtitleFormat,
+		embedSubtitles:      opt.EmbedSubtitles,
+		keyProvider:         opt.KeyProvider,
 		removeSubTs:         opt.RemoveSubTs,
 		fileDir:             opt.FileDir,
 		tsFilePrefix:        opt.TsFilePrefix,
 		allDone:             make(chan struct{}),
 		stopSignalChan:      make(chan struct{}),
 		httpRequestCallback: opt.HttpRequestCallback,
-	}).Download(ctx, opt.M3u8Url)
+		retry:               opt.RetryPolicy,
+		client:              opt.HTTPClient,
+		live:                opt.Live,
+		resume:              opt.Resume,
+		content:             opt.M3u8Content,
+		baseUrl:             opt.BaseUrl,
+		cp:                  &checkpointWriter{},
+		inits:               make(map[string]*initSegment),
+	}
+	var provider KeyProvider = httpKeyProvider{md: md}
+	if opt.KeyProvider != nil {
+		provider = opt.KeyProvider
+	}
+	md.keys = newKeyCache(provider, opt.KeyTTL, opt.RetryPolicy)
+	if opt.Output != nil {
+		limit := opt.OutputBuffer
+		if limit <= 0 {
+			limit = 2 * opt.WorkerCnt
+		}
+		md.out = newSegmentWriter(opt.Output, limit)
+	}
+	return md
 }
 
-// Segment, Merger和ConvToMP4中有且只有一个为非nil
+// Segment, Merged和ConvToMP4中最多有一个为非nil, 均为nil时为下载结束时写入检查点失败的事件
 type Event struct {
 	*Segment
-	Merged         *bool
-	MergedFilePath string
-	MergeErr       string // 仅在Merged不为nil且*Merged为false时不为nil
-	ConvToMP4      *bool
-	ConvToMP4Err   string // 仅在ConvToMP4不为nil且*ConvToMP4为false时不为nil
-	MP4FilePath    string
+	Rendition          *Media // Segment属于备选媒体时不为nil
+	KeyId              string // 解密Segment使用的秘钥的标识, 秘钥轮换后会发生变化, 分片未加密或未下载时为空
+	Merged             *bool
+	MergedFilePath     string
+	RenditionFilePaths []string // 与AllM3u8.Renditions一一对应的合并后的文件
+	MergeErr           string   // 仅在Merged不为nil且*Merged为false时不为nil
+	ConvToMP4          *bool
+	ConvToMP4Err       string // 仅在ConvToMP4不为nil且*ConvToMP4为false时不为nil
+	MP4FilePath        string
+	// CheckpointErr 写入检查点失败的原因, 为空表示写入成功或者未写入. 写入失败时续传从上一次成功写入的检查点开始
+	CheckpointErr string
 }
 
 type m3u8Downloader struct {
@@ -113,37 +226,79 @@ type m3u8Downloader struct {
 	tsFilePrefix        string
 	doMerge             bool
 	convToMP4           bool
-	ffmpeg              string
+	mirror              bool // 生成HLS目录而不是合并分片
+	mirrorDecrypt       bool
+	ffmpeg              string // 为空表示没有可用的ffmpeg
+	mp4Backend          MP4Backend
 	err                 sync.Map
 	removeSubTs         bool
 	m3u8                *M3u8
 	m3u8Copy            AllM3u8
+	segLock             sync.RWMutex      // 保护m3u8.Segments及m3u8Copy, 直播模式下刷新播放列表时会追加分片
+	mediaUrl            string            // 最终选中的媒体播放列表地址
+	imports             map[string]string // 主播放列表定义的变量, 供媒体播放列表的EXT-X-DEFINE导入
+	live                bool
+	keys                *keyCache      // 主下载器和子下载器共享的秘钥缓存
+	out                 *segmentWriter // 为nil表示分片保存到FileDir
+	keyProvider         KeyProvider
+	m3u8Url             string
+	content             []byte    // 入口播放列表的内容, 为nil时请求m3u8Url
+	baseUrl             string    // 解析入口播放列表使用的地址, 为空时使用m3u8Url
+	variant             *PlayInfo // 主播放列表中选中的码流
+	resume              bool
+	cp                  *checkpointWriter
+	chooseMedia         func(PlayInfo, []Media) []Media
+	medias              []Media           // 选中的备选媒体
+	renditions          []*m3u8Downloader // 下载备选媒体的子下载器, 与medias一一对应
+	media               *Media            // 子下载器下载的备选媒体, 主下载器为nil
+	subtitleFormat      SubtitleFormat
+	embedSubtitles      bool
+	cues                []subtitle.Cue // 拼接后的字幕, 仅字幕备选媒体使用
+	fmp4                bool           // 媒体播放列表由fMP4分片组成
+	initLock            sync.Mutex
+	inits               map[string]*initSegment // 已下载的初始化分片, key为mapKey
 	allDone             chan struct{}
+	doneErr             error     // allDone关闭前写入
+	reloadErr           error     // 直播模式下刷新播放列表最终失败的原因
+	lastReload          time.Time // 最近一次请求媒体播放列表的时间, 距今小于CAN-SKIP-UNTIL时才能请求增量更新
 	doneCnt             int32
 	eventChan           chan Event
+	eventLock           *sync.Mutex // 直播时保护分片事件的发送, 由主下载器和子下载器共享
 	stopSignalChan      chan struct{}
 	httpRequestCallback func(r *http.Request) error
+	retry               RetryPolicy
+	client              *http.Client // 为nil时使用defaultHTTPClient
+	allowFile           bool         // 是否允许读取file:地址, 仅入口播放列表或BaseUrl是本地文件或者由M3u8Content指定时为true
 }
 
 type Result struct {
 	Segments       []Segment
+	Renditions     []RenditionResult
 	Merged         bool
 	MergeErr       string
 	MergedFilePath string
 	ConvToMP4      bool
 	ConvToMP4Err   string
 	MP4FilePath    string
+	CheckpointErr  string // 最后一次写入检查点失败的原因
 }
 
 type AllM3u8 struct {
-	MastPlay *M3u8
-	Common   *M3u8
+	MastPlay   *M3u8
+	Common     *M3u8
+	Renditions []Rendition
 }
 
+// ErrShutdown 调用Status.Shutdown终止了下载
+var ErrShutdown = errors.New("download shutdown")
+
 type Status interface {
 	TsTotal() int    // 任务总数
 	TsComplete() int // 已经完成的任务数(包含失败和成功的任务)
 	Done() <-chan struct{}
+	// Err 返回下载终止的原因, Done关闭前以及正常结束时为nil, ctx被取消时为ctx.Err(), 调用Shutdown时为ErrShutdown,
+	// 直播模式下重试后仍然无法刷新播放列表时为刷新的错误, 此时已下载的分片照常合并
+	Err() error
 	M3u8() AllM3u8
 	Event() <-chan Event // 每完成一个任务向此chan中写入
 	Shutdown()           // 强制终止下载
@@ -154,21 +309,34 @@ type status struct {
 }
 
 func (s *status) TsTotal() int {
-	return len(s.md.m3u8.Segments)
+	return s.md.totalCnt()
 }
 
 func (s *status) TsComplete() int {
-	return int(atomic.LoadInt32(&s.md.doneCnt))
+	return s.md.completeCnt()
 }
 
 func (s *status) Done() <-chan struct{} {
 	return s.md.allDone
 }
 
+func (s *status) Err() error {
+	select {
+	case <-s.md.allDone:
+		return s.md.doneErr
+	default:
+		return nil
+	}
+}
+
 func (s *status) M3u8() AllM3u8 {
+	renditions := s.md.renditionList()
+	s.md.segLock.RLock()
+	defer s.md.segLock.RUnlock()
 	return AllM3u8{
-		Common:   s.md.m3u8Copy.Common.Copy(),
-		MastPlay: s.md.m3u8Copy.MastPlay.Copy(),
+		Common:     s.md.m3u8Copy.Common.Copy(),
+		MastPlay:   s.md.m3u8Copy.MastPlay.Copy(),
+		Renditions: renditions,
 	}
 }
 
@@ -190,10 +358,15 @@ func (md *m3u8Downloader) Download(ctx context.Context, m3u8Url string) (ret Sta
 	}
 
 	util.Async(ctx, func() {
+		var err error
 		defer func() {
+			if err == nil {
+				err = md.liveErr()
+			}
+			md.doneErr = md.stopReason(ctx, err)
 			close(md.allDone)
 		}()
-		if err = md.startDownload(); err != nil {
+		if err = md.startDownload(ctx); err != nil {
 			return
 		}
 		md.succ(ctx)
@@ -206,19 +379,42 @@ func (md *m3u8Downloader) Download(ctx context.Context, m3u8Url string) (ret Sta
 
 // 预处理
 func (md *m3u8Downloader) pre(ctx context.Context, m3u8Url string) (err error) {
-	if md.m3u8, err = md.Parse(ctx, m3u8Url); err != nil {
-		return fmt.Errorf("parse m3u8 error, %w", err)
+	if m3u8Url == "" && md.content == nil {
+		return errors.New("m3u8 url is empty")
 	}
+	if m3u8Url == "" && md.live {
+		return errors.New("live need m3u8 url to reload playlist")
+	}
+	if m3u8Url != "" {
+		if m3u8Url, err = fileUrl(m3u8Url); err != nil {
+			return err
+		}
+	}
+	if md.baseUrl == "" && m3u8Url == "" {
+		md.baseUrl = "."
+	}
+	if md.baseUrl != "" {
+		if md.baseUrl, err = fileUrl(md.baseUrl); err != nil {
+			return err
+		}
+	}
+	md.allowFile = md.content != nil || isFileUrl(m3u8Url) || isFileUrl(md.baseUrl)
 
-	md.m3u8Copy.Common = md.m3u8.Copy()
+	if md.out != nil && (md.convToMP4 || md.mirror || md.resume) {
+		return errors.New("convert to mp4, mirror and resume are not supported when writing to output")
+	}
 
 	if md.convToMP4 {
 		if !md.doMerge {
 			return errors.New("convert to mp4 need set merge be true")
 		}
 
-		if md.ffmpeg, err = exec.LookPath("ffmpeg"); err != nil {
-			return fmt.Errorf("set to mp4, but look ffmpeg error, %w", err)
+		if md.mp4Backend != MP4BackendNative {
+			ffmpeg, err := exec.LookPath("ffmpeg")
+			if err != nil && md.mp4Backend == MP4BackendFFmpeg {
+				return fmt.Errorf("set to mp4 with ffmpeg, but look ffmpeg error, %w", err)
+			}
+			md.ffmpeg = ffmpeg
 		}
 	}
 
@@ -233,10 +429,93 @@ func (md *m3u8Downloader) pre(ctx context.Context, m3u8Url string) (err error) {
 		md.tsFilePrefix = fmt.Sprintf("ts_%d", now)
 	}
 
-	if err = createIfNotExists(md.fileDir); err != nil {
+	if md.out == nil {
+		if err = createIfNotExists(md.fileDir); err != nil {
+			return err
+		}
+	}
+
+	if err = md.load(ctx, m3u8Url); err != nil {
 		return err
 	}
+	if md.out != nil {
+		// 写入Output时只输出主码流
+		md.medias = nil
+	}
+	if err = md.loadRenditions(ctx); err != nil {
+		return err
+	}
+	if md.convToMP4 && md.ffmpeg == "" && md.fmp4Mux() {
+		return errFMP4NeedFFmpeg
+	}
+
+	ended := md.m3u8.EndList
+	for _, r := range md.renditions {
+		ended = ended && r.m3u8.EndList
+	}
+	if md.live && !ended {
+		md.eventChan = make(chan Event, liveEventChanSize)
+	} else {
+		md.eventChan = make(chan Event, md.totalCnt()+10)
+	}
+	md.eventLock = &sync.Mutex{}
 
+	for _, r := range md.renditions {
+		r.eventChan, r.eventLock = md.eventChan, md.eventLock
+		if err = r.saveCheckpoint(true); err != nil {
+			return err
+		}
+	}
+	return md.saveCheckpoint(true)
+}
+
+// load 获取并解析m3u8Url对应的播放列表, 开启续传且存在检查点时从检查点恢复
+func (md *m3u8Downloader) load(ctx context.Context, m3u8Url string) (err error) {
+	md.m3u8Url = m3u8Url
+	if md.out == nil {
+		md.cp.path = md.checkpointPath()
+	}
+
+	var restored bool
+	if md.resume {
+		if restored, err = md.restore(m3u8Url); err != nil {
+			return fmt.Errorf("restore from checkpoint error, %w", err)
+		}
+	}
+
+	if !restored {
+		if md.m3u8, err = md.Parse(ctx, m3u8Url); err != nil {
+			return fmt.Errorf("parse m3u8 error, %w", err)
+		}
+	}
+
+	md.fmp4 = md.m3u8.IsFMP4()
+	md.m3u8Copy.Common = md.m3u8.Copy()
+	return nil
+}
+
+// stopReason 返回下载终止的原因, err为调度分片时的错误
+func (md *m3u8Downloader) stopReason(ctx context.Context, err error) error {
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case md.needStop():
+		return ErrShutdown
+	default:
+		return err
+	}
+}
+
+// liveErr 返回主下载器或子下载器刷新直播播放列表最终失败的原因
+func (md *m3u8Downloader) liveErr() error {
+	if md.reloadErr != nil {
+		return md.reloadErr
+	}
+	for _, r := range md.renditions {
+		if r.reloadErr != nil {
+			return r.reloadErr
+		}
+	}
 	return nil
 }
 
@@ -249,61 +528,210 @@ func (md *m3u8Downloader) needStop() bool {
 	}
 }
 
-func (md *m3u8Downloader) startDownload() error {
+func (md *m3u8Downloader) startDownload(ctx context.Context) error {
 	var wg sync.WaitGroup
-	for i := range md.m3u8.Segments {
-		if md.needStop() {
+	defer func() {
+		wg.Wait()
+		if err := md.saveCheckpoint(true); err != nil {
+			md.eventChan <- Event{Rendition: md.media, CheckpointErr: err.Error()}
+		}
+	}()
+
+	if md.out != nil {
+		// 停止时唤醒等待写入Output的分片
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				md.out.abort()
+			case <-md.stopSignalChan:
+				md.out.abort()
+			case <-done:
+			}
+		}()
+	}
+
+	for _, r := range md.renditions {
+		r := r
+		wg.Add(1)
+		util.Async(ctx, func() {
+			defer wg.Done()
+			_ = r.startDownload(ctx)
+		})
+	}
+
+	if err := md.schedule(ctx, &wg, 0); err != nil {
+		return err
+	}
+
+	if md.live && !md.m3u8.EndList {
+		return md.followLive(ctx, &wg)
+	}
+	return nil
+}
+
+// schedule 将索引从from开始的分片加入下载队列
+func (md *m3u8Downloader) schedule(ctx context.Context, wg *sync.WaitGroup, from int) error {
+	for idx := from; idx < md.segmentCnt(); idx++ {
+		if md.needStop() || ctx.Err() != nil {
 			return nil
 		}
 
-		idx := i
+		if seg := md.segment(idx); seg.ErrMsg != "" || md.segmentCompleted(idx) {
+			// 获取秘钥失败的分片和续传前已完成的分片无需下载
+			if md.out != nil {
+				md.out.skip(idx)
+			}
+			md.segmentDone(idx, nil)
+			continue
+		}
+
+		idx := idx
 		wg.Add(1)
 		if _, err := md.gp.AddTask(func() {
-			var (
-				body []byte
-				err  error
-			)
+			var err error
 			defer func() {
-				if err != nil {
-					md.m3u8.Segments[idx].ErrMsg = err.Error()
-				}
-
-				atomic.AddInt32(&md.doneCnt, 1)
-				md.eventChan <- Event{
-					Segment: &md.m3u8.Segments[idx],
+				if err != nil && md.out != nil {
+					// 失败的分片必须跳过, 否则之后的分片会一直等待写入Output
+					md.out.skip(idx)
 				}
-
+				md.segmentDone(idx, err)
 				wg.Done()
 			}()
 
-			if body, err = md.downloadAndDecryptOneTs(idx); err != nil {
+			// 排队期间ctx可能已经被取消
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			if err = md.ensureInit(ctx, md.segment(idx)); err != nil {
+				return
+			}
+			if md.out != nil {
+				err = md.writeSegment(ctx, idx)
+				return
+			}
+
+			var (
+				size int64
+				sum  string
+			)
+			if err = md.downloadSegment(ctx, idx, func(seg Segment, wrap segmentWrap) (err error) {
+				size, sum, err = md.saveSegment(ctx, md.fullPath(md.tsName(idx)), seg, wrap)
+				return err
+			}); err != nil {
 				return
 			}
-			err = md.save(idx, body)
+			md.recordSegment(idx, md.segment(idx).Sequence, size, sum)
 		}, nil, true); err != nil {
+			wg.Done()
 			return err
 		}
 	}
-	wg.Wait()
 	return nil
 }
 
-func (md *m3u8Downloader) succ(_ context.Context) {
-	if md.needStop() || !md.doMerge {
+func (md *m3u8Downloader) segmentCnt() int {
+	md.segLock.RLock()
+	defer md.segLock.RUnlock()
+	return len(md.m3u8.Segments)
+}
+
+func (md *m3u8Downloader) segment(idx int) Segment {
+	md.segLock.RLock()
+	defer md.segLock.RUnlock()
+	return md.m3u8.Segments[idx]
+}
+
+func (md *m3u8Downloader) segments() []Segment {
+	md.segLock.RLock()
+	defer md.segLock.RUnlock()
+	ret := make([]Segment, len(md.m3u8.Segments))
+	copy(ret, md.m3u8.Segments)
+	return ret
+}
+
+// segmentDone 记录分片的下载结果并发送事件
+func (md *m3u8Downloader) segmentDone(idx int, err error) {
+	md.segLock.Lock()
+	if err != nil {
+		md.m3u8.Segments[idx].ErrMsg = err.Error()
+	}
+	seg := md.m3u8.Segments[idx]
+	md.segLock.Unlock()
+
+	atomic.AddInt32(&md.doneCnt, 1)
+	ev := Event{
+		Segment:   &seg,
+		Rendition: md.media,
+		KeyId:     keyId(seg.EncryptMeta.SecretKey),
+	}
+	if err := md.saveCheckpoint(false); err != nil {
+		ev.CheckpointErr = err.Error()
+	}
+	md.sendSegmentEvent(ev)
+}
+
+// sendSegmentEvent 发送分片的事件. 直播时分片数未知, 通道中剩余的容量不超过liveResultEvents时丢弃分片的事件,
+// 避免调用方不读取事件时阻塞下载, 剩余的容量留给合并和转换等结果事件.
+func (md *m3u8Downloader) sendSegmentEvent(ev Event) {
+	if !md.live {
+		md.eventChan <- ev
 		return
 	}
+	md.eventLock.Lock()
+	defer md.eventLock.Unlock()
+	if len(md.eventChan) < cap(md.eventChan)-liveResultEvents {
+		md.eventChan <- ev
+	}
+}
 
-	// 合并文件
-	var fs []string
-	for idx, v := range md.m3u8.Segments {
-		if v.ErrMsg != "" {
-			continue
+func (md *m3u8Downloader) succ(ctx context.Context) {
+	if md.needStop() || ctx.Err() != nil || !md.doMerge {
+		return
+	}
+
+	if md.out != nil {
+		ok := true
+		ev := Event{Merged: &ok}
+		if _, skipped, err := md.out.result(); err != nil {
+			ok, ev.MergeErr = false, err.Error()
+		} else if skipped > 0 {
+			ok, ev.MergeErr = false, fmt.Sprintf("%d segments failed and were skipped in output", skipped)
 		}
-		fs = append(fs, md.fullPath(md.tsName(idx)))
+		md.eventChan <- ev
+		return
+	}
+
+	if md.mirror {
+		ok := true
+		ev := Event{Merged: &ok}
+		var err error
+		if ev.MergedFilePath, ev.RenditionFilePaths, err = md.writeMirror(ctx); err != nil {
+			ok, ev = false, Event{Merged: &ok, MergeErr: err.Error()}
+		}
+		md.eventChan <- ev
+		if ok {
+			md.removeCheckpoint()
+			for _, r := range md.renditions {
+				r.removeCheckpoint()
+			}
+		}
+		return
 	}
 
-	mergedPath := md.tsFilePrefix + ".ts"
-	if err := md.merge(fs, mergedPath); err != nil {
+	mergedPath, err := md.mergeSegments(ctx)
+	renditionPaths := make([]string, len(md.renditions))
+	for i, r := range md.renditions {
+		if err != nil || r.isSubtitles() {
+			continue
+		}
+		renditionPaths[i], err = r.mergeSegments(ctx)
+	}
+	if err == nil {
+		err = md.mergeSubtitles(ctx, mergedPath, renditionPaths)
+	}
+	if err != nil {
 		md.eventChan <- Event{
 			Merged: func() *bool {
 				t := false
@@ -319,15 +747,59 @@ func (md *m3u8Downloader) succ(_ context.Context) {
 			t := true
 			return &t
 		}(),
-		MergedFilePath: mergedPath,
+		MergedFilePath:     mergedPath,
+		RenditionFilePaths: renditionPaths,
+	}
+	md.removeCheckpoint()
+	for _, r := range md.renditions {
+		r.removeCheckpoint()
+	}
+
+	if md.needStop() || ctx.Err() != nil || !md.convToMP4 {
+		return
+	}
+
+	// 音频和视频备选媒体与主码流合并到同一个mp4中, 字幕仅在EmbedSubtitles为true时嵌入
+	var (
+		inputs = []string{mergedPath}
+		subs   []subtitleTrack
+	)
+	for i, r := range md.renditions {
+		switch {
+		case r.muxable():
+			inputs = append(inputs, renditionPaths[i])
+		case r.isSubtitles() && md.embedSubtitles && r.cues != nil:
+			subs = append(subs, subtitleTrack{path: renditionPaths[i], language: r.media.Language, cues: r.cues})
+		}
 	}
 
-	if md.needStop() || !md.convToMP4 {
+	// 合并后的fMP4已经是mp4文件, 无需转换
+	if md.fmp4 && len(inputs) == 1 && len(subs) == 0 {
+		if md.removeSubTs {
+			_ = os.RemoveAll(md.fileDir)
+		}
+		md.eventChan <- Event{
+			ConvToMP4: func() *bool {
+				t := true
+				return &t
+			}(),
+			MP4FilePath: mergedPath,
+		}
 		return
 	}
 
 	mp4FilePath := md.tsFilePrefix + ".mp4"
-	if err := md.toMP4(mergedPath, mp4FilePath); err != nil {
+	output := mp4FilePath
+	if md.fmp4 {
+		// 合并后的fMP4与输出文件同名, 先输出到临时文件
+		output = md.tsFilePrefix + ".muxing.mp4"
+	}
+	if err = md.toMP4(ctx, output, inputs, subs); err == nil && output != mp4FilePath {
+		if err = os.Rename(output, mp4FilePath); err != nil {
+			err = fmt.Errorf("os.Rename %s error, %w", output, err)
+		}
+	}
+	if err != nil {
 		md.eventChan <- Event{
 			ConvToMP4: func() *bool {
 				t := false
@@ -339,7 +811,11 @@ func (md *m3u8Downloader) succ(_ context.Context) {
 	}
 
 	if md.removeSubTs {
-		_ = os.Remove(mergedPath)
+		for _, v := range inputs {
+			if v != mp4FilePath {
+				_ = os.Remove(v)
+			}
+		}
 		_ = os.RemoveAll(md.fileDir)
 	}
 
@@ -350,8 +826,31 @@ func (md *m3u8Downloader) succ(_ context.Context) {
 		}(),
 		MP4FilePath: mp4FilePath,
 	}
+}
+
+// mergeSegments 合并下载成功的分片并返回合并后的文件路径, fMP4分片在EXT-X-MAP变化处写入对应的初始化分片
+func (md *m3u8Downloader) mergeSegments(ctx context.Context) (string, error) {
+	var (
+		fs       []string
+		lastInit string
+	)
+	for idx, v := range md.segments() {
+		if v.ErrMsg != "" {
+			continue
+		}
+		// 续传时已完成的分片对应的初始化分片可能尚未下载
+		if err := md.ensureInit(ctx, v); err != nil {
+			return "", err
+		}
+		if p := md.initPath(v); p != "" && p != lastInit {
+			fs = append(fs, p)
+			lastInit = p
+		}
+		fs = append(fs, md.fullPath(md.tsName(idx)))
+	}
 
-	return
+	mergedPath := md.tsFilePrefix + md.mergedExt()
+	return mergedPath, md.merge(fs, mergedPath)
 }
 
 // merge 合并文件主函数
@@ -364,7 +863,13 @@ func (md *m3u8Downloader) merge(subTsFilePaths []string, mergedTsFilePath string
 		_ = mergedTsFile.Close()
 	}()
 
-	for _, v := range subTsFilePaths {
+	// 同一个初始化分片可能出现多次, 在最后一次使用后再删除
+	last := make(map[string]int)
+	for i, v := range subTsFilePaths {
+		last[v] = i
+	}
+
+	for i, v := range subTsFilePaths {
 		if err = func() error {
 			subTsFile, err := os.OpenFile(v, os.O_CREATE|os.O_RDONLY, os.ModePerm)
 			if err != nil {
@@ -374,16 +879,11 @@ func (md *m3u8Downloader) merge(subTsFilePaths []string, mergedTsFilePath string
 				_ = subTsFile.Close()
 			}()
 
-			body, err := ioutil.ReadAll(subTsFile)
-			if err != nil {
-				return fmt.Errorf("ioutil.ReadAll with %s error, %w", v, err)
-			}
-
-			if _, err = mergedTsFile.Write(body); err != nil {
+			if _, err = copyBuffer(mergedTsFile, subTsFile); err != nil {
 				return fmt.Errorf("write to merged file error, %w", err)
 			}
 
-			if md.removeSubTs {
+			if md.removeSubTs && last[v] == i {
 				if err = os.Remove(v); err != nil {
 					return fmt.Errorf("os.Remove %s error, %w", v, err)
 				}
@@ -396,197 +896,528 @@ func (md *m3u8Downloader) merge(subTsFilePaths []string, mergedTsFilePath string
 	return nil
 }
 
-func (md *m3u8Downloader) toMP4(tsPath string, mp4Path string) error {
-	// ffmpeg -i ${tsPath} -acodec copy -vcodec copy -f mp4 ${mp4Path}
-	_, err := exec.Command(md.ffmpeg, []string{"-i", tsPath, "-acodec", "copy", "-vcodec", "copy", "-f", "mp4", mp4Path}...).Output()
-	return err
+// toMP4 将一个或多个ts文件中的音视频以及字幕合并转换为mp4
+func (md *m3u8Downloader) toMP4(ctx context.Context, mp4Path string, tsPaths []string, subs []subtitleTrack) error {
+	// 内置remux只支持ts, 直播起始时没有分片, 无法在下载前判断是否为fMP4
+	if md.fmp4Mux() {
+		if md.ffmpeg == "" {
+			return errFMP4NeedFFmpeg
+		}
+		return md.ffmpegToMP4(ctx, mp4Path, tsPaths, subs)
+	}
+	if md.mp4Backend == MP4BackendFFmpeg {
+		return md.ffmpegToMP4(ctx, mp4Path, tsPaths, subs)
+	}
+
+	err := remuxToMP4(mp4Path, tsPaths, subs)
+	if err == nil || md.mp4Backend == MP4BackendNative || md.ffmpeg == "" {
+		return err
+	}
+
+	// 内置remux失败时回退到ffmpeg
+	if ffErr := md.ffmpegToMP4(ctx, mp4Path, tsPaths, subs); ffErr != nil {
+		return fmt.Errorf("remux error: %v, and fallback to ffmpeg error: %w", err, ffErr)
+	}
+	return nil
+}
+
+func remuxToMP4(mp4Path string, tsPaths []string, subs []subtitleTrack) (err error) {
+	var inputs []io.Reader
+	for _, v := range tsPaths {
+		in, err := os.Open(v)
+		if err != nil {
+			return fmt.Errorf("os.Open %s error, %w", v, err)
+		}
+		defer func() {
+			_ = in.Close()
+		}()
+		inputs = append(inputs, bufio.NewReaderSize(in, 1<<20))
+	}
+
+	out, err := os.OpenFile(mp4Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile %s error, %w", mp4Path, err)
+	}
+	defer func() {
+		if cErr := out.Close(); err == nil && cErr != nil {
+			err = fmt.Errorf("close %s error, %w", mp4Path, cErr)
+		}
+		if err != nil {
+			_ = os.Remove(mp4Path)
+		}
+	}()
+
+	var subtitles []remux.Subtitle
+	for _, v := range subs {
+		subtitles = append(subtitles, v.remux())
+	}
+	if err = remux.TsToMP4WithSubtitles(out, subtitles, inputs...); err != nil {
+		return fmt.Errorf("remux ts to mp4 error, %w", err)
+	}
+	return nil
 }
 
-func (md *m3u8Downloader) downloadAndDecryptOneTs(idx int) (body []byte, err error) {
-	seg := md.m3u8.Segments[idx]
-	util.Retry(func(sn int) (end bool) {
-		body, err = md.httpGet(seg.Url)
-		return err == nil
-	}, 10, time.Second*10)
+func (md *m3u8Downloader) ffmpegToMP4(ctx context.Context, mp4Path string, tsPaths []string, subs []subtitleTrack) error {
+	// ffmpeg -y -i ${tsPath} [-i ${audioPath} -i ${subtitlePath} -map 0 -map 1 -map 2 -scodec mov_text] -acodec copy -vcodec copy -f mp4 ${mp4Path}
+	inputs := append([]string{}, tsPaths...)
+	for _, v := range subs {
+		inputs = append(inputs, v.path)
+	}
+	args := []string{"-y"}
+	for _, v := range inputs {
+		args = append(args, "-i", v)
+	}
+	if len(inputs) > 1 {
+		for i := range inputs {
+			args = append(args, "-map", strconv.Itoa(i))
+		}
+	}
+	if len(subs) > 0 {
+		args = append(args, "-scodec", "mov_text")
+	}
+	args = append(args, "-acodec", "copy", "-vcodec", "copy", "-f", "mp4", mp4Path)
+	output, err := exec.CommandContext(ctx, md.ffmpeg, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg error, %w, output:%s", err, lastLines(output, 10))
+	}
+	return nil
+}
 
+// segmentWrap 在下载的数据上叠加解密等处理
+type segmentWrap func(r io.Reader) (io.Reader, error)
+
+// downloadSegment 下载并解密索引为idx的分片, fetch负责下载经过wrap处理后的数据并写出
+func (md *m3u8Downloader) downloadSegment(ctx context.Context, idx int, fetch func(seg Segment, wrap segmentWrap) error) error {
+	if md.keepEncrypted() {
+		return md.mirrorSegment(ctx, idx, fetch)
+	}
+	key, err := md.fetchSegment(ctx, md.segment(idx), md.segmentExt(), fetch)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if key != nil {
+		md.useKey(idx, key)
 	}
+	return nil
+}
 
+// fetchSegment 下载并解密分片, ext为分片的扩展名, 返回解密使用的秘钥, 分片未加密时返回nil
+func (md *m3u8Downloader) fetchSegment(ctx context.Context, seg Segment, ext string, fetch func(seg Segment, wrap segmentWrap) error) ([]byte, error) {
 	if !seg.IsEncrypted() {
-		return body, nil
+		return nil, fetch(seg, nil)
 	}
 
-	body, err = decryptByAES128(body, []byte(seg.EncryptMeta.SecretKey), []byte(seg.EncryptMeta.IV))
+	iv, err := seg.aesIV()
 	if err != nil {
 		return nil, err
 	}
 
-	for i, v := range body {
-		if v == uint8(71) {
-			body = body[i:]
-			break
+	var wrap func(key []byte) segmentWrap
+	switch seg.EncryptMeta.Method {
+	case CryptMethodSampleAESCTR:
+		if ext != ".m4s" {
+			return nil, fmt.Errorf("%s is only supported for fMP4 segments, not %s", CryptMethodSampleAESCTR, ext)
 		}
+		// 按cenc方案解密moof中senc描述的样本, 需要完整的分片
+		wrap = func(key []byte) segmentWrap {
+			return func(r io.Reader) (io.Reader, error) {
+				body, err := io.ReadAll(r)
+				if err != nil {
+					return nil, fmt.Errorf("io.ReadAll error, %w", err)
+				}
+				if err = remux.DecryptCENC(body, key); err != nil {
+					return nil, &decryptError{fmt.Errorf("decrypt sample-aes-ctr error, %w", err)}
+				}
+				return bytes.NewReader(body), nil
+			}
+		}
+	case CryptMethodSampleAES:
+		if ext != ".ts" {
+			return nil, fmt.Errorf("%s is not supported for %s segments", CryptMethodSampleAES, ext)
+		}
+		// SAMPLE-AES按PES解密, 需要完整的分片
+		wrap = func(key []byte) segmentWrap {
+			return func(r io.Reader) (io.Reader, error) {
+				body, err := io.ReadAll(r)
+				if err != nil {
+					return nil, fmt.Errorf("io.ReadAll error, %w", err)
+				}
+				if body, err = remux.DecryptSampleAES(body, key, iv); err != nil {
+					return nil, &decryptError{fmt.Errorf("decrypt sample-aes error, %w", err)}
+				}
+				return bytes.NewReader(body), nil
+			}
+		}
+	default:
+		wrap = func(key []byte) segmentWrap {
+			return func(r io.Reader) (io.Reader, error) {
+				ret, err := newCBCReader(r, key, iv)
+				if err != nil || ext != ".ts" {
+					return ret, err
+				}
+				return &tsSyncReader{r: ret}, nil
+			}
+		}
+	}
+
+	return md.decrypt(ctx, seg, func(key []byte) error {
+		return fetch(seg, wrap(key))
+	})
+}
+
+// retryFetch 按重试策略执行下载f, 解密错误和永久失败直接返回
+func (md *m3u8Downloader) retryFetch(ctx context.Context, f func() error) error {
+	return md.retry.do(ctx, f)
+}
+
+// copySegment 下载分片并经过wrap处理后写入w
+func (md *m3u8Downloader) copySegment(ctx context.Context, seg Segment, wrap segmentWrap, w io.Writer) (int64, error) {
+	body, err := md.httpOpen(ctx, seg.Url, seg.ByteRange)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+
+	var r io.Reader = body
+	if wrap != nil {
+		if r, err = wrap(r); err != nil {
+			return 0, err
+		}
+	}
+	n, err := copyBuffer(w, r)
+	if err != nil && !isDecryptError(err) {
+		err = fmt.Errorf("write segment error, %w", err)
 	}
+	return n, err
+}
+
+// saveSegment 下载分片写入path, 返回写入的字节数和sha256.
+// 先写入临时文件, 完整写入后再重命名, 避免留下不完整的分片.
+func (md *m3u8Downloader) saveSegment(ctx context.Context, path string, seg Segment, wrap segmentWrap) (size int64, sum string, err error) {
+	err = md.retryFetch(ctx, func() error {
+		tmp := path + ".part"
+		f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("os.OpenFile %s error, %w", tmp, err)
+		}
+		h := sha256.New()
+		size, err = md.copySegment(ctx, seg, wrap, io.MultiWriter(f, h))
+		if cErr := f.Close(); err == nil && cErr != nil {
+			err = fmt.Errorf("close %s error, %w", tmp, cErr)
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		if err = os.Rename(tmp, path); err != nil {
+			return fmt.Errorf("os.Rename %s error, %w", tmp, err)
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	return size, sum, err
+}
 
-	return body, nil
+// readSegment 下载分片到内存
+func (md *m3u8Downloader) readSegment(ctx context.Context, seg Segment, wrap segmentWrap) ([]byte, error) {
+	var buf bytes.Buffer
+	err := md.retryFetch(ctx, func() error {
+		buf.Reset()
+		_, err := md.copySegment(ctx, seg, wrap, &buf)
+		return err
+	})
+	return buf.Bytes(), err
 }
 
 func (md *m3u8Downloader) tsName(idx int) string {
-	return md.tsFilePrefix + fmt.Sprintf("_%d.ts", idx)
+	return md.tsFilePrefix + fmt.Sprintf("_%d%s", idx, md.segmentExt())
+}
+
+// segmentExt 返回分片文件的扩展名
+func (md *m3u8Downloader) segmentExt() string {
+	switch {
+	case md.fmp4:
+		return ".m4s"
+	case md.isSubtitles():
+		return ".vtt"
+	default:
+		return ".ts"
+	}
+}
+
+// mergedExt 返回合并后文件的扩展名
+func (md *m3u8Downloader) mergedExt() string {
+	switch {
+	case md.fmp4:
+		return ".mp4"
+	case md.isSubtitles() && md.subtitleFormat == SubtitleFormatSRT:
+		return ".srt"
+	default:
+		return md.segmentExt()
+	}
 }
 
 func (md *m3u8Downloader) fullPath(tsName string) string {
 	return md.fileDir + "/" + tsName
 }
 
-// 保存索引为idx的文件
-func (md *m3u8Downloader) save(idx int, body []byte) error {
-	path := md.fullPath(md.tsName(idx))
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+func (md *m3u8Downloader) httpGet(ctx context.Context, u string) ([]byte, error) {
+	return md.httpGetRange(ctx, u, nil)
+}
+
+// responseBody 带有重定向之后的最终地址的响应体
+type responseBody struct {
+	io.ReadCloser
+	url string
+}
+
+// httpGetPlaylist 获取播放列表, 同时返回重定向之后的最终地址, EXT-X-DEFINE的QUERYPARAM取该地址中的查询参数
+func (md *m3u8Downloader) httpGetPlaylist(ctx context.Context, u string) ([]byte, string, error) {
+	body, err := md.httpOpen(ctx, u, nil)
 	if err != nil {
-		return fmt.Errorf("error in os.OpenFile, %w", err)
+		return nil, "", err
 	}
 	defer func() {
-		_ = f.Close()
+		_ = body.Close()
 	}()
-	if _, err = f.Write(body); err != nil {
-		return fmt.Errorf("write to file error, %w", err)
+
+	ret, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("io.ReadAll error, %w", err)
 	}
-	return nil
+	if v, ok := body.(*responseBody); ok {
+		u = v.url
+	}
+	return ret, u, nil
+}
+
+// httpGetRange 获取u中由br描述的字节范围, br为nil时获取整个资源
+func (md *m3u8Downloader) httpGetRange(ctx context.Context, u string, br *ByteRange) ([]byte, error) {
+	body, err := md.httpOpen(ctx, u, br)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+
+	ret, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll error, %w", err)
+	}
+	return ret, nil
 }
 
-func (md *m3u8Downloader) httpGet(u string) ([]byte, error) {
+// httpOpen 请求u并返回由br描述的字节范围的响应体, br为nil时返回整个资源, 调用方负责关闭.
+// 服务端忽略Range返回200时跳过范围之前的数据. 响应体的长度与br不一致时, 读取时返回错误.
+// data:和file:地址不经过限流和HttpRequestCallback, 直接读取内容.
+// 入口播放列表来自远程时不允许读取file:地址, 避免远程的播放列表读取本机的文件.
+func (md *m3u8Downloader) httpOpen(ctx context.Context, u string, br *ByteRange) (io.ReadCloser, error) {
+	switch {
+	case strings.HasPrefix(u, "data:"):
+		return openDataUrl(u, br)
+	case isFileUrl(u):
+		if !md.allowFile {
+			return nil, Permanent(fmt.Errorf("file url %s is not allowed in remote playlist", u))
+		}
+		return openFileUrl(u, br)
+	}
 	if md.qpsLimit != nil {
-		if err := md.qpsLimit.Wait(context.Background()); err != nil {
+		if err := md.qpsLimit.Wait(ctx); err != nil {
 			return nil, fmt.Errorf("wait on limiter error, %w", err)
 		}
 	}
-	req, err := http.NewRequest(http.MethodGet, u, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return nil, fmt.Errorf("new request fail, %w", err)
 	}
+	if br != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", br.Offset, br.Offset+br.Length-1))
+	}
 	if md.httpRequestCallback != nil {
 		if err = md.httpRequestCallback(req); err != nil {
 			return nil, fmt.Errorf("http request callback exec fail, %w", err)
 		}
 	}
-	resp, err := (&http.Client{
-		Timeout: 30 * time.Second,
-	}).Do(req)
+	client := md.client
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("http get %s error, %w", u, err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("response StatusCode is %d, Status is %s", resp.StatusCode, resp.Status)
-	}
 
-	defer func() {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusPartialContent && br != nil:
+		if err = checkContentRange(resp.Header.Get("Content-Range"), br); err != nil {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+	default:
 		_ = resp.Body.Close()
-	}()
+		return nil, &StatusError{
+			Url:        u,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	if br == nil {
+		return &responseBody{ReadCloser: resp.Body, url: resp.Request.URL.String()}, nil
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		if n, err := io.CopyN(io.Discard, resp.Body, br.Offset); err != nil {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("byte range %d@%d out of body size %d", br.Length, br.Offset, n)
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: &exactReader{r: resp.Body, n: br.Length, strict: resp.StatusCode == http.StatusPartialContent},
+		Closer: resp.Body,
+	}, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// checkContentRange 校验206响应的Content-Range与请求的字节范围一致, 格式为bytes first-last/complete-length
+func checkContentRange(v string, br *ByteRange) error {
+	spec := strings.TrimSpace(strings.TrimPrefix(v, "bytes"))
+	if pos := strings.Index(spec, "/"); pos >= 0 {
+		spec = spec[:pos]
+	}
+	pos := strings.Index(spec, "-")
+	if pos < 0 {
+		return fmt.Errorf("response header Content-Range %q is illegal", v)
+	}
+	first, err := strconv.ParseInt(spec[:pos], 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("io.ReadAll error, %w", err)
+		return fmt.Errorf("response header Content-Range %q is illegal, %w", v, err)
+	}
+	last, err := strconv.ParseInt(spec[pos+1:], 10, 64)
+	if err != nil {
+		return fmt.Errorf("response header Content-Range %q is illegal, %w", v, err)
 	}
-	return body, nil
+	if first != br.Offset || last != br.Offset+br.Length-1 {
+		return fmt.Errorf("response header Content-Range %q mismatch with byte range %d@%d", v, br.Length, br.Offset)
+	}
+	return nil
 }
 
 func (md *m3u8Downloader) Parse(ctx context.Context, link string) (ret *M3u8, err error) {
-	var body []byte
-	util.Retry(func(sn int) (end bool) {
-		body, err = md.httpGet(link)
-		return err == nil
-	}, 10, time.Second*10)
-	if err != nil {
-		return nil, fmt.Errorf("http request[%s] fail, %v", link, err)
+	body, fetched := md.content, link
+	if link != md.m3u8Url || body == nil {
+		if err = md.retry.do(ctx, func() (err error) {
+			md.lastReload = time.Now()
+			body, fetched, err = md.httpGetPlaylist(ctx, link)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("http request[%s] fail, %v", link, err)
+		}
 	}
 
 	//解析请求体内容，m3u8中的内容
-	m3u8, err := Parse(body, link)
+	m3u8, err := parse(body, md.playlistBase(link), parseConfig{imports: md.imports, queryUrl: fetched})
 	if err != nil {
 		return nil, err
 	}
 
 	if len(m3u8.MastPlayList) > 0 {
 		md.m3u8Copy.MastPlay = m3u8
-		if len(m3u8.MastPlayList) == 1 {
-			return md.Parse(ctx, m3u8.MastPlayList[0].M3u8Url)
+		md.imports = m3u8.Variables
+		var play PlayInfo
+		switch {
+		case len(m3u8.MastPlayList) == 1:
+			play = m3u8.MastPlayList[0]
+		case md.ChooseStream != nil:
+			play = md.ChooseStream(m3u8.MastPlayList)
+		default:
+			return nil, fmt.Errorf("link(%s) is master play list and has more than 1 stream, but ChooseStream not set", link)
 		}
-		if md.ChooseStream != nil {
-			return md.Parse(ctx, md.ChooseStream(m3u8.MastPlayList).M3u8Url)
+		md.variant = &play
+		if md.chooseMedia != nil {
+			md.medias = md.chooseMedia(play, m3u8.MediaList)
+		} else {
+			md.medias = DefaultRenditions(play, m3u8.MediaList)
 		}
-		return nil, fmt.Errorf("link(%s) is master play list and has more than 1 stream, but ChooseStream not set", link)
+		return md.Parse(ctx, play.M3u8Url)
 	}
 
-	if len(m3u8.Segments) == 0 {
+	// 直播的播放列表可能暂时没有分片, 等待刷新后出现
+	if len(m3u8.Segments) == 0 && !(md.live && !m3u8.EndList) {
 		return nil, errors.New("ts files list is empty")
 	}
 
-	secretKeys := make(map[string]*string)
-	for _, v := range m3u8.Segments {
-		if !v.IsEncrypted() {
-			continue
-		}
+	md.mediaUrl = link
+	md.markUnsupported(m3u8.Segments)
+	return m3u8, nil
+}
 
-		skUrl := v.EncryptMeta.SecretKeyUrl
-		if _, ok := secretKeys[skUrl]; ok {
-			continue
-		}
-		secretKeys[skUrl] = new(string)
+// playlistBase 返回解析link对应的播放列表时使用的地址, 入口播放列表使用BaseUrl
+func (md *m3u8Downloader) playlistBase(link string) string {
+	if link == md.m3u8Url && md.baseUrl != "" {
+		return md.baseUrl
 	}
+	return link
+}
 
-	var errMap sync.Map
-
-	// 并发获取解密秘钥
-	var wg sync.WaitGroup
-	for k, v := range secretKeys {
-		secretUrl := k
-		secretValue := v
-
-		wg.Add(1)
-		if _, err := md.gp.AddTask(func() {
-			defer wg.Done()
-			var (
-				body []byte
-				err  error
-			)
-			util.Retry(func(sn int) (end bool) {
-				body, err = md.httpGet(secretUrl)
-				return err == nil
-			}, 10, 10*time.Second)
-
-			if err == nil {
-				*secretValue = string(body)
-			} else {
-				errMap.Store(secretUrl, err)
-			}
-		}, nil, true); err != nil {
-			_ = md.gp.Stop()
-			return nil, fmt.Errorf("add task to gpool error, %w", err)
-		}
+// unsupportedEncryption 返回无法使用clear key解密的原因, 可以解密时返回nil.
+// 未设置KeyProvider时只支持identity格式的秘钥.
+func (md *m3u8Downloader) unsupportedEncryption(meta EncryptMeta) error {
+	if md.keyProvider == nil && !meta.IsClearKey() {
+		return fmt.Errorf("key format %s is not supported", meta.KeyFormat)
 	}
-	wg.Wait()
-
-	md.eventChan = make(chan Event, len(m3u8.Segments)+10)
+	return nil
+}
 
-	for i := range m3u8.Segments {
-		if !m3u8.Segments[i].IsEncrypted() {
+// markUnsupported 为无法解密的分片设置ErrMsg, 这些分片不会被下载. 秘钥在下载分片时按需获取.
+func (md *m3u8Downloader) markUnsupported(segs []Segment) {
+	for i := range segs {
+		if !segs[i].IsEncrypted() {
 			continue
 		}
-
-		skUrl := m3u8.Segments[i].EncryptMeta.SecretKeyUrl
-		if err, ok := errMap.Load(skUrl); ok {
-			m3u8.Segments[i].ErrMsg = err.(error).Error()
-			md.doneCnt++
-			md.eventChan <- Event{
-				Segment: &md.m3u8.Segments[i],
-			}
-			continue
+		if err := md.unsupportedEncryption(segs[i].EncryptMeta); err != nil {
+			segs[i].ErrMsg = err.Error()
 		}
+	}
+}
+
+// decrypt 使用缓存的秘钥执行解密fn, fn返回decryptError时秘钥可能已经轮换或过期, 重新获取秘钥后再重试一次.
+// 返回解密使用的秘钥.
+func (md *m3u8Downloader) decrypt(ctx context.Context, seg Segment, fn func(key []byte) error) ([]byte, error) {
+	key, err := md.keys.get(ctx, seg.EncryptMeta, nil)
+	if err != nil {
+		return nil, fmt.Errorf("get secret key %s error, %w", seg.EncryptMeta.SecretKeyUrl, err)
+	}
+	if err = md.verifyKey(seg.EncryptMeta.SecretKeyUrl, key); err != nil {
+		return nil, err
+	}
+	if err = fn(key); err == nil || !isDecryptError(err) {
+		return key, err
+	}
 
-		m3u8.Segments[i].EncryptMeta.SecretKey = *secretKeys[skUrl]
+	newKey, kErr := md.keys.get(ctx, seg.EncryptMeta, key)
+	if kErr != nil || bytes.Equal(newKey, key) {
+		return nil, err
 	}
+	if err = md.verifyKey(seg.EncryptMeta.SecretKeyUrl, newKey); err != nil {
+		return nil, err
+	}
+	if err = fn(newKey); err != nil {
+		return nil, err
+	}
+	return newKey, nil
+}
 
-	return m3u8, nil
+// useKey 记录分片解密使用的秘钥
+func (md *m3u8Downloader) useKey(idx int, key []byte) {
+	md.segLock.Lock()
+	md.m3u8.Segments[idx].EncryptMeta.SecretKey = string(key)
+	md.segLock.Unlock()
 }
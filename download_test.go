@@ -0,0 +1,252 @@
+package m3u8
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHttpGetRange(t *testing.T) {
+	Convey("TestHttpGetRange", t, func() {
+		content := []byte("0123456789abcdefghij")
+		var ranges []string
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ranges = append(ranges, r.Header.Get("Range"))
+			switch r.URL.Path {
+			case "/full":
+				// 忽略Range
+				_, _ = w.Write(content)
+			case "/bad":
+				w.Header().Set("Content-Range", "bytes 0-3/20")
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write(content[:4])
+			default:
+				http.ServeContent(w, r, "seg.ts", time.Time{}, bytes.NewReader(content))
+			}
+		}))
+		defer s.Close()
+
+		md := &m3u8Downloader{}
+		br := &ByteRange{Length: 5, Offset: 10}
+
+		body, err := md.httpGetRange(context.Background(), s.URL+"/seg.ts", br)
+		So(err, ShouldEqual, nil)
+		So(string(body), ShouldEqual, "abcde")
+		So(ranges[0], ShouldEqual, "bytes=10-14")
+
+		body, err = md.httpGetRange(context.Background(), s.URL+"/full", br)
+		So(err, ShouldEqual, nil)
+		So(string(body), ShouldEqual, "abcde")
+
+		_, err = md.httpGetRange(context.Background(), s.URL+"/full", &ByteRange{Length: 5, Offset: 18})
+		So(err, ShouldNotEqual, nil)
+
+		_, err = md.httpGetRange(context.Background(), s.URL+"/bad", br)
+		So(err, ShouldNotEqual, nil)
+
+		body, err = md.httpGet(context.Background(), s.URL+"/seg.ts")
+		So(err, ShouldEqual, nil)
+		So(body, ShouldResemble, content)
+		So(ranges[len(ranges)-1], ShouldEqual, "")
+	})
+}
+
+func TestDownloadCancel(t *testing.T) {
+	Convey("TestDownloadCancel", t, func() {
+		started := make(chan struct{}, 100)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/index.m3u8" {
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n")
+				for i := 0; i < 20; i++ {
+					fmt.Fprintf(w, "#EXTINF:2,\n%d.ts\n", i)
+				}
+				fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+				return
+			}
+			// 分片请求一直阻塞直到客户端取消
+			started <- struct{}{}
+			<-r.Context().Done()
+		}))
+		defer s.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, t.TempDir(), "out", 4)
+		st, err := DownloadWithOpt(ctx, opt)
+		So(err, ShouldEqual, nil)
+		So(st.Err(), ShouldEqual, nil)
+
+		<-started
+		cancel()
+		select {
+		case <-st.Done():
+		case <-time.After(5 * time.Second):
+			So("download not canceled", ShouldBeEmpty)
+		}
+		So(st.Err(), ShouldEqual, context.Canceled)
+
+		ret := GenResult(st, false)
+		So(ret.Merged, ShouldBeFalse)
+		for _, v := range ret.Segments {
+			So(v.ErrMsg, ShouldNotEqual, "")
+		}
+	})
+}
+
+type countTransport struct {
+	n int32
+}
+
+func (t *countTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.n, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDownloadHTTPClient(t *testing.T) {
+	Convey("TestDownloadHTTPClient", t, func() {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c, err := r.Cookie("session"); err != nil || c.Value != "login" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if r.URL.Path == "/index.m3u8" {
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\n0.ts\n#EXTINF:2,\n1.ts\n#EXT-X-ENDLIST\n")
+				return
+			}
+			fmt.Fprint(w, r.URL.Path)
+		}))
+		defer s.Close()
+
+		// 登录得到的cookie通过Jar携带
+		jar, _ := cookiejar.New(nil)
+		u, _ := url.Parse(s.URL)
+		jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "login"}})
+		transport := &countTransport{}
+
+		var out bytes.Buffer
+		opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, t.TempDir(), "out", 2)
+		opt.HTTPClient = &http.Client{Transport: transport, Jar: jar}
+		opt.Output = &out
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+		<-st.Done()
+		So(st.Err(), ShouldEqual, nil)
+		So(out.String(), ShouldEqual, "/0.ts/1.ts")
+		So(atomic.LoadInt32(&transport.n), ShouldEqual, 3)
+
+		// 默认客户端不限制整个请求的时间, 避免中断下载较慢的大分片
+		So(defaultHTTPClient.Timeout, ShouldEqual, 0)
+		So(defaultHTTPClient.Transport.(*http.Transport).ResponseHeaderTimeout, ShouldBeGreaterThan, 0)
+	})
+}
+
+func TestDownloadDefine(t *testing.T) {
+	Convey("TestDownloadDefine", t, func() {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/master.m3u8":
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-DEFINE:QUERYPARAM=\"token\"\n#EXT-X-STREAM-INF:BANDWIDTH=100\nvideo.m3u8?token={$token}\n")
+			case "/video.m3u8":
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-DEFINE:IMPORT=\"token\"\n")
+				fmt.Fprint(w, "#EXTINF:2,\n0.ts?token={$token}\n#EXTINF:2,\n1.ts?token={$token}\n#EXT-X-ENDLIST\n")
+			default:
+				fmt.Fprint(w, r.URL.RequestURI())
+			}
+		}))
+		defer s.Close()
+
+		var out bytes.Buffer
+		opt := NewDefaultOption(s.URL+"/master.m3u8?token=abc", ModelMerged, t.TempDir(), "out", 2)
+		opt.Output = &out
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+		<-st.Done()
+		So(st.Err(), ShouldEqual, nil)
+		So(out.String(), ShouldEqual, "/0.ts?token=abc/1.ts?token=abc")
+
+		Convey("redirect and BaseUrl", func() {
+			mux := http.NewServeMux()
+			// token只出现在重定向之后的地址中
+			mux.HandleFunc("/entry.m3u8", func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "/origin/master.m3u8?token=def", http.StatusFound)
+			})
+			mux.HandleFunc("/origin/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-DEFINE:QUERYPARAM=\"token\"\n#EXT-X-STREAM-INF:BANDWIDTH=100\nvideo.m3u8?token={$token}\n")
+			})
+			mux.HandleFunc("/cdn/video.m3u8", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-DEFINE:QUERYPARAM=\"token\"\n#EXTINF:2,\n0.ts?t={$token}\n#EXT-X-ENDLIST\n")
+			})
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.URL.RequestURI())
+			})
+			s := httptest.NewServer(mux)
+			defer s.Close()
+
+			var out bytes.Buffer
+			opt := NewDefaultOption(s.URL+"/entry.m3u8", ModelMerged, t.TempDir(), "out", 2)
+			// 相对地址按BaseUrl解析, 查询参数取实际获取的地址
+			opt.BaseUrl = s.URL + "/cdn/master.m3u8?token=base"
+			opt.Output = &out
+			st, err := DownloadWithOpt(context.Background(), opt)
+			So(err, ShouldEqual, nil)
+			<-st.Done()
+			So(st.Err(), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "/cdn/0.ts?t=def")
+		})
+	})
+}
+
+func TestDownloadLocal(t *testing.T) {
+	Convey("TestDownloadLocal", t, func() {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.URL.Path)
+		}))
+		defer s.Close()
+
+		dir := t.TempDir()
+		So(os.WriteFile(filepath.Join(dir, "0.ts"), []byte("local0"), os.ModePerm), ShouldEqual, nil)
+		content := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\n0.ts\n#EXTINF:2,\n" + s.URL + "/1.ts\n#EXT-X-ENDLIST\n"
+		So(os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte(content), os.ModePerm), ShouldEqual, nil)
+
+		download := func(opt Option) string {
+			var out bytes.Buffer
+			opt.Output = &out
+			st, err := DownloadWithOpt(context.Background(), opt)
+			So(err, ShouldEqual, nil)
+			<-st.Done()
+			So(st.Err(), ShouldEqual, nil)
+			return out.String()
+		}
+
+		// 本地路径, 相对地址按播放列表所在目录解析
+		So(download(NewDefaultOption(filepath.Join(dir, "index.m3u8"), ModelMerged, t.TempDir(), "out", 2)), ShouldEqual, "local0/1.ts")
+
+		// 直接提供播放列表内容, 相对地址按BaseUrl解析
+		opt := NewDefaultOption("", ModelMerged, t.TempDir(), "out", 2)
+		opt.M3u8Content = []byte(content)
+		opt.BaseUrl = s.URL + "/capture/"
+		So(download(opt), ShouldEqual, "/capture/0.ts/1.ts")
+
+		opt.BaseUrl = dir
+		So(download(opt), ShouldEqual, "local0/1.ts")
+
+		_, err := DownloadWithOpt(context.Background(), NewDefaultOption("", ModelMerged, t.TempDir(), "out", 2))
+		So(err, ShouldNotEqual, nil)
+
+		// 只有播放列表内容时无法刷新直播
+		opt.Live = true
+		_, err = DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldContainSubstring, "live")
+	})
+}
@@ -0,0 +1,258 @@
+package m3u8
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MarshalText 实现encoding.TextMarshaler, 等价于Encode
+func (m *M3u8) MarshalText() ([]byte, error) {
+	return m.Encode(), nil
+}
+
+// Encode 将播放列表编码为m3u8文本, 对于Parse的结果p, Parse(p.Encode(), url)与p相同.
+// 分片中的url按原样输出, 未被解析的标签输出在其所属分片的EXTINF之前.
+func (m *M3u8) Encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	if m.Version > 0 {
+		fmt.Fprintf(&buf, "#EXT-X-VERSION:%d\n", m.Version)
+	}
+	if m.IndependentSegments {
+		buf.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	// 地址中的变量引用已经被替换, 变量统一以NAME和VALUE的形式输出
+	names := make([]string, 0, len(m.Variables))
+	for k := range m.Variables {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(&buf, "#EXT-X-DEFINE:NAME=\"%s\",VALUE=\"%s\"\n", k, m.Variables[k])
+	}
+	if m.Start != nil {
+		fmt.Fprintf(&buf, "#EXT-X-START:TIME-OFFSET=%s", formatFloat(m.Start.TimeOffset))
+		if m.Start.Precise {
+			buf.WriteString(",PRECISE=YES")
+		}
+		buf.WriteByte('\n')
+	}
+
+	if len(m.MastPlayList) > 0 || len(m.MediaList) > 0 {
+		writeTags(&buf, m.UnknownTags)
+		for _, v := range m.MediaList {
+			encodeMedia(&buf, v)
+		}
+		for _, v := range m.MastPlayList {
+			encodePlayInfo(&buf, v)
+		}
+		return buf.Bytes()
+	}
+
+	if m.TargetDuration > 0 {
+		// 小数形式的目标时长向上取整, 保证不小于任何分片的时长
+		fmt.Fprintf(&buf, "#EXT-X-TARGETDURATION:%d\n", int64(math.Ceil(m.TargetDuration.Seconds())))
+	}
+	if m.MediaSequence != 0 {
+		fmt.Fprintf(&buf, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.MediaSequence)
+	}
+	if m.DiscontinuitySequence != 0 {
+		fmt.Fprintf(&buf, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", m.DiscontinuitySequence)
+	}
+	if m.PlayListType != "" {
+		fmt.Fprintf(&buf, "#EXT-X-PLAYLIST-TYPE:%s\n", m.PlayListType)
+	}
+	if m.IFramesOnly {
+		buf.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	}
+	if m.ServerControl != nil {
+		encodeServerControl(&buf, *m.ServerControl)
+	}
+
+	if m.Skip != nil {
+		fmt.Fprintf(&buf, "#EXT-X-SKIP:SKIPPED-SEGMENTS=%d", m.Skip.SkippedSegments)
+		if len(m.Skip.RecentlyRemovedDateRanges) > 0 {
+			// 多个ID以制表符分隔, 不能使用strconv.Quote转义
+			fmt.Fprintf(&buf, ",RECENTLY-REMOVED-DATERANGES=\"%s\"", strings.Join(m.Skip.RecentlyRemovedDateRanges, "\t"))
+		}
+		buf.WriteByte('\n')
+	}
+
+	var (
+		encryptMeta EncryptMeta
+		segMap      *Map
+	)
+	for _, v := range m.Segments {
+		if !sameEncryptMeta(encryptMeta, v.EncryptMeta) {
+			encodeKey(&buf, v.EncryptMeta)
+			encryptMeta = v.EncryptMeta
+		}
+		if !sameMap(segMap, v.Map) && v.Map != nil {
+			fmt.Fprintf(&buf, "#EXT-X-MAP:URI=%s", strconv.Quote(v.Map.Url))
+			if v.Map.ByteRange != nil {
+				fmt.Fprintf(&buf, ",BYTERANGE=\"%d@%d\"", v.Map.ByteRange.Length, v.Map.ByteRange.Offset)
+			}
+			buf.WriteByte('\n')
+		}
+		segMap = v.Map
+		if v.Discontinuity {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if !v.ProgramDateTime.IsZero() {
+			fmt.Fprintf(&buf, "#EXT-X-PROGRAM-DATE-TIME:%s\n", v.ProgramDateTime.Format(time.RFC3339Nano))
+		}
+		writeTags(&buf, v.UnknownTags)
+		fmt.Fprintf(&buf, "#EXTINF:%s,%s\n", formatFloat(v.Duration.Seconds()), v.Title)
+		if v.ByteRange != nil {
+			fmt.Fprintf(&buf, "#EXT-X-BYTERANGE:%d@%d\n", v.ByteRange.Length, v.ByteRange.Offset)
+		}
+		buf.WriteString(v.Url)
+		buf.WriteByte('\n')
+	}
+
+	writeTags(&buf, m.UnknownTags)
+	if m.EndList {
+		buf.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return buf.Bytes()
+}
+
+func encodePlayInfo(buf *bytes.Buffer, v PlayInfo) {
+	var attrs []string
+	if v.ProgramId != 0 {
+		attrs = append(attrs, "PROGRAM-ID="+strconv.FormatInt(v.ProgramId, 10))
+	}
+	attrs = append(attrs, "BANDWIDTH="+strconv.FormatInt(v.BandWidth, 10))
+	if v.AverageBandWidth != 0 {
+		attrs = append(attrs, "AVERAGE-BANDWIDTH="+strconv.FormatInt(v.AverageBandWidth, 10))
+	}
+	if v.Codecs != "" {
+		attrs = append(attrs, "CODECS="+strconv.Quote(v.Codecs))
+	}
+	if v.Resolution.Width != 0 || v.Resolution.High != 0 {
+		attrs = append(attrs, fmt.Sprintf("RESOLUTION=%dx%d", v.Resolution.Width, v.Resolution.High))
+	}
+	if v.FrameRate != 0 {
+		attrs = append(attrs, "FRAME-RATE="+formatFloat(v.FrameRate))
+	}
+	if v.HdcpLevel != "" {
+		attrs = append(attrs, "HDCP-LEVEL="+v.HdcpLevel)
+	}
+	if v.VideoRange != "" {
+		attrs = append(attrs, "VIDEO-RANGE="+v.VideoRange)
+	}
+	if v.Audio != "" {
+		attrs = append(attrs, "AUDIO="+strconv.Quote(v.Audio))
+	}
+	if v.Video != "" {
+		attrs = append(attrs, "VIDEO="+strconv.Quote(v.Video))
+	}
+	if v.Subtitles != "" {
+		attrs = append(attrs, "SUBTITLES="+strconv.Quote(v.Subtitles))
+	}
+	if v.ClosedCaptions == "NONE" {
+		attrs = append(attrs, "CLOSED-CAPTIONS=NONE")
+	} else if v.ClosedCaptions != "" {
+		attrs = append(attrs, "CLOSED-CAPTIONS="+strconv.Quote(v.ClosedCaptions))
+	}
+	fmt.Fprintf(buf, "#EXT-X-STREAM-INF:%s\n%s\n", strings.Join(attrs, ","), v.M3u8Url)
+}
+
+func encodeMedia(buf *bytes.Buffer, v Media) {
+	attrs := []string{"TYPE=" + v.Type, "GROUP-ID=" + strconv.Quote(v.GroupId)}
+	if v.Language != "" {
+		attrs = append(attrs, "LANGUAGE="+strconv.Quote(v.Language))
+	}
+	if v.AssocLanguage != "" {
+		attrs = append(attrs, "ASSOC-LANGUAGE="+strconv.Quote(v.AssocLanguage))
+	}
+	attrs = append(attrs, "NAME="+strconv.Quote(v.Name))
+	if v.Default {
+		attrs = append(attrs, "DEFAULT=YES")
+	}
+	if v.AutoSelect {
+		attrs = append(attrs, "AUTOSELECT=YES")
+	}
+	if v.Forced {
+		attrs = append(attrs, "FORCED=YES")
+	}
+	if v.InstreamId != "" {
+		attrs = append(attrs, "INSTREAM-ID="+strconv.Quote(v.InstreamId))
+	}
+	if v.Characteristics != "" {
+		attrs = append(attrs, "CHARACTERISTICS="+strconv.Quote(v.Characteristics))
+	}
+	if v.Channels != "" {
+		attrs = append(attrs, "CHANNELS="+strconv.Quote(v.Channels))
+	}
+	if v.Url != "" {
+		attrs = append(attrs, "URI="+strconv.Quote(v.Url))
+	}
+	fmt.Fprintf(buf, "#EXT-X-MEDIA:%s\n", strings.Join(attrs, ","))
+}
+
+func encodeKey(buf *bytes.Buffer, meta EncryptMeta) {
+	method := meta.Method
+	if method == "" {
+		method = CryptMethodNONE
+	}
+	fmt.Fprintf(buf, "#EXT-X-KEY:METHOD=%s", method)
+	if meta.SecretKeyUrl != "" {
+		fmt.Fprintf(buf, ",URI=%s", strconv.Quote(meta.SecretKeyUrl))
+	}
+	if meta.IV != "" {
+		fmt.Fprintf(buf, ",IV=%s", meta.IV)
+	}
+	if meta.KeyFormat != "" {
+		fmt.Fprintf(buf, ",KEYFORMAT=%s", strconv.Quote(meta.KeyFormat))
+	}
+	if meta.KeyFormatVersions != "" {
+		fmt.Fprintf(buf, ",KEYFORMATVERSIONS=%s", strconv.Quote(meta.KeyFormatVersions))
+	}
+	buf.WriteByte('\n')
+}
+
+func encodeServerControl(buf *bytes.Buffer, v ServerControl) {
+	var attrs []string
+	if v.CanSkipUntil > 0 {
+		attrs = append(attrs, "CAN-SKIP-UNTIL="+formatFloat(v.CanSkipUntil.Seconds()))
+	}
+	if v.CanSkipDateRanges {
+		attrs = append(attrs, "CAN-SKIP-DATERANGES=YES")
+	}
+	if v.HoldBack > 0 {
+		attrs = append(attrs, "HOLD-BACK="+formatFloat(v.HoldBack.Seconds()))
+	}
+	fmt.Fprintf(buf, "#EXT-X-SERVER-CONTROL:%s\n", strings.Join(attrs, ","))
+}
+
+func sameEncryptMeta(a, b EncryptMeta) bool {
+	return a.Method == b.Method && a.SecretKeyUrl == b.SecretKeyUrl && a.IV == b.IV &&
+		a.KeyFormat == b.KeyFormat && a.KeyFormatVersions == b.KeyFormatVersions
+}
+
+func sameMap(a, b *Map) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Url != b.Url || (a.ByteRange == nil) != (b.ByteRange == nil) {
+		return false
+	}
+	return a.ByteRange == nil || *a.ByteRange == *b.ByteRange
+}
+
+func writeTags(buf *bytes.Buffer, tags []string) {
+	for _, v := range tags {
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,81 @@
+package m3u8
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEncode(t *testing.T) {
+	Convey("TestEncode", t, func() {
+		roundTrip := func(content, link string) {
+			p, err := Parse([]byte(content), link)
+			So(err, ShouldEqual, nil)
+			encoded, err := p.MarshalText()
+			So(err, ShouldEqual, nil)
+			q, err := Parse(encoded, link)
+			So(err, ShouldEqual, nil)
+			So(q, ShouldResemble, p)
+		}
+
+		Convey("Master Playlist", func() {
+			roundTrip(`#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-CUSTOM-TAG:FOO=1
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="fr",NAME="Français",AUTOSELECT=YES,URI="audio/fr.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="CC1",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=1280000,AVERAGE-BANDWIDTH=1000000,RESOLUTION=1280x720,FRAME-RATE=29.970,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aac",CLOSED-CAPTIONS=NONE,HDCP-LEVEL=NONE,VIDEO-RANGE=SDR
+720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS="mp4a.40.5",CLOSED-CAPTIONS="cc"
+http://example.com/audio/index.m3u8`, "http://example.com/master.m3u8")
+		})
+
+		Convey("Media Playlist", func() {
+			roundTrip(`#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MEDIA-SEQUENCE:250
+#EXT-X-DISCONTINUITY-SEQUENCE:3
+#EXT-X-START:TIME-OFFSET=10
+#EXT-X-KEY:METHOD=AES-128,URI="key.key",IV=0x000102030405060708090A0B0C0D0E0F
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-PROGRAM-DATE-TIME:2021-01-02T03:04:05.678Z
+#EXTINF:3,first
+#EXT-X-BYTERANGE:1000@0
+a.mp4
+#EXT-X-CUE-OUT:DURATION=30
+#EXTINF:1.52,
+#EXT-X-BYTERANGE:1000
+a.mp4
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init2.mp4",BYTERANGE="100@20"
+#EXTINF:3.003,
+/b.mp4
+#EXT-X-CUE-IN
+#EXT-X-ENDLIST
+`, "http://example.com/hls/index.m3u8")
+		})
+
+		Convey("EXT-X-SERVER-CONTROL", func() {
+			roundTrip(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:266
+#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=24,CAN-SKIP-DATERANGES=YES,HOLD-BACK=12
+#EXTINF:2,
+266.mp4
+#EXTINF:2,
+267.mp4
+`, "http://example.com/2M/index.m3u8")
+		})
+
+		Convey("Encoded Text", func() {
+			p, err := Parse([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\na.ts\n#EXT-X-ENDLIST"), "http://example.com/index.m3u8")
+			So(err, ShouldEqual, nil)
+			So(string(p.Encode()), ShouldEqual, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\nhttp://example.com/a.ts\n#EXT-X-ENDLIST\n")
+		})
+	})
+}
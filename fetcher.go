@@ -0,0 +1,89 @@
+package m3u8
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Fetcher 按照Option中的Qps, HttpRequestCallback, KeyProvider, KeyTTL, RetryPolicy和HTTPClient获取播放列表, 分片, 初始化分片和秘钥,
+// 供代理等不经过Download的场景复用下载器的请求和解密逻辑. 获取失败时按RetryPolicy重试.
+type Fetcher struct {
+	md *m3u8Downloader
+}
+
+// NewFetcher 创建Fetcher, 仅M3u8Url或BaseUrl是本地文件或者设置了M3u8Content时允许获取file:地址
+func NewFetcher(opt Option) *Fetcher {
+	md := newDownloader(opt)
+	for _, v := range []string{opt.M3u8Url, opt.BaseUrl} {
+		if v == "" {
+			continue
+		}
+		if u, err := fileUrl(v); err == nil && isFileUrl(u) {
+			md.allowFile = true
+		}
+	}
+	md.allowFile = md.allowFile || opt.M3u8Content != nil
+	return &Fetcher{md: md}
+}
+
+// Get 获取u的全部内容
+func (f *Fetcher) Get(ctx context.Context, u string) ([]byte, error) {
+	return f.GetRange(ctx, u, nil)
+}
+
+// GetRange 获取u中由br描述的字节范围, br为nil时获取整个资源
+func (f *Fetcher) GetRange(ctx context.Context, u string, br *ByteRange) (body []byte, err error) {
+	err = f.md.retryFetch(ctx, func() (err error) {
+		body, err = f.md.httpGetRange(ctx, u, br)
+		return err
+	})
+	return body, err
+}
+
+// Key 获取分片的解密秘钥, 秘钥按SecretKeyUrl缓存
+func (f *Fetcher) Key(ctx context.Context, meta EncryptMeta) ([]byte, error) {
+	if err := f.md.unsupportedEncryption(meta); err != nil {
+		return nil, err
+	}
+	return f.md.keys.get(ctx, meta, nil)
+}
+
+// Segment 获取分片, decrypt为true时返回解密后的数据
+func (f *Fetcher) Segment(ctx context.Context, seg Segment, decrypt bool) ([]byte, error) {
+	if !decrypt || !seg.IsEncrypted() {
+		return f.GetRange(ctx, seg.Url, seg.ByteRange)
+	}
+	if err := f.md.unsupportedEncryption(seg.EncryptMeta); err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	_, err := f.md.fetchSegment(ctx, seg, segmentExtOf(seg), func(seg Segment, wrap segmentWrap) (err error) {
+		body, err = f.md.readSegment(ctx, seg, wrap)
+		return err
+	})
+	return body, err
+}
+
+// Init 获取分片的EXT-X-MAP对应的初始化分片, decrypt为true时返回解密后的数据
+func (f *Fetcher) Init(ctx context.Context, seg Segment, decrypt bool) ([]byte, error) {
+	if !decrypt || !seg.IsEncrypted() {
+		return f.GetRange(ctx, seg.Map.Url, seg.Map.ByteRange)
+	}
+	return f.md.downloadInit(ctx, seg)
+}
+
+// segmentExtOf 根据分片本身推断其扩展名
+func segmentExtOf(seg Segment) string {
+	if seg.Map != nil {
+		return ".m4s"
+	}
+	if u, err := url.Parse(seg.Url); err == nil {
+		if ext := strings.ToLower(path.Ext(u.Path)); ext == ".vtt" || ext == ".webvtt" {
+			return ".vtt"
+		}
+	}
+	return ".ts"
+}
@@ -0,0 +1,132 @@
+package m3u8
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/gogokit/m3u8/remux"
+)
+
+// IsFMP4 返回媒体播放列表是否由带EXT-X-MAP初始化分片的fMP4(CMAF)分片组成
+func (m *M3u8) IsFMP4() bool {
+	for _, v := range m.Segments {
+		if v.Map != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// initSegment 一个EXT-X-MAP对应的初始化分片, 每个不同的EXT-X-MAP只下载一次
+type initSegment struct {
+	once sync.Once
+	idx  int
+	body []byte // 写入Output时初始化分片保存在内存中
+	err  error
+}
+
+func mapKey(m *Map) string {
+	if m.ByteRange == nil {
+		return m.Url
+	}
+	return fmt.Sprintf("%s@%d-%d", m.Url, m.ByteRange.Offset, m.ByteRange.Length)
+}
+
+func (md *m3u8Downloader) initName(idx int) string {
+	return md.tsFilePrefix + fmt.Sprintf("_init_%d.mp4", idx)
+}
+
+// initPath 返回分片对应的初始化分片的保存路径, 初始化分片尚未下载时返回空
+func (md *m3u8Downloader) initPath(seg Segment) string {
+	if seg.Map == nil {
+		return ""
+	}
+	md.initLock.Lock()
+	defer md.initLock.Unlock()
+	v, ok := md.inits[mapKey(seg.Map)]
+	if !ok {
+		return ""
+	}
+	return md.fullPath(md.initName(v.idx))
+}
+
+// ensureInit 确保分片对应的初始化分片已经下载, 同一个EXT-X-MAP并发调用时只会下载一次
+func (md *m3u8Downloader) ensureInit(ctx context.Context, seg Segment) error {
+	if seg.Map == nil {
+		return nil
+	}
+	key := mapKey(seg.Map)
+	md.initLock.Lock()
+	v, ok := md.inits[key]
+	if !ok {
+		v = &initSegment{idx: len(md.inits)}
+		md.inits[key] = v
+	}
+	md.initLock.Unlock()
+
+	v.once.Do(func() {
+		body, err := md.downloadInit(ctx, seg)
+		switch {
+		case err != nil:
+			v.err = err
+		case md.out != nil:
+			v.body = body
+		default:
+			path := md.fullPath(md.initName(v.idx))
+			if err = os.WriteFile(path, body, os.ModePerm); err != nil {
+				v.err = fmt.Errorf("os.WriteFile %s error, %w", path, err)
+			}
+		}
+	})
+	if v.err != nil {
+		return fmt.Errorf("download init segment %s error, %w", seg.Map.Url, v.err)
+	}
+	return nil
+}
+
+func (md *m3u8Downloader) downloadInit(ctx context.Context, seg Segment) ([]byte, error) {
+	var body []byte
+	if err := md.retryFetch(ctx, func() (err error) {
+		body, err = md.httpGetRange(ctx, seg.Map.Url, seg.Map.ByteRange)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if seg.EncryptMeta.Method == CryptMethodSampleAESCTR && !md.keepEncrypted() {
+		// 初始化分片是明文, 但样本描述标记为加密, 分片解密后需要改写为原始格式才能播放
+		if err := remux.ClearCENCInit(body); err != nil {
+			return nil, fmt.Errorf("clear sample-aes-ctr init segment error, %w", err)
+		}
+	}
+
+	// 初始化分片使用作用于EXT-X-MAP的秘钥加密, SAMPLE-AES只加密媒体样本, 初始化分片是明文
+	if seg.EncryptMeta.Method == CryptMethodAES && !md.keepEncrypted() {
+		iv, err := seg.aesIV()
+		if err != nil {
+			return nil, err
+		}
+		encrypted := body
+		if _, err = md.decrypt(ctx, seg, func(key []byte) error {
+			if body, err = decryptByAES128(encrypted, key, iv); err != nil {
+				return &decryptError{err}
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// initBody 返回写入Output时分片对应的初始化分片
+func (md *m3u8Downloader) initBody(seg Segment) []byte {
+	md.initLock.Lock()
+	defer md.initLock.Unlock()
+	if v, ok := md.inits[mapKey(seg.Map)]; ok {
+		return v.body
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package m3u8
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFMP4(t *testing.T) {
+	// files为服务端的文件, 返回服务端及各个文件被请求的次数
+	newServer := func(files map[string][]byte) (*httptest.Server, func() map[string]int) {
+		var (
+			lock sync.Mutex
+			hits = make(map[string]int)
+		)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			hits[r.URL.Path]++
+			lock.Unlock()
+			body, ok := files[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(body))
+		}))
+		return s, func() map[string]int {
+			lock.Lock()
+			defer lock.Unlock()
+			ret := make(map[string]int)
+			for k, v := range hits {
+				ret[k] = v
+			}
+			return ret
+		}
+	}
+	download := func(s *httptest.Server) string {
+		var out bytes.Buffer
+		opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, t.TempDir(), "out", 2)
+		opt.Output = &out
+		opt.RetryPolicy = RetryPolicy{MaxAttempts: 1}
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+		ret := GenResult(st, false)
+		So(st.Err(), ShouldEqual, nil)
+		So(ret.Merged, ShouldBeTrue)
+		for _, v := range ret.Segments {
+			So(v.ErrMsg, ShouldEqual, "")
+		}
+		return out.String()
+	}
+
+	Convey("TestFMP4", t, func() {
+		Convey("init", func() {
+			s, hits := newServer(map[string][]byte{
+				"/index.m3u8": []byte("#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2,\n0.m4s\n#EXTINF:2,\n1.m4s\n#EXT-X-ENDLIST\n"),
+				"/init.mp4":   []byte("[init]"),
+				"/0.m4s":      []byte("[0]"),
+				"/1.m4s":      []byte("[1]"),
+			})
+			defer s.Close()
+
+			So(download(s), ShouldEqual, "[init][0][1]")
+			So(hits()["/init.mp4"], ShouldEqual, 1)
+		})
+
+		Convey("map change", func() {
+			// 初始化分片a.mp4和b.mp4位于同一个文件的不同字节范围, EXT-X-MAP变化时先写入新的初始化分片
+			s, hits := newServer(map[string][]byte{
+				"/index.m3u8": []byte("#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:2\n" +
+					"#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=\"3@0\"\n#EXTINF:2,\n0.m4s\n#EXTINF:2,\n1.m4s\n" +
+					"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=\"3@3\"\n#EXTINF:2,\n2.m4s\n#EXTINF:2,\n3.m4s\n#EXT-X-ENDLIST\n"),
+				"/init.mp4": []byte("[a][b]"),
+				"/0.m4s":    []byte("[0]"),
+				"/1.m4s":    []byte("[1]"),
+				"/2.m4s":    []byte("[2]"),
+				"/3.m4s":    []byte("[3]"),
+			})
+			defer s.Close()
+
+			So(download(s), ShouldEqual, "[a][0][1][b][2][3]")
+			So(hits()["/init.mp4"], ShouldEqual, 2)
+		})
+
+		Convey("aes-128", func() {
+			// EXT-X-KEY同时作用于其后的EXT-X-MAP和分片, 初始化分片和分片均需解密
+			key := []byte("0123456789abcdef")
+			iv := bytes.Repeat([]byte{1}, 16)
+			s, _ := newServer(map[string][]byte{
+				"/index.m3u8": []byte("#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:2\n" +
+					"#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\",IV=0x01010101010101010101010101010101\n" +
+					"#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2,\n0.m4s\n#EXT-X-ENDLIST\n"),
+				"/key.bin":  key,
+				"/init.mp4": encryptAES128([]byte("[init]"), key, iv),
+				"/0.m4s":    encryptAES128([]byte("[0]"), key, iv),
+			})
+			defer s.Close()
+
+			So(download(s), ShouldEqual, "[init][0]")
+		})
+
+		Convey("sample-aes-ctr", func() {
+			key := []byte("0123456789abcdef")
+			iv := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+			sample := bytes.Repeat([]byte("[sample]"), 4)
+			enc := make([]byte, len(sample))
+			block, _ := aes.NewCipher(key)
+			cipher.NewCTR(block, append(append([]byte{}, iv...), make([]byte, 8)...)).XORKeyStream(enc, sample)
+
+			u32 := func(v int) []byte {
+				b := make([]byte, 4)
+				binary.BigEndian.PutUint32(b, uint32(v))
+				return b
+			}
+			mp4Box := func(typ string, payload ...[]byte) []byte {
+				body := bytes.Join(payload, nil)
+				return append(append(u32(8+len(body)), typ...), body...)
+			}
+			encv := mp4Box("encv", make([]byte, 78), mp4Box("sinf", mp4Box("frma", []byte("avc1"))))
+			init := mp4Box("moov", mp4Box("trak", mp4Box("mdia", mp4Box("minf", mp4Box("stbl", mp4Box("stsd", u32(0), u32(1), encv))))))
+			moof := func(dataOffset int) []byte {
+				return mp4Box("moof", mp4Box("traf",
+					mp4Box("tfhd", u32(0x020010), u32(1), u32(len(sample))),
+					mp4Box("trun", u32(0x000001), u32(1), u32(dataOffset)),
+					mp4Box("senc", u32(0), u32(1), iv),
+				))
+			}
+			segment := append(moof(len(moof(0))+8), mp4Box("mdat", enc)...)
+
+			s, _ := newServer(map[string][]byte{
+				"/index.m3u8": []byte("#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:2\n" +
+					"#EXT-X-KEY:METHOD=SAMPLE-AES-CTR,URI=\"key.bin\"\n" +
+					"#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2,\n0.m4s\n#EXT-X-ENDLIST\n"),
+				"/key.bin":  key,
+				"/init.mp4": init,
+				"/0.m4s":    segment,
+			})
+			defer s.Close()
+
+			out := download(s)
+			So(len(out), ShouldEqual, len(init)+len(segment))
+			So(strings.HasSuffix(out, string(sample)), ShouldBeTrue)
+			// 样本描述改写为原始格式, 加密信息改写为free
+			So(out, ShouldContainSubstring, "avc1")
+			for _, typ := range []string{"encv", "sinf", "senc"} {
+				So(out, ShouldNotContainSubstring, typ)
+			}
+		})
+
+		Convey("save", func() {
+			s, hits := newServer(map[string][]byte{
+				"/a.mp4": []byte("[a]"),
+				"/b.mp4": []byte("[b]"),
+			})
+			defer s.Close()
+
+			m, err := Parse([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"a.mp4\"\n#EXTINF:2,\n0.m4s\n#EXT-X-MAP:URI=\"b.mp4\"\n#EXTINF:2,\n1.m4s\n#EXTINF:2,\n2.m4s\n"), s.URL+"/index.m3u8")
+			So(err, ShouldEqual, nil)
+			So(m.IsFMP4(), ShouldBeTrue)
+
+			md := &m3u8Downloader{fileDir: t.TempDir(), tsFilePrefix: "out", inits: make(map[string]*initSegment), retry: RetryPolicy{MaxAttempts: 1}}
+			So(md.initPath(m.Segments[0]), ShouldEqual, "")
+			// 同一个EXT-X-MAP并发调用时只下载一次
+			var wg sync.WaitGroup
+			errs := make(chan error, 3*len(m.Segments))
+			for i := 0; i < 3; i++ {
+				for _, seg := range m.Segments {
+					seg := seg
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						errs <- md.ensureInit(context.Background(), seg)
+					}()
+				}
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				So(err, ShouldEqual, nil)
+			}
+
+			So(hits(), ShouldResemble, map[string]int{"/a.mp4": 1, "/b.mp4": 1})
+			So(md.initPath(m.Segments[1]), ShouldEqual, md.initPath(m.Segments[2]))
+			for i, expect := range []string{"[a]", "[b]", "[b]"} {
+				body, err := os.ReadFile(md.initPath(m.Segments[i]))
+				So(err, ShouldEqual, nil)
+				So(string(body), ShouldEqual, expect)
+			}
+
+			seg := m.Segments[0]
+			seg.Map = &Map{Url: s.URL + "/missing.mp4"}
+			err = md.ensureInit(context.Background(), seg)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "missing.mp4")
+		})
+	})
+}
@@ -0,0 +1,150 @@
+package m3u8
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyProvider 获取分片的解密秘钥, 返回原始的秘钥字节, AES-128, SAMPLE-AES和SAMPLE-AES-CTR的秘钥长度均为16字节.
+// 秘钥在第一个使用它的分片下载时获取, 按SecretKeyUrl缓存, 获取失败时按RetryPolicy重试, 返回Permanent(err)时不再重试.
+type KeyProvider interface {
+	Key(ctx context.Context, meta EncryptMeta) ([]byte, error)
+}
+
+// KeyProviderFunc 将函数适配为KeyProvider
+type KeyProviderFunc func(ctx context.Context, meta EncryptMeta) ([]byte, error)
+
+func (f KeyProviderFunc) Key(ctx context.Context, meta EncryptMeta) ([]byte, error) {
+	return f(ctx, meta)
+}
+
+// httpKeyProvider 默认的KeyProvider, 使用下载器的限流和HttpRequestCallback请求SecretKeyUrl, data:地址直接解码
+type httpKeyProvider struct {
+	md *m3u8Downloader
+}
+
+func (p httpKeyProvider) Key(ctx context.Context, meta EncryptMeta) ([]byte, error) {
+	return p.md.httpGet(ctx, meta.SecretKeyUrl)
+}
+
+// StaticKeyProvider 返回所有分片都使用同一个秘钥的KeyProvider, hexKey为十六进制表示的秘钥, 可以带0x前缀
+func StaticKeyProvider(hexKey string) (KeyProvider, error) {
+	key, err := decodeHexKey(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	return KeyProviderFunc(func(context.Context, EncryptMeta) ([]byte, error) {
+		return key, nil
+	}), nil
+}
+
+// FileKeyProvider 返回从本地文件读取秘钥的KeyProvider, path根据EncryptMeta返回秘钥文件的路径.
+// 文件内容为16字节的原始秘钥或者十六进制表示的秘钥.
+func FileKeyProvider(path func(meta EncryptMeta) string) KeyProvider {
+	return KeyProviderFunc(func(_ context.Context, meta EncryptMeta) ([]byte, error) {
+		name := path(meta)
+		body, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile %s error, %w", name, err)
+		}
+		if len(body) == 16 {
+			return body, nil
+		}
+		return decodeHexKey(string(body))
+	})
+}
+
+func decodeHexKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+	}
+	ret, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("hex key %s is illegal, %w", s, err)
+	}
+	if len(ret) != 16 {
+		return nil, fmt.Errorf("key length must be 16, got %d", len(ret))
+	}
+	return ret, nil
+}
+
+// keyCache 按SecretKeyUrl缓存秘钥, 同一个秘钥同时只会获取一次
+// keyCacheSize 最多缓存的秘钥数, 直播或者代理长时间运行时秘钥地址不断轮换, 超过后淘汰最久未使用的秘钥
+const keyCacheSize = 1024
+
+type keyCache struct {
+	provider KeyProvider
+	ttl      time.Duration // 小于等于0表示不过期
+	retry    RetryPolicy
+	lock     sync.Mutex
+	entries  map[string]*keyEntry
+	lru      *list.List // 按最近使用排序的SecretKeyUrl, 最近使用的在前
+}
+
+type keyEntry struct {
+	lock      sync.Mutex
+	key       []byte
+	fetchedAt time.Time
+	elem      *list.Element
+}
+
+func newKeyCache(provider KeyProvider, ttl time.Duration, retry RetryPolicy) *keyCache {
+	return &keyCache{
+		provider: provider,
+		ttl:      ttl,
+		retry:    retry,
+		entries:  make(map[string]*keyEntry),
+		lru:      list.New(),
+	}
+}
+
+// get 返回meta对应的秘钥, 缓存不存在, 已过期或者等于stale时重新获取.
+// stale为解密失败时使用的秘钥, 其他分片已经重新获取到不同的秘钥时直接返回新的秘钥.
+func (c *keyCache) get(ctx context.Context, meta EncryptMeta, stale []byte) ([]byte, error) {
+	c.lock.Lock()
+	e, ok := c.entries[meta.SecretKeyUrl]
+	if ok {
+		c.lru.MoveToFront(e.elem)
+	} else {
+		e = &keyEntry{elem: c.lru.PushFront(meta.SecretKeyUrl)}
+		c.entries[meta.SecretKeyUrl] = e
+		if c.lru.Len() > keyCacheSize {
+			delete(c.entries, c.lru.Remove(c.lru.Back()).(string))
+		}
+	}
+	c.lock.Unlock()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.key != nil && (c.ttl <= 0 || time.Since(e.fetchedAt) < c.ttl) && (stale == nil || !bytes.Equal(e.key, stale)) {
+		return e.key, nil
+	}
+
+	var key []byte
+	if err := c.retry.do(ctx, func() (err error) {
+		key, err = c.provider.Key(ctx, meta)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	e.key, e.fetchedAt = key, time.Now()
+	return key, nil
+}
+
+// keyId 返回秘钥的标识, 为秘钥sha256的前8字节, 用于在不暴露秘钥的情况下区分轮换前后的秘钥
+func keyId(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
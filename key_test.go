@@ -0,0 +1,175 @@
+package m3u8
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyProvider(t *testing.T) {
+	Convey("TestKeyProvider", t, func() {
+		key := []byte("0123456789abcdef")
+
+		Convey("static and file", func() {
+			p, err := StaticKeyProvider("0x30313233343536373839616263646566")
+			So(err, ShouldEqual, nil)
+			got, err := p.Key(context.Background(), EncryptMeta{})
+			So(err, ShouldEqual, nil)
+			So(got, ShouldResemble, key)
+
+			_, err = StaticKeyProvider("3031")
+			So(err, ShouldNotEqual, nil)
+
+			dir := t.TempDir()
+			So(os.WriteFile(filepath.Join(dir, "raw.key"), key, os.ModePerm), ShouldEqual, nil)
+			So(os.WriteFile(filepath.Join(dir, "hex.key"), []byte("30313233343536373839616263646566\n"), os.ModePerm), ShouldEqual, nil)
+			p = FileKeyProvider(func(meta EncryptMeta) string {
+				return filepath.Join(dir, filepath.Base(meta.SecretKeyUrl))
+			})
+			for _, v := range []string{"http://example.com/raw.key", "http://example.com/hex.key"} {
+				got, err = p.Key(context.Background(), EncryptMeta{SecretKeyUrl: v})
+				So(err, ShouldEqual, nil)
+				So(got, ShouldResemble, key)
+			}
+		})
+
+		Convey("cache and rotation", func() {
+			var calls int32
+			provider := KeyProviderFunc(func(_ context.Context, meta EncryptMeta) ([]byte, error) {
+				if meta.SecretKeyUrl != "skd://a" {
+					return nil, errors.New("unknown key")
+				}
+				// 每次获取都返回轮换后的新秘钥
+				return []byte(fmt.Sprintf("%016d", atomic.AddInt32(&calls, 1))), nil
+			})
+			meta := EncryptMeta{Method: CryptMethodAES, SecretKeyUrl: "skd://a"}
+
+			c := newKeyCache(provider, 0, RetryPolicy{})
+			k1, err := c.get(context.Background(), meta, nil)
+			So(err, ShouldEqual, nil)
+			k2, err := c.get(context.Background(), meta, nil)
+			So(err, ShouldEqual, nil)
+			So(k2, ShouldResemble, k1)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+
+			// 解密失败后重新获取, 其他分片已经重新获取过时直接使用新秘钥
+			k3, err := c.get(context.Background(), meta, k1)
+			So(err, ShouldEqual, nil)
+			So(k3, ShouldNotResemble, k1)
+			k4, err := c.get(context.Background(), meta, k1)
+			So(err, ShouldEqual, nil)
+			So(k4, ShouldResemble, k3)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+
+			c = newKeyCache(provider, time.Millisecond, RetryPolicy{})
+			k1, _ = c.get(context.Background(), meta, nil)
+			time.Sleep(2 * time.Millisecond)
+			k2, _ = c.get(context.Background(), meta, nil)
+			So(k2, ShouldNotResemble, k1)
+
+			// 使用轮换后的秘钥加密的分片在解密失败后使用新秘钥解密
+			iv := make([]byte, 16)
+			c = newKeyCache(provider, 0, RetryPolicy{})
+			old, _ := c.get(context.Background(), meta, nil)
+			rotated := []byte(fmt.Sprintf("%016d", atomic.LoadInt32(&calls)+1))
+			plain := []byte("0123456789")
+			encrypted := encryptAES128(plain, rotated, iv)
+			md := &m3u8Downloader{keys: c}
+			var body []byte
+			key, err := md.decrypt(context.Background(), Segment{EncryptMeta: meta}, func(key []byte) (err error) {
+				if body, err = decryptByAES128(encrypted, key, iv); err != nil {
+					return &decryptError{err}
+				}
+				return nil
+			})
+			So(err, ShouldEqual, nil)
+			So(body, ShouldResemble, plain)
+			So(key, ShouldResemble, rotated)
+			So(key, ShouldNotResemble, old)
+			So(keyId(string(key)), ShouldHaveLength, 16)
+			So(keyId(""), ShouldEqual, "")
+		})
+
+		Convey("bounded", func() {
+			var calls int32
+			c := newKeyCache(KeyProviderFunc(func(_ context.Context, meta EncryptMeta) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				return []byte(meta.SecretKeyUrl), nil
+			}), 0, RetryPolicy{})
+			get := func(i int) {
+				_, err := c.get(context.Background(), EncryptMeta{Method: CryptMethodAES, SecretKeyUrl: fmt.Sprintf("skd://%d", i)}, nil)
+				So(err, ShouldEqual, nil)
+			}
+			for i := 0; i < keyCacheSize; i++ {
+				get(i)
+			}
+			// 第0个秘钥最近被使用过, 超过容量时淘汰第1个
+			get(0)
+			get(keyCacheSize)
+			So(len(c.entries), ShouldEqual, keyCacheSize)
+			So(c.lru.Len(), ShouldEqual, keyCacheSize)
+			So(atomic.LoadInt32(&calls), ShouldEqual, keyCacheSize+1)
+			get(0)
+			So(atomic.LoadInt32(&calls), ShouldEqual, keyCacheSize+1)
+			get(1)
+			So(atomic.LoadInt32(&calls), ShouldEqual, keyCacheSize+2)
+		})
+
+		Convey("verify checkpoint digest", func() {
+			md := &m3u8Downloader{cp: &checkpointWriter{}}
+			So(md.verifyKey("skd://a", key), ShouldEqual, nil)
+			So(md.cp.keys, ShouldContainKey, "skd://a")
+
+			// 续传后第一次获取的秘钥与检查点中记录的不一致时返回不可重试的错误
+			sum := md.cp.keys["skd://a"]
+			md.cp.keys = map[string]string{"skd://a": sum}
+			md.cp.verify = map[string]string{"skd://a": sum}
+			err := md.verifyKey("skd://a", []byte("fedcba9876543210"))
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "changed since checkpoint")
+			So(errors.As(err, new(*PermanentError)), ShouldBeTrue)
+			So(md.cp.keys["skd://a"], ShouldEqual, sum)
+
+			// 校验通过后允许本次下载中秘钥轮换
+			So(md.verifyKey("skd://a", key), ShouldEqual, nil)
+			So(md.verifyKey("skd://a", []byte("fedcba9876543210")), ShouldEqual, nil)
+			So(md.cp.keys["skd://a"], ShouldNotEqual, sum)
+		})
+
+		Convey("mark unsupported", func() {
+			segs := []Segment{
+				{EncryptMeta: EncryptMeta{Method: CryptMethodSampleAES, SecretKeyUrl: "skd://a", KeyFormat: "com.apple.streamingkeydelivery"}},
+				{EncryptMeta: EncryptMeta{Method: CryptMethodSampleAESCTR, SecretKeyUrl: "skd://a"}},
+				{EncryptMeta: EncryptMeta{Method: CryptMethodAES, SecretKeyUrl: "http://example.com/a.key"}},
+			}
+			(&m3u8Downloader{}).markUnsupported(segs)
+			So(segs[0].ErrMsg, ShouldNotEqual, "")
+			So(segs[1].ErrMsg, ShouldEqual, "")
+			So(segs[2].ErrMsg, ShouldEqual, "")
+
+			segs[0].ErrMsg = ""
+			(&m3u8Downloader{keyProvider: KeyProviderFunc(nil)}).markUnsupported(segs)
+			So(segs[0].ErrMsg, ShouldEqual, "")
+			So(segs[1].ErrMsg, ShouldEqual, "")
+		})
+	})
+}
+
+func encryptAES128(plain, key, iv []byte) []byte {
+	n := aes.BlockSize - len(plain)%aes.BlockSize
+	plain = append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(n)}, n)...)
+	b, _ := aes.NewCipher(key)
+	ret := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(b, iv).CryptBlocks(ret, plain)
+	return ret
+}
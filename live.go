@@ -0,0 +1,161 @@
+package m3u8
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	liveEventChanSize = 1024
+	// 直播时事件通道中为合并, 转换和检查点错误等结果事件保留的容量
+	liveResultEvents = 16
+	// 播放列表未提供EXT-X-TARGETDURATION时使用的刷新间隔
+	defaultTargetDuration = 10 * time.Second
+)
+
+// followLive 按照RFC 8216 6.3.4的规定持续刷新媒体播放列表, 并将新增的分片加入下载队列.
+// 播放列表发生变化后至少等待一个目标时长再刷新, 未发生变化则等待目标时长的一半.
+func (md *m3u8Downloader) followLive(ctx context.Context, wg *sync.WaitGroup) error {
+	latest := md.m3u8
+	interval := md.reloadInterval(latest, true)
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-md.stopSignalChan:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		u, err := md.reloadUrl(latest)
+		if err != nil {
+			return err
+		}
+
+		from := md.segmentCnt()
+		var changed bool
+		err = md.retryFetch(ctx, func() (err error) {
+			latest, changed, err = md.reload(ctx, u)
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil || md.needStop() {
+				return nil
+			}
+			// 重试后仍然刷新失败时停止跟随直播, 已下载的分片照常合并, 错误由Status.Err返回
+			md.reloadErr = fmt.Errorf("reload live playlist %s error, %w", u, err)
+			return nil
+		}
+
+		if err = md.schedule(ctx, wg, from); err != nil {
+			return err
+		}
+
+		if latest.EndList {
+			return nil
+		}
+		interval = md.reloadInterval(latest, changed)
+	}
+}
+
+// reload 从u重新获取媒体播放列表, 将Sequence大于已有分片的新分片追加到md.m3u8.Segments中
+func (md *m3u8Downloader) reload(ctx context.Context, u string) (latest *M3u8, changed bool, err error) {
+	start := time.Now()
+	body, fetched, err := md.httpGetPlaylist(ctx, u)
+	if err != nil {
+		return nil, false, fmt.Errorf("http request[%s] fail, %w", u, err)
+	}
+
+	if latest, err = parse(body, md.playlistBase(md.mediaUrl), parseConfig{imports: md.imports, queryUrl: fetched}); err != nil {
+		return nil, false, err
+	}
+	if latest.Skip != nil {
+		md.segLock.RLock()
+		full, err := md.m3u8.ApplyDelta(latest)
+		md.segLock.RUnlock()
+		if err != nil {
+			if u == md.mediaUrl {
+				return nil, false, err
+			}
+			// 增量更新无法与已有的分片衔接, 改为请求一次完整的播放列表
+			return md.reload(ctx, md.mediaUrl)
+		}
+		latest = full
+	}
+	md.lastReload = start
+
+	lastSeq := md.lastSequence()
+
+	var added []Segment
+	for _, v := range latest.Segments {
+		if v.Sequence <= lastSeq {
+			continue
+		}
+		added = append(added, v)
+	}
+
+	md.markUnsupported(added)
+
+	md.segLock.Lock()
+	if len(md.m3u8.Segments) == 0 && len(added) > 0 {
+		// 起始时没有分片, 按第一次出现的分片判断是否为fMP4
+		md.fmp4 = (&M3u8{Segments: added}).IsFMP4()
+	}
+	for _, v := range added {
+		v.Idx = len(md.m3u8.Segments)
+		md.m3u8.Segments = append(md.m3u8.Segments, v)
+	}
+	md.m3u8.EndList = latest.EndList
+	md.m3u8.PlayListType = latest.PlayListType
+	if latest.TargetDuration > 0 {
+		md.m3u8.TargetDuration = latest.TargetDuration
+	}
+	md.m3u8Copy.Common = md.m3u8.Copy()
+	md.segLock.Unlock()
+
+	return latest, len(added) > 0 || latest.EndList, nil
+}
+
+// reloadUrl 返回刷新m使用的地址, 服务端支持增量更新(CAN-SKIP-UNTIL)时通过_HLS_skip=YES请求省略已有分片的播放列表.
+// 按RFC 8216bis 6.2.5.1, 只有距上一次请求播放列表的时间小于CAN-SKIP-UNTIL时才请求增量更新.
+func (md *m3u8Downloader) reloadUrl(m *M3u8) (string, error) {
+	if m.ServerControl == nil || time.Since(md.lastReload) >= m.ServerControl.CanSkipUntil {
+		return md.mediaUrl, nil
+	}
+
+	u, err := url.Parse(md.mediaUrl)
+	if err != nil {
+		return "", fmt.Errorf("url.Parse %s error, %w", md.mediaUrl, err)
+	}
+	q := u.Query()
+	q.Set("_HLS_skip", "YES")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// lastSequence 返回最后一个分片的媒体序列号, 没有分片时返回-1
+func (md *m3u8Downloader) lastSequence() int64 {
+	md.segLock.RLock()
+	defer md.segLock.RUnlock()
+	if n := len(md.m3u8.Segments); n > 0 {
+		return md.m3u8.Segments[n-1].Sequence
+	}
+	return -1
+}
+
+func (md *m3u8Downloader) reloadInterval(m *M3u8, changed bool) time.Duration {
+	d := m.TargetDuration
+	if d <= 0 {
+		d = defaultTargetDuration
+	}
+	if !changed {
+		d /= 2
+	}
+	return d
+}
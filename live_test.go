@@ -0,0 +1,161 @@
+package m3u8
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLive(t *testing.T) {
+	// 播放列表每次请求新增一个分片, 第end个分片后结束; fail返回第n次请求播放列表的状态码, 为0表示正常返回
+	newServer := func(end int, fail func(n int) int) (*httptest.Server, func() int) {
+		var (
+			lock     sync.Mutex
+			requests int
+		)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+			if r.URL.Path != "/index.m3u8" {
+				fmt.Fprint(w, r.URL.Path)
+				return
+			}
+			requests++
+			if code := fail(requests); code != 0 {
+				w.WriteHeader(code)
+				return
+			}
+			last := requests - 1
+			if last > end {
+				last = end
+			}
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-PLAYLIST-TYPE:EVENT\n")
+			for i := 0; i <= last; i++ {
+				fmt.Fprintf(w, "#EXTINF:0.01,\n/%d.ts\n", i)
+			}
+			if last == end {
+				fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+			}
+		}))
+		return s, func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return requests
+		}
+	}
+	download := func(s *httptest.Server) (Status, *bytes.Buffer) {
+		var out bytes.Buffer
+		opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, t.TempDir(), "out", 2)
+		opt.Live, opt.Output = true, &out
+		opt.RetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+		select {
+		case <-st.Done():
+		case <-time.After(10 * time.Second):
+			So("live download not finished", ShouldBeEmpty)
+		}
+		return st, &out
+	}
+
+	Convey("TestLive", t, func() {
+		Convey("grow", func() {
+			// 第3次请求失败一次, 重试后继续跟随
+			s, requests := newServer(3, func(n int) int {
+				if n == 3 {
+					return http.StatusServiceUnavailable
+				}
+				return 0
+			})
+			defer s.Close()
+
+			st, out := download(s)
+			So(st.Err(), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "/0.ts/1.ts/2.ts/3.ts")
+			So(st.TsTotal(), ShouldEqual, 4)
+			So(requests(), ShouldEqual, 4)
+		})
+
+		Convey("empty", func() {
+			// 前两次请求播放列表还没有分片, 等待刷新后出现
+			s, _ := newServer(1, func(n int) int { return 0 })
+			defer s.Close()
+			var emptyCnt int32
+			empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/static.m3u8" || (r.URL.Path == "/index.m3u8" && atomic.AddInt32(&emptyCnt, 1) <= 2) {
+					fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-PLAYLIST-TYPE:EVENT\n")
+					return
+				}
+				s.Config.Handler.ServeHTTP(w, r)
+			}))
+			defer empty.Close()
+
+			st, out := download(empty)
+			So(st.Err(), ShouldEqual, nil)
+			So(out.String(), ShouldEqual, "/0.ts/1.ts")
+
+			// 不是直播时没有分片的播放列表仍然报错
+			opt := NewDefaultOption(empty.URL+"/static.m3u8", ModelMerged, t.TempDir(), "out", 2)
+			opt.Output = &bytes.Buffer{}
+			_, err := DownloadWithOpt(context.Background(), opt)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "ts files list is empty")
+		})
+
+		Convey("reload error", func() {
+			// 第一次刷新起播放列表不存在, 停止跟随并通过Err返回错误, 已下载的分片照常输出
+			s, requests := newServer(3, func(n int) int {
+				if n > 1 {
+					return http.StatusNotFound
+				}
+				return 0
+			})
+			defer s.Close()
+
+			st, out := download(s)
+			var se *StatusError
+			So(errors.As(st.Err(), &se), ShouldBeTrue)
+			So(se.StatusCode, ShouldEqual, http.StatusNotFound)
+			So(out.String(), ShouldEqual, "/0.ts")
+			So(requests(), ShouldEqual, 2)
+		})
+
+		Convey("retry exhausted", func() {
+			s, requests := newServer(3, func(n int) int {
+				if n > 1 {
+					return http.StatusBadGateway
+				}
+				return 0
+			})
+			defer s.Close()
+
+			st, out := download(s)
+			So(st.Err(), ShouldNotEqual, nil)
+			So(out.String(), ShouldEqual, "/0.ts")
+			So(requests(), ShouldEqual, 4)
+		})
+	})
+}
+
+func TestSendSegmentEvent(t *testing.T) {
+	Convey("TestSendSegmentEvent", t, func() {
+		md := &m3u8Downloader{live: true, eventChan: make(chan Event, liveResultEvents+4), eventLock: &sync.Mutex{}}
+		// 调用方不读取事件时分片的事件被丢弃而不是阻塞
+		for i := 0; i < 10; i++ {
+			md.sendSegmentEvent(Event{Segment: &Segment{Idx: i}})
+		}
+		So(len(md.eventChan), ShouldEqual, 4)
+		So((<-md.eventChan).Segment.Idx, ShouldEqual, 0)
+		md.sendSegmentEvent(Event{Segment: &Segment{Idx: 10}})
+		So(len(md.eventChan), ShouldEqual, 4)
+	})
+}
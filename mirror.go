@@ -0,0 +1,207 @@
+package m3u8
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// keepEncrypted 返回是否保存原始的加密分片, 仅ModelMirror且未设置MirrorDecrypt时为true
+func (md *m3u8Downloader) keepEncrypted() bool {
+	return md.mirror && !md.mirrorDecrypt
+}
+
+// mirrorSegment 下载索引为idx的分片但不解密, 并获取分片使用的秘钥, 秘钥在生成播放列表时保存为本地文件
+func (md *m3u8Downloader) mirrorSegment(ctx context.Context, idx int, fetch func(seg Segment, wrap segmentWrap) error) error {
+	seg := md.segment(idx)
+	if err := fetch(seg, nil); err != nil {
+		return err
+	}
+	if !seg.IsEncrypted() {
+		return nil
+	}
+	// 同一个SecretKeyUrl的秘钥可能轮换, 按下载时获取到的秘钥记录
+	key, err := md.keys.get(ctx, seg.EncryptMeta, nil)
+	if err != nil {
+		return fmt.Errorf("get secret key %s error, %w", seg.EncryptMeta.SecretKeyUrl, err)
+	}
+	md.useKey(idx, key)
+	return nil
+}
+
+// writeMirror 生成ModelMirror的播放列表, 返回入口播放列表和备选媒体的媒体播放列表的路径.
+// 存在主播放列表时入口为只包含选中码流和备选媒体的主播放列表, 否则为媒体播放列表.
+func (md *m3u8Downloader) writeMirror(ctx context.Context) (string, []string, error) {
+	master := md.m3u8Copy.MastPlay
+	mediaName := md.tsFilePrefix + ".m3u8"
+	if master != nil {
+		mediaName = md.tsFilePrefix + "_media.m3u8"
+	}
+	mediaPath, err := md.writeMediaPlaylist(ctx, mediaName)
+	if err != nil {
+		return "", nil, err
+	}
+
+	renditionPaths := make([]string, len(md.renditions))
+	for i, r := range md.renditions {
+		if renditionPaths[i], err = r.writeMediaPlaylist(ctx, r.tsFilePrefix+".m3u8"); err != nil {
+			return "", nil, err
+		}
+	}
+	if master == nil {
+		return mediaPath, renditionPaths, nil
+	}
+
+	m := master.Copy()
+	m.UnknownTags = dropRemoteTags(m.UnknownTags)
+	m.MediaList = nil
+	for _, v := range master.MediaList {
+		if v.Url == "" {
+			m.MediaList = append(m.MediaList, v)
+			continue
+		}
+		for i, r := range md.renditions {
+			if *r.media == v {
+				v.Url = filepath.Base(renditionPaths[i])
+				m.MediaList = append(m.MediaList, v)
+				break
+			}
+		}
+	}
+
+	// 未下载任何备选媒体的组从码流中去除
+	hasGroup := func(typ, groupId string) bool {
+		for _, v := range m.MediaList {
+			if v.Type == typ && v.GroupId == groupId {
+				return true
+			}
+		}
+		return false
+	}
+	variant := *md.variant
+	variant.M3u8Url = mediaName
+	if !hasGroup(MediaTypeAudio, variant.Audio) {
+		variant.Audio = ""
+	}
+	if !hasGroup(MediaTypeVideo, variant.Video) {
+		variant.Video = ""
+	}
+	if !hasGroup(MediaTypeSubtitles, variant.Subtitles) {
+		variant.Subtitles = ""
+	}
+	m.MastPlayList = []PlayInfo{variant}
+
+	path := md.fullPath(md.tsFilePrefix + ".m3u8")
+	if err = os.WriteFile(path, m.Encode(), os.ModePerm); err != nil {
+		return "", nil, fmt.Errorf("os.WriteFile %s error, %w", path, err)
+	}
+	return path, renditionPaths, nil
+}
+
+// writeMediaPlaylist 将下载成功的分片写入FileDir下名为name的媒体播放列表, 分片, 初始化分片和秘钥的地址改写为相对路径.
+// 下载失败的分片被去除, 其后的分片标记为EXT-X-DISCONTINUITY.
+func (md *m3u8Downloader) writeMediaPlaylist(ctx context.Context, name string) (string, error) {
+	md.segLock.RLock()
+	m := md.m3u8.Copy()
+	md.segLock.RUnlock()
+
+	var (
+		segs    []Segment
+		dropped bool // 上一个分片下载失败
+		shifted bool // 之前有分片下载失败, 之后的分片的媒体序列号与原播放列表不一致
+		keys    = make(map[string]string)
+	)
+	for idx, v := range m.Segments {
+		if v.ErrMsg != "" {
+			dropped, shifted = true, true
+			continue
+		}
+
+		// 续传时已完成的分片对应的初始化分片可能尚未下载
+		if err := md.ensureInit(ctx, v); err != nil {
+			return "", err
+		}
+		if v.Map != nil {
+			v.Map = &Map{Url: filepath.Base(md.initPath(v))}
+		}
+		v.Url, v.ByteRange = md.tsName(idx), nil
+		v.UnknownTags = dropRemoteTags(v.UnknownTags)
+		v.Discontinuity = v.Discontinuity || dropped
+		dropped = false
+
+		switch {
+		case !v.IsEncrypted() || !md.keepEncrypted():
+			v.EncryptMeta = EncryptMeta{}
+		default:
+			meta, err := md.mirrorKey(ctx, v, shifted, keys)
+			if err != nil {
+				return "", err
+			}
+			v.EncryptMeta = meta
+		}
+		segs = append(segs, v)
+	}
+	m.Segments = segs
+	// 镜像是下载结束时的快照, 即使源是直播也不会再更新, 去除刷新相关的标签
+	m.EndList = true
+	m.ServerControl, m.Skip = nil, nil
+	m.UnknownTags = dropRemoteTags(m.UnknownTags)
+
+	path := md.fullPath(name)
+	if err := os.WriteFile(path, m.Encode(), os.ModePerm); err != nil {
+		return "", fmt.Errorf("os.WriteFile %s error, %w", path, err)
+	}
+	return path, nil
+}
+
+// dropRemoteTags 去除带有URI属性的未知标签. 镜像不下载这些标签引用的I帧播放列表, 会话秘钥和会话数据等资源,
+// 保留时其中的地址仍指向源站或者相对于源站, 在镜像中无法访问.
+func dropRemoteTags(tags []string) []string {
+	var ret []string
+	for _, v := range tags {
+		if _, ok := toParam(v)["URI"]; ok {
+			continue
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// mirrorKey 将分片的秘钥保存为本地文件并返回改写后的EncryptMeta, keys记录已保存的秘钥对应的文件名.
+// shifted为true时分片的媒体序列号已经变化, 未指定IV的分片显式写出由原媒体序列号得到的IV.
+func (md *m3u8Downloader) mirrorKey(ctx context.Context, seg Segment, shifted bool, keys map[string]string) (EncryptMeta, error) {
+	key := seg.EncryptMeta.SecretKey
+	if key == "" {
+		// 续传前已完成的分片没有记录秘钥
+		v, err := md.keys.get(ctx, seg.EncryptMeta, nil)
+		if err != nil {
+			return EncryptMeta{}, fmt.Errorf("get secret key %s error, %w", seg.EncryptMeta.SecretKeyUrl, err)
+		}
+		key = string(v)
+	}
+
+	name, ok := keys[key]
+	if !ok {
+		name = md.tsFilePrefix + "_" + keyId(key) + ".key"
+		if err := os.WriteFile(md.fullPath(name), []byte(key), os.ModePerm); err != nil {
+			return EncryptMeta{}, fmt.Errorf("os.WriteFile %s error, %w", name, err)
+		}
+		keys[key] = name
+	}
+
+	ret := EncryptMeta{
+		Method:       seg.EncryptMeta.Method,
+		SecretKeyUrl: name,
+		IV:           seg.EncryptMeta.IV,
+	}
+	if ret.IV == "" && shifted {
+		iv, err := seg.aesIV()
+		if err != nil {
+			return EncryptMeta{}, err
+		}
+		ret.IV = "0x" + hex.EncodeToString(iv)
+	}
+	return ret, nil
+}
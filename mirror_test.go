@@ -0,0 +1,196 @@
+package m3u8
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMirror(t *testing.T) {
+	Convey("TestMirror", t, func() {
+		key := []byte("0123456789abcdef")
+		// 加密的初始化分片要求EXT-X-KEY指定IV
+		iv := []byte("fedcba9876543210")
+		mux := http.NewServeMux()
+		mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n")
+			fmt.Fprint(w, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"en\",DEFAULT=YES,URI=\"audio/index.m3u8\"\n")
+			fmt.Fprint(w, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"fr\",URI=\"audio/fr.m3u8\"\n")
+			fmt.Fprint(w, "#EXT-X-STREAM-INF:BANDWIDTH=100,AUDIO=\"aud\"\nvideo/index.m3u8\n")
+			fmt.Fprint(w, "#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=10,URI=\"video/iframe.m3u8\"\n")
+			fmt.Fprint(w, "#EXT-X-SESSION-KEY:METHOD=AES-128,URI=\"key.bin\"\n")
+			fmt.Fprint(w, "#EXT-X-SESSION-DATA:DATA-ID=\"com.example.title\",VALUE=\"demo\"\n")
+			fmt.Fprint(w, "#EXT-X-SESSION-DATA:DATA-ID=\"com.example.info\",URI=\"info.json\"\n")
+		})
+		mux.HandleFunc("/video/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n")
+			fmt.Fprintf(w, "#EXT-X-KEY:METHOD=AES-128,URI=\"../key.bin\",IV=0x%x\n#EXT-X-MAP:URI=\"init.mp4\"\n", iv)
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(w, "#EXTINF:2,\n%d.m4s\n", i)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+		})
+		mux.HandleFunc("/audio/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\na0.ts\n#EXTINF:2,\na1.ts\n#EXT-X-ENDLIST\n")
+		})
+		mux.HandleFunc("/key.bin", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(key)
+		})
+		mux.HandleFunc("/video/", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(encryptAES128([]byte(r.URL.Path), key, iv))
+		})
+		mux.HandleFunc("/audio/", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "G"+r.URL.Path)
+		})
+		s := httptest.NewServer(mux)
+		defer s.Close()
+
+		download := func(decrypt bool) *Result {
+			opt := NewDefaultOption(s.URL+"/master.m3u8", ModelMirror, t.TempDir()+"/files", "out", 4)
+			opt.MirrorDecrypt = decrypt
+			st, err := DownloadWithOpt(context.Background(), opt)
+			So(err, ShouldEqual, nil)
+			ret := GenResult(st, false)
+			So(ret.Merged, ShouldBeTrue)
+			So(ret.MergeErr, ShouldEqual, "")
+			So(ret.MergedFilePath, ShouldEqual, opt.FileDir+"/out.m3u8")
+			return ret
+		}
+		// parseLocal 解析本地的播放列表, 返回读取与播放列表在同一目录下的文件的函数.
+		// 相对地址按http://mirror/解析, 读取时只使用地址中的文件名.
+		parseLocal := func(path string) (*M3u8, func(u string) string) {
+			body, err := os.ReadFile(path)
+			So(err, ShouldEqual, nil)
+			So(string(body), ShouldNotContainSubstring, s.URL)
+			m, err := Parse(body, "http://mirror/"+filepath.Base(path))
+			So(err, ShouldEqual, nil)
+			return m, func(u string) string {
+				body, err := os.ReadFile(filepath.Join(filepath.Dir(path), filepath.Base(u)))
+				So(err, ShouldEqual, nil)
+				return string(body)
+			}
+		}
+
+		Convey("keep encrypted", func() {
+			ret := download(false)
+			master, _ := parseLocal(ret.MergedFilePath)
+			So(len(master.MastPlayList), ShouldEqual, 1)
+			So(master.MastPlayList[0].Audio, ShouldEqual, "aud")
+			// 未下载的备选媒体被去除
+			So(len(master.MediaList), ShouldEqual, 1)
+			So(master.MediaList[0].Name, ShouldEqual, "en")
+			So(len(ret.Renditions), ShouldEqual, 1)
+			So(filepath.Base(ret.Renditions[0].MergedFilePath), ShouldEqual, filepath.Base(master.MediaList[0].Url))
+			// 引用未下载资源的标签被去除
+			So(master.UnknownTags, ShouldResemble, []string{"#EXT-X-SESSION-DATA:DATA-ID=\"com.example.title\",VALUE=\"demo\""})
+
+			media, read := parseLocal(filepath.Join(filepath.Dir(ret.MergedFilePath), filepath.Base(master.MastPlayList[0].M3u8Url)))
+			So(media.EndList, ShouldBeTrue)
+			So(len(media.Segments), ShouldEqual, 3)
+			for i, v := range media.Segments {
+				So(v.EncryptMeta.Method, ShouldEqual, CryptMethodAES)
+				So(read(v.EncryptMeta.SecretKeyUrl), ShouldEqual, string(key))
+				plain, err := decryptByAES128([]byte(read(v.Url)), key, iv)
+				So(err, ShouldEqual, nil)
+				So(string(plain), ShouldEqual, fmt.Sprintf("/video/%d.m4s", i))
+			}
+			plain, err := decryptByAES128([]byte(read(media.Segments[0].Map.Url)), key, iv)
+			So(err, ShouldEqual, nil)
+			So(string(plain), ShouldEqual, "/video/init.mp4")
+
+			audio, read := parseLocal(ret.Renditions[0].MergedFilePath)
+			So(len(audio.Segments), ShouldEqual, 2)
+			So(read(audio.Segments[1].Url), ShouldEqual, "G/audio/a1.ts")
+
+			// 完成后删除检查点
+			_, err = os.Stat(filepath.Join(filepath.Dir(ret.MergedFilePath), "out"+checkpointSuffix))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("decrypt", func() {
+			ret := download(true)
+			master, _ := parseLocal(ret.MergedFilePath)
+			media, read := parseLocal(filepath.Join(filepath.Dir(ret.MergedFilePath), filepath.Base(master.MastPlayList[0].M3u8Url)))
+			So(len(media.Segments), ShouldEqual, 3)
+			So(strings.Contains(read(master.MastPlayList[0].M3u8Url), "EXT-X-KEY"), ShouldBeFalse)
+			for i, v := range media.Segments {
+				So(v.IsEncrypted(), ShouldBeFalse)
+				So(read(v.Url), ShouldEqual, fmt.Sprintf("/video/%d.m4s", i))
+			}
+			So(read(media.Segments[0].Map.Url), ShouldEqual, "/video/init.mp4")
+		})
+
+		Convey("failed segments", func() {
+			md := &m3u8Downloader{
+				fileDir:      t.TempDir(),
+				tsFilePrefix: "out",
+				mirror:       true,
+				keys:         newKeyCache(KeyProviderFunc(func(context.Context, EncryptMeta) ([]byte, error) { return key, nil }), 0, RetryPolicy{}),
+				inits:        make(map[string]*initSegment),
+				m3u8: &M3u8{
+					MediaSequence: 10,
+					EndList:       true,
+					Segments: []Segment{
+						{Sequence: 10, Url: "http://a/0.ts", ErrMsg: "404"},
+						{Sequence: 11, Url: "http://a/1.ts", EncryptMeta: EncryptMeta{Method: CryptMethodAES, SecretKeyUrl: "http://a/k"}},
+						{Sequence: 12, Url: "http://a/2.ts", EncryptMeta: EncryptMeta{Method: CryptMethodAES, SecretKeyUrl: "http://a/k", IV: "0x000102030405060708090a0b0c0d0e0f"}},
+					},
+				},
+			}
+			path, err := md.writeMediaPlaylist(context.Background(), "out.m3u8")
+			So(err, ShouldEqual, nil)
+			m, _ := parseLocal(path)
+			So(len(m.Segments), ShouldEqual, 2)
+			So(filepath.Base(m.Segments[0].Url), ShouldEqual, "out_1.ts")
+			So(m.Segments[0].Discontinuity, ShouldBeTrue)
+			So(m.Segments[1].Discontinuity, ShouldBeFalse)
+			// 去除失败的分片后按原媒体序列号显式指定IV
+			iv, err := m.Segments[0].aesIV()
+			So(err, ShouldEqual, nil)
+			So(iv, ShouldResemble, sequenceIV(11))
+			So(m.Segments[1].EncryptMeta.IV, ShouldEqual, "0x000102030405060708090a0b0c0d0e0f")
+		})
+
+		Convey("live source", func() {
+			md := &m3u8Downloader{
+				fileDir:      t.TempDir(),
+				tsFilePrefix: "out",
+				mirror:       true,
+				inits:        make(map[string]*initSegment),
+				m3u8: &M3u8{
+					PlayListType:   "EVENT",
+					TargetDuration: 2 * time.Second,
+					MediaSequence:  5,
+					ServerControl:  &ServerControl{CanSkipUntil: 12 * time.Second},
+					Skip:           &Skip{SkippedSegments: 3},
+					Segments: []Segment{
+						{Sequence: 5, Duration: 2 * time.Second, Url: "http://a/5.ts"},
+						{Sequence: 6, Duration: 2 * time.Second, Url: "http://a/6.ts", UnknownTags: []string{"#EXT-X-PART:DURATION=1,URI=\"6.0.mp4\"", "#EXT-X-DATERANGE:ID=\"ad\",START-DATE=\"2020-01-01T00:00:00Z\""}},
+					},
+					UnknownTags: []string{"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"7.0.mp4\""},
+				},
+			}
+			path, err := md.writeMediaPlaylist(context.Background(), "out.m3u8")
+			So(err, ShouldEqual, nil)
+			body, err := os.ReadFile(path)
+			So(err, ShouldEqual, nil)
+			for _, tag := range []string{"#EXT-X-SERVER-CONTROL", "#EXT-X-SKIP", "#EXT-X-PART", "#EXT-X-PRELOAD-HINT"} {
+				So(string(body), ShouldNotContainSubstring, tag)
+			}
+			m, _ := parseLocal(path)
+			So(m.EndList, ShouldBeTrue)
+			So(m.MediaSequence, ShouldEqual, 5)
+			So(len(m.Segments), ShouldEqual, 2)
+			So(m.Segments[1].UnknownTags, ShouldResemble, []string{"#EXT-X-DATERANGE:ID=\"ad\",START-DATE=\"2020-01-01T00:00:00Z\""})
+			So(md.m3u8.EndList, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,135 @@
+package m3u8
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// errOutputAborted 下载被停止, 不再向Output写入
+var errOutputAborted = errors.New("output aborted")
+
+// segmentWriter 按分片顺序将下载完成的分片写入io.Writer.
+// 乱序完成的分片在内存中等待, 索引超出窗口的分片会阻塞直到前面的分片写入, 内存中最多缓存limit个分片.
+type segmentWriter struct {
+	w       io.Writer
+	limit   int
+	lock    sync.Mutex
+	cond    *sync.Cond
+	next    int                   // 下一个需要写入的分片索引
+	ready   map[int]*readySegment // 已下载等待写入的分片
+	lastMap string                // 上一个写入的分片的EXT-X-MAP, fMP4分片在EXT-X-MAP变化时先写入初始化分片
+	written int64
+	skipped int // 跳过的分片数
+	err     error
+}
+
+type readySegment struct {
+	skip    bool // 下载失败的分片, 直接跳过
+	mapKey  string
+	initSeg []byte
+	body    []byte
+}
+
+func newSegmentWriter(w io.Writer, limit int) *segmentWriter {
+	if limit <= 0 {
+		limit = 1
+	}
+	ret := &segmentWriter{
+		w:     w,
+		limit: limit,
+		ready: make(map[int]*readySegment),
+	}
+	ret.cond = sync.NewCond(&ret.lock)
+	return ret
+}
+
+// put 提交索引为idx的分片, 并写出所有已经连续的分片
+func (s *segmentWriter) put(idx int, seg *readySegment) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.err == nil && idx >= s.next+s.limit {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return s.err
+	}
+
+	s.ready[idx] = seg
+	for {
+		v, ok := s.ready[s.next]
+		if !ok {
+			break
+		}
+		delete(s.ready, s.next)
+		s.next++
+		if v.skip {
+			s.skipped++
+			continue
+		}
+		if err := s.write(v); err != nil {
+			s.err = fmt.Errorf("write to output error, %w", err)
+			break
+		}
+	}
+	s.cond.Broadcast()
+	return s.err
+}
+
+func (s *segmentWriter) write(v *readySegment) error {
+	if v.mapKey != s.lastMap && v.initSeg != nil {
+		n, err := s.w.Write(v.initSeg)
+		s.written += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	s.lastMap = v.mapKey
+	n, err := s.w.Write(v.body)
+	s.written += int64(n)
+	return err
+}
+
+// skip 跳过索引为idx的分片
+func (s *segmentWriter) skip(idx int) {
+	_ = s.put(idx, &readySegment{skip: true})
+}
+
+// abort 停止写入并唤醒所有等待的分片
+func (s *segmentWriter) abort() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = errOutputAborted
+	}
+	s.cond.Broadcast()
+}
+
+// result 返回已写入的字节数, 跳过的分片数和写入错误
+func (s *segmentWriter) result() (int64, int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.written, s.skipped, s.err
+}
+
+// writeSegment 下载索引为idx的分片到内存并按顺序写入Output, 下载失败时由调用方跳过该分片
+func (md *m3u8Downloader) writeSegment(ctx context.Context, idx int) error {
+	var body []byte
+	err := md.downloadSegment(ctx, idx, func(seg Segment, wrap segmentWrap) (err error) {
+		body, err = md.readSegment(ctx, seg, wrap)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	seg := md.segment(idx)
+	ready := &readySegment{body: body}
+	if seg.Map != nil {
+		ready.mapKey = mapKey(seg.Map)
+		ready.initSeg = md.initBody(seg)
+	}
+	return md.out.put(idx, ready)
+}
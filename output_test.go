@@ -0,0 +1,173 @@
+package m3u8
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSegmentWriter(t *testing.T) {
+	Convey("TestSegmentWriter", t, func() {
+		Convey("reorder", func() {
+			var buf bytes.Buffer
+			w := newSegmentWriter(&buf, 3)
+			const n = 50
+			var (
+				wg   sync.WaitGroup
+				errs int32
+			)
+			for _, idx := range rand.Perm(n) {
+				idx := idx
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if idx == 7 {
+						w.skip(idx)
+						return
+					}
+					if w.put(idx, &readySegment{body: []byte(fmt.Sprintf("%d,", idx))}) != nil {
+						atomic.AddInt32(&errs, 1)
+					}
+				}()
+			}
+			wg.Wait()
+			So(errs, ShouldEqual, 0)
+
+			var expect bytes.Buffer
+			for i := 0; i < n; i++ {
+				if i != 7 {
+					fmt.Fprintf(&expect, "%d,", i)
+				}
+			}
+			So(buf.String(), ShouldEqual, expect.String())
+			written, skipped, err := w.result()
+			So(err, ShouldEqual, nil)
+			So(written, ShouldEqual, expect.Len())
+			So(skipped, ShouldEqual, 1)
+		})
+
+		Convey("abort", func() {
+			w := newSegmentWriter(&bytes.Buffer{}, 1)
+			errCh := make(chan error)
+			go func() {
+				errCh <- w.put(5, &readySegment{})
+			}()
+			w.abort()
+			So(<-errCh, ShouldEqual, errOutputAborted)
+		})
+	})
+}
+
+func TestDownloadToOutput(t *testing.T) {
+	Convey("TestDownloadToOutput", t, func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init.mp4\"\n")
+			for i := 0; i < 20; i++ {
+				if i == 10 {
+					fmt.Fprint(w, "#EXT-X-MAP:URI=\"init2.mp4\"\n")
+				}
+				fmt.Fprintf(w, "#EXTINF:2,\n%d.m4s\n", i)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+		})
+		mux.HandleFunc("/init.mp4", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "I1;")
+		})
+		mux.HandleFunc("/init2.mp4", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "I2;")
+		})
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s;", r.URL.Path[1:])
+		})
+		s := httptest.NewServer(mux)
+		defer s.Close()
+
+		var out bytes.Buffer
+		opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, t.TempDir()+"/files", "out", 4)
+		opt.Output = &out
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+		ret := GenResult(st, false)
+		So(ret.Merged, ShouldBeTrue)
+
+		var expect bytes.Buffer
+		expect.WriteString("I1;")
+		for i := 0; i < 20; i++ {
+			if i == 10 {
+				expect.WriteString("I2;")
+			}
+			fmt.Fprintf(&expect, "%d.m4s;", i)
+		}
+		So(out.String(), ShouldEqual, expect.String())
+
+		// 不在FileDir中保存任何文件
+		_, err = os.Stat(opt.FileDir)
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		opt.Model = ModelConvertToMP4
+		_, err = DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestDownloadToOutputInitFail(t *testing.T) {
+	Convey("TestDownloadToOutputInitFail", t, func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"bad.mp4\"\n")
+			for i := 0; i < 20; i++ {
+				if i == 10 {
+					fmt.Fprint(w, "#EXT-X-MAP:URI=\"init.mp4\"\n")
+				}
+				fmt.Fprintf(w, "#EXTINF:2,\n%d.m4s\n", i)
+			}
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+		})
+		mux.HandleFunc("/bad.mp4", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+		mux.HandleFunc("/init.mp4", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "I;")
+		})
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s;", r.URL.Path[1:])
+		})
+		s := httptest.NewServer(mux)
+		defer s.Close()
+
+		var out bytes.Buffer
+		opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, t.TempDir(), "out", 2)
+		opt.Output = &out
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+
+		// 初始化分片获取失败的分片被跳过, 之后的分片不会一直等待
+		select {
+		case <-st.Done():
+		case <-time.After(10 * time.Second):
+			st.Shutdown()
+			So("output stalled", ShouldBeEmpty)
+		}
+		ret := GenResult(st, false)
+		So(ret.Merged, ShouldBeFalse)
+		So(ret.MergeErr, ShouldContainSubstring, "10 segments")
+
+		var expect bytes.Buffer
+		expect.WriteString("I;")
+		for i := 10; i < 20; i++ {
+			fmt.Fprintf(&expect, "%d.m4s;", i)
+		}
+		So(out.String(), ShouldEqual, expect.String())
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -15,10 +16,22 @@ import (
 )
 
 type M3u8 struct {
-	Segments     []Segment
-	MastPlayList []PlayInfo
-	PlayListType string
-	EndList      bool
+	Segments              []Segment
+	MastPlayList          []PlayInfo
+	MediaList             []Media // 主播放列表中的EXT-X-MEDIA
+	PlayListType          string
+	EndList               bool
+	TargetDuration        time.Duration
+	Version               int
+	MediaSequence         int64
+	DiscontinuitySequence int64
+	IndependentSegments   bool
+	IFramesOnly           bool
+	Start                 *Start
+	ServerControl         *ServerControl    // EXT-X-SERVER-CONTROL
+	Skip                  *Skip             // 不为nil表示播放列表是增量更新, 需要通过ApplyDelta得到完整的播放列表
+	Variables             map[string]string // EXT-X-DEFINE定义的变量, 播放列表中的变量引用已经被替换
+	UnknownTags           []string          // 未被解析且其后没有分片的标签, 按出现顺序保存
 }
 
 func (m *M3u8) Copy() *M3u8 {
@@ -26,8 +39,19 @@ func (m *M3u8) Copy() *M3u8 {
 		return nil
 	}
 	ret := &M3u8{
-		PlayListType: m.PlayListType,
-		EndList:      m.EndList,
+		PlayListType:          m.PlayListType,
+		EndList:               m.EndList,
+		TargetDuration:        m.TargetDuration,
+		Version:               m.Version,
+		MediaSequence:         m.MediaSequence,
+		DiscontinuitySequence: m.DiscontinuitySequence,
+		IndependentSegments:   m.IndependentSegments,
+		IFramesOnly:           m.IFramesOnly,
+		Start:                 m.Start,
+		ServerControl:         m.ServerControl,
+		Skip:                  m.Skip,
+		Variables:             m.Variables,
+		UnknownTags:           m.UnknownTags,
 	}
 	if m.Segments != nil {
 		ret.Segments = make([]Segment, len(m.Segments), len(m.Segments))
@@ -37,14 +61,33 @@ func (m *M3u8) Copy() *M3u8 {
 		ret.MastPlayList = make([]PlayInfo, len(m.MastPlayList), len(m.MastPlayList))
 		copy(ret.MastPlayList, m.MastPlayList)
 	}
+	if m.MediaList != nil {
+		ret.MediaList = make([]Media, len(m.MediaList), len(m.MediaList))
+		copy(ret.MediaList, m.MediaList)
+	}
 	return ret
 }
 
+// Start 对应EXT-X-START, 表示播放的首选起始位置
+type Start struct {
+	TimeOffset float64 // 单位秒, 负数表示相对播放列表末尾的偏移
+	Precise    bool
+}
+
 type PlayInfo struct {
-	M3u8Url    string
-	ProgramId  int64
-	BandWidth  int64
-	Resolution Resolution
+	M3u8Url          string
+	ProgramId        int64
+	BandWidth        int64
+	AverageBandWidth int64
+	Resolution       Resolution
+	Codecs           string
+	FrameRate        float64
+	HdcpLevel        string
+	VideoRange       string
+	Audio            string // 音频EXT-X-MEDIA的GROUP-ID
+	Video            string // 视频EXT-X-MEDIA的GROUP-ID
+	Subtitles        string // 字幕EXT-X-MEDIA的GROUP-ID
+	ClosedCaptions   string // 隐藏式字幕EXT-X-MEDIA的GROUP-ID, 或者NONE
 }
 
 type Resolution struct {
@@ -52,35 +95,147 @@ type Resolution struct {
 	High  int64
 }
 
+// EXT-X-MEDIA的TYPE
+const (
+	MediaTypeAudio          = "AUDIO"
+	MediaTypeVideo          = "VIDEO"
+	MediaTypeSubtitles      = "SUBTITLES"
+	MediaTypeClosedCaptions = "CLOSED-CAPTIONS"
+)
+
+// Media 对应EXT-X-MEDIA, 描述主播放列表中的一个备选媒体
+type Media struct {
+	Type            string
+	GroupId         string
+	Language        string
+	AssocLanguage   string
+	Name            string
+	Default         bool
+	AutoSelect      bool
+	Forced          bool
+	InstreamId      string
+	Characteristics string
+	Channels        string
+	Url             string // 为空表示该媒体包含在码流中
+}
+
 type Segment struct {
-	Idx         int
-	Url         string
-	Duration    time.Duration
-	Sequence    int64
-	EncryptMeta EncryptMeta
-	ErrMsg      string
+	Idx             int
+	Url             string
+	Duration        time.Duration
+	Sequence        int64
+	EncryptMeta     EncryptMeta
+	Discontinuity   bool
+	ProgramDateTime time.Time  // 未指定EXT-X-PROGRAM-DATE-TIME时为零值
+	ByteRange       *ByteRange // 为nil表示分片是完整的资源
+	Map             *Map       // 分片对应的EXT-X-MAP, 为nil表示没有初始化分片
+	Title           string     // EXTINF中的标题
+	UnknownTags     []string   // 分片之前未被解析的标签, 按出现顺序保存
+	ErrMsg          string
+}
+
+// ByteRange 对应EXT-X-BYTERANGE和EXT-X-MAP的BYTERANGE属性, 表示资源中[Offset, Offset+Length)的子区间
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+// Map 对应EXT-X-MAP, 描述解析后续分片所需的媒体初始化分片
+type Map struct {
+	Url       string
+	ByteRange *ByteRange
+}
+
+// ServerControl 对应EXT-X-SERVER-CONTROL, 仅解析增量更新相关的属性
+type ServerControl struct {
+	CanSkipUntil      time.Duration // 可以通过_HLS_skip请求增量更新的范围, 为0表示不支持
+	CanSkipDateRanges bool
+	HoldBack          time.Duration
+}
+
+// Skip 对应EXT-X-SKIP, 增量更新中代替播放列表开头的SkippedSegments个分片
+type Skip struct {
+	SkippedSegments           int64
+	RecentlyRemovedDateRanges []string // 已经从播放列表中删除的EXT-X-DATERANGE的ID
 }
 
 func (s Segment) IsEncrypted() bool {
-	return s.EncryptMeta.Method == CryptMethodAES
+	return s.EncryptMeta.Method != "" && s.EncryptMeta.Method != CryptMethodNONE
+}
+
+// aesIV 返回分片解密使用的IV. EXT-X-KEY未指定IV时, 按照RFC 8216使用分片的媒体序列号作为IV
+func (s Segment) aesIV() ([]byte, error) {
+	if s.EncryptMeta.IV == "" {
+		return sequenceIV(s.Sequence), nil
+	}
+	return decodeIV(s.EncryptMeta.IV)
 }
 
 type EncryptMeta struct {
-	SecretKeyUrl string
-	IV           string
-	Method       string
-	SecretKey    string
+	SecretKeyUrl      string
+	IV                string
+	Method            string
+	KeyFormat         string // 为空表示identity
+	KeyFormatVersions string
+	SecretKey         string
+}
+
+// IsClearKey 返回密钥是否可以直接从URI获取, 即KEYFORMAT为identity
+func (e EncryptMeta) IsClearKey() bool {
+	return e.KeyFormat == "" || e.KeyFormat == KeyFormatIdentity
 }
 
 const (
-	CryptMethodAES  = "AES-128"
-	CryptMethodNONE = "NONE"
+	CryptMethodAES          = "AES-128"
+	CryptMethodSampleAES    = "SAMPLE-AES"     // 支持解密ts分片, 不支持fMP4分片(cbcs)
+	CryptMethodSampleAESCTR = "SAMPLE-AES-CTR" // 支持解密fMP4分片(cenc)
+	CryptMethodNONE         = "NONE"
+
+	KeyFormatIdentity = "identity"
 )
 
-var attrReg = regexp.MustCompile(`([A-Z-]+)=("[^"\n\r]+"|[^",\s]+)`)
+var (
+	attrReg    = regexp.MustCompile(`([A-Z-]+)=("[^"\n\r]+"|[^",\s]+)`)
+	varNameReg = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	varRefReg  = regexp.MustCompile(`\{\$([a-zA-Z0-9_-]+)\}`)
+	quotedReg  = regexp.MustCompile(`"[^"\r\n]*"`)
+)
 
 // 注意Parse不会填充SecretKey
 func Parse(content []byte, m3u8Url string) (*M3u8, error) {
+	return ParseWithImport(content, m3u8Url, nil)
+}
+
+// ParseFile 解析本地的播放列表文件, 相对地址按文件所在的目录解析
+func ParseFile(path string) (*M3u8, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile %s error, %w", path, err)
+	}
+	u, err := fileUrl(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content, u)
+}
+
+// ParseWithImport 解析从主播放列表加载的媒体播放列表, imports为主播放列表的Variables, 供EXT-X-DEFINE的IMPORT引用
+func ParseWithImport(content []byte, m3u8Url string, imports map[string]string) (*M3u8, error) {
+	return parse(content, m3u8Url, parseConfig{imports: imports})
+}
+
+// parseConfig 解析播放列表的可选参数
+type parseConfig struct {
+	imports map[string]string // 主播放列表的Variables, 供EXT-X-DEFINE的IMPORT引用
+	// queryUrl 实际获取播放列表的地址(重定向之后), EXT-X-DEFINE的QUERYPARAM取其中的查询参数, 为空时使用m3u8Url
+	queryUrl string
+	// report 不为nil时为宽松模式, 不合法的行不返回错误, 而是通过report报告后作为未知标签保留,
+	// 供ValidateContent将其作为Issue返回. 参数为从0开始的行索引和错误.
+	report func(i int, err error)
+}
+
+// parse 解析播放列表, 相对地址按m3u8Url解析
+func parse(content []byte, m3u8Url string, cfg parseConfig) (*M3u8, error) {
 	urlStruct, err := url.Parse(m3u8Url)
 	if err != nil {
 		return nil, fmt.Errorf("m3u8 url illegal, %w", err)
@@ -89,6 +244,14 @@ func Parse(content []byte, m3u8Url string) (*M3u8, error) {
 	if !urlStruct.IsAbs() {
 		return nil, fmt.Errorf("m3u8 url %s is not absolute url", m3u8Url)
 	}
+	query := urlStruct.Query()
+	if cfg.queryUrl != "" {
+		u, err := url.Parse(cfg.queryUrl)
+		if err != nil {
+			return nil, fmt.Errorf("playlist url illegal, %w", err)
+		}
+		query = u.Query()
+	}
 
 	var lines []string
 	sc := bufio.NewScanner(bytes.NewReader(content))
@@ -101,28 +264,60 @@ func Parse(content []byte, m3u8Url string) (*M3u8, error) {
 	}
 
 	var (
-		ret         = &M3u8{}
-		encryptMeta EncryptMeta
-		seq         int64
-		duration    time.Duration
+		ret           = &M3u8{}
+		encryptMeta   EncryptMeta
+		keyTagRun     bool // 上一个分片之后是否已经出现过EXT-X-KEY
+		seq           int64
+		skipped       int64 // EXT-X-SKIP跳过的分片数, 之后的分片的媒体序列号从seq+skipped开始
+		duration      time.Duration
+		discontinuity bool
+		pdt           time.Time
+		byteRange     *ByteRange
+		lastRange     *ByteRange // 上一个分片的子区间, 用于计算省略了偏移的EXT-X-BYTERANGE
+		lastRangeUrl  string
+		segMap        *Map
+		title         string
+		unknownTags   []string
 	)
 
-	for i := 1; i < len(lines); i++ {
-		line := util.TrimWhite(lines[i])
+	var i int
+	// ignore 将值不合法的标签作为未知标签保留, 并通过report报告
+	ignore := func(line string) {
+		if cfg.report != nil {
+			cfg.report(i, fmt.Errorf("line:%d, %s is illegal", i, line))
+		}
+		unknownTags = append(unknownTags, line)
+	}
+	// parseLine 解析第i行, EXT-X-STREAM-INF会继续读取下一行的地址并移动i
+	parseLine := func(line string) error {
 		switch {
 		case line == "":
 		case !strings.HasPrefix(line, "#"):
 			u, err := toUrl(line, urlStruct)
 			if err != nil {
-				return nil, fmt.Errorf("line:%d, ts file url %s is illegal, %w", i, line, err)
+				return fmt.Errorf("line:%d, ts file url %s is illegal, %w", i, line, err)
+			}
+			if byteRange != nil && byteRange.Offset < 0 {
+				if lastRange == nil || lastRangeUrl != u {
+					return fmt.Errorf("line:%d, EXT-X-BYTERANGE without offset but previous segment is not a sub-range of %s", i, u)
+				}
+				byteRange.Offset = lastRange.Offset + lastRange.Length
 			}
 			ret.Segments = append(ret.Segments, Segment{
-				Idx:         len(ret.Segments),
-				Url:         u,
-				Duration:    duration,
-				Sequence:    seq + int64(len(ret.Segments)),
-				EncryptMeta: encryptMeta,
+				Idx:             len(ret.Segments),
+				Url:             u,
+				Duration:        duration,
+				Sequence:        seq + skipped + int64(len(ret.Segments)),
+				EncryptMeta:     encryptMeta,
+				Discontinuity:   discontinuity,
+				ProgramDateTime: pdt,
+				ByteRange:       byteRange,
+				Map:             segMap,
+				Title:           title,
+				UnknownTags:     unknownTags,
 			})
+			lastRange, lastRangeUrl, keyTagRun = byteRange, u, false
+			discontinuity, pdt, byteRange, title, unknownTags = false, time.Time{}, nil, "", nil
 		case !strings.HasPrefix(line, "#EXT"):
 		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
 			play := PlayInfo{}
@@ -130,135 +325,447 @@ func Parse(content []byte, m3u8Url string) (*M3u8, error) {
 			if v, ok := params["PROGRAM-ID"]; ok {
 				pid, err := strconv.ParseInt(v, 10, 64)
 				if err != nil {
-					return nil, fmt.Errorf("line:%d, PROGRAM-ID %s is not a number, %w", i, v, err)
+					return fmt.Errorf("line:%d, PROGRAM-ID %s is not a number, %w", i, v, err)
 				}
 				play.ProgramId = pid
 			}
 			if v, ok := params["BANDWIDTH"]; ok {
 				bandWidth, err := strconv.ParseInt(v, 10, 64)
 				if err != nil {
-					return nil, fmt.Errorf("line:%d, BANDWIDTH %s is not a number, %w", i, v, err)
+					return fmt.Errorf("line:%d, BANDWIDTH %s is not a number, %w", i, v, err)
 				}
 				play.BandWidth = bandWidth
 			}
+			if v, ok := params["AVERAGE-BANDWIDTH"]; ok {
+				bandWidth, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return fmt.Errorf("line:%d, AVERAGE-BANDWIDTH %s is not a number, %w", i, v, err)
+				}
+				play.AverageBandWidth = bandWidth
+			}
 			if v, ok := params["RESOLUTION"]; ok {
 				arr := strings.Split(v, "x")
 				if len(arr) != 2 {
-					return nil, fmt.Errorf("line:%d, RESOLUTION %s is illegal", i, v)
+					return fmt.Errorf("line:%d, RESOLUTION %s is illegal", i, v)
 				}
 				width, err := strconv.ParseInt(arr[0], 10, 64)
 				if err != nil {
-					return nil, fmt.Errorf("line:%d, RESOLUTION %s is illegal, %w", i, v, err)
+					return fmt.Errorf("line:%d, RESOLUTION %s is illegal, %w", i, v, err)
 				}
 				high, err := strconv.ParseInt(arr[1], 10, 64)
 				if err != nil {
-					return nil, fmt.Errorf("line:%d, RESOLUTION %s is illegal, %w", i, v, err)
+					return fmt.Errorf("line:%d, RESOLUTION %s is illegal, %w", i, v, err)
 				}
 				play.Resolution.Width = width
 				play.Resolution.High = high
 			}
+			if v, ok := params["FRAME-RATE"]; ok {
+				frameRate, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return fmt.Errorf("line:%d, FRAME-RATE %s is not a number, %w", i, v, err)
+				}
+				play.FrameRate = frameRate
+			}
+			play.Codecs = params["CODECS"]
+			play.HdcpLevel = params["HDCP-LEVEL"]
+			play.VideoRange = params["VIDEO-RANGE"]
+			play.Audio = params["AUDIO"]
+			play.Video = params["VIDEO"]
+			play.Subtitles = params["SUBTITLES"]
+			play.ClosedCaptions = params["CLOSED-CAPTIONS"]
 
 			i++
-			line = util.TrimWhite(lines[i])
+			if i >= len(lines) {
+				return fmt.Errorf("line:%d, EXT-X-STREAM-INF is not followed by uri", i-1)
+			}
+			if line, err = substitute(util.TrimWhite(lines[i]), ret.Variables); err != nil {
+				return fmt.Errorf("line:%d, %w", i, err)
+			}
 			u, err := toUrl(line, urlStruct)
 			if err != nil {
-				return nil, fmt.Errorf("line:%d, sub m3u8 url %s is illegal, %w", i, line, err)
+				return fmt.Errorf("line:%d, sub m3u8 url %s is illegal, %w", i, line, err)
 			}
 			play.M3u8Url = u
 			ret.MastPlayList = append(ret.MastPlayList, play)
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			params := toParam(line)
+			media := Media{
+				Type:            params["TYPE"],
+				GroupId:         params["GROUP-ID"],
+				Language:        params["LANGUAGE"],
+				AssocLanguage:   params["ASSOC-LANGUAGE"],
+				Name:            params["NAME"],
+				Default:         params["DEFAULT"] == "YES",
+				AutoSelect:      params["AUTOSELECT"] == "YES",
+				Forced:          params["FORCED"] == "YES",
+				InstreamId:      params["INSTREAM-ID"],
+				Characteristics: params["CHARACTERISTICS"],
+				Channels:        params["CHANNELS"],
+			}
+			switch media.Type {
+			case MediaTypeAudio, MediaTypeVideo, MediaTypeSubtitles, MediaTypeClosedCaptions:
+			default:
+				return fmt.Errorf("line:%d, EXT-X-MEDIA TYPE %s is illegal", i, media.Type)
+			}
+			if media.GroupId == "" || media.Name == "" {
+				return fmt.Errorf("line:%d, EXT-X-MEDIA %s has no GROUP-ID or NAME", i, line)
+			}
+			if v, ok := params["URI"]; ok {
+				u, err := toUrl(v, urlStruct)
+				if err != nil {
+					return fmt.Errorf("line:%d, URI %s is illegal, %w", i, v, err)
+				}
+				media.Url = u
+			}
+			ret.MediaList = append(ret.MediaList, media)
 		case strings.HasPrefix(line, "#EXT-X-KEY"):
-			encryptMeta = EncryptMeta{}
+			meta := EncryptMeta{}
 			params := toParam(line)
 			if v, ok := params["METHOD"]; ok {
-				if v != CryptMethodAES && v != CryptMethodNONE {
-					return nil, fmt.Errorf("line:%d, unknown encrypt method %s", i, v)
+				switch v {
+				case CryptMethodAES, CryptMethodSampleAES, CryptMethodSampleAESCTR, CryptMethodNONE:
+				default:
+					return fmt.Errorf("line:%d, unknown encrypt method %s", i, v)
 				}
-				encryptMeta.Method = v
+				meta.Method = v
 			}
 			if v, ok := params["URI"]; ok {
 				u, err := toUrl(v, urlStruct)
 				if err != nil {
-					return nil, fmt.Errorf("line:%d, URI %s is illegal, %w", i, v, err)
+					return fmt.Errorf("line:%d, URI %s is illegal, %w", i, v, err)
 				}
-				encryptMeta.SecretKeyUrl = u
+				meta.SecretKeyUrl = u
 			}
 			if v, ok := params["IV"]; ok {
-				encryptMeta.IV = v
+				if _, err := decodeIV(v); err != nil {
+					return fmt.Errorf("line:%d, IV %s is illegal, %w", i, v, err)
+				}
+				meta.IV = v
 			}
-		case strings.HasPrefix(line, "#EXT-X-PLAYLIST-TYPE"):
-			pos := strings.Index(line, ":")
-			if pos < 0 {
-				return nil, fmt.Errorf("line:%d, EXT-X-PLAYLIST-TYPE %s is illegal", i, line)
+			meta.KeyFormat = params["KEYFORMAT"]
+			meta.KeyFormatVersions = params["KEYFORMATVERSIONS"]
+			// 同一分片可以有多个不同KEYFORMAT的EXT-X-KEY, 优先使用identity格式的密钥
+			if !keyTagRun || !encryptMeta.IsClearKey() || meta.IsClearKey() {
+				encryptMeta = meta
 			}
-			line = line[pos+1:]
-			if line != "VOD" && line != "EVENT" {
-				return nil, fmt.Errorf("line:%d, EXT-X-PLAYLIST-TYPE %s is illegal", i, line)
+			keyTagRun = true
+		case strings.HasPrefix(line, "#EXT-X-MAP"):
+			params := toParam(line)
+			v, ok := params["URI"]
+			if !ok {
+				return fmt.Errorf("line:%d, EXT-X-MAP %s has no URI", i, line)
+			}
+			u, err := toUrl(v, urlStruct)
+			if err != nil {
+				return fmt.Errorf("line:%d, URI %s is illegal, %w", i, v, err)
+			}
+			segMap = &Map{Url: u}
+			if v, ok := params["BYTERANGE"]; ok {
+				if segMap.ByteRange, err = parseByteRange(v); err != nil {
+					return fmt.Errorf("line:%d, BYTERANGE %s is illegal, %w", i, v, err)
+				}
+				if segMap.ByteRange.Offset < 0 {
+					segMap.ByteRange.Offset = 0
+				}
+			}
+		case strings.HasPrefix(line, "#EXT-X-PLAYLIST-TYPE"):
+			v, ok := tagValue(line)
+			if !ok || (v != "VOD" && v != "EVENT") {
+				return fmt.Errorf("line:%d, EXT-X-PLAYLIST-TYPE %s is illegal", i, line)
 			}
-			ret.PlayListType = line
+			ret.PlayListType = v
 		case strings.HasPrefix(line, "#EXTINF"):
-			pos := strings.Index(line, ":")
-			if pos < 0 {
-				return nil, fmt.Errorf("line:%d, EXTINF %s is illegal", i, line)
+			v, ok := tagValue(line)
+			if !ok {
+				return fmt.Errorf("line:%d, EXTINF %s is illegal", i, line)
 			}
-			line = line[pos+1:]
-			pos = strings.Index(line, ",")
-			if pos >= 0 {
-				line = line[:pos]
+			title = ""
+			if pos := strings.Index(v, ","); pos >= 0 {
+				v, title = v[:pos], v[pos+1:]
 			}
-			d, err := strconv.ParseFloat(line, 64)
+			d, err := strconv.ParseFloat(v, 64)
 			if err != nil {
-				return nil, fmt.Errorf("line:%d, EXTINF %s is illegal, %w", i, line, err)
+				return fmt.Errorf("line:%d, EXTINF %s is illegal, %w", i, v, err)
 			}
 			duration = time.Duration(d * float64(time.Second))
+		// 以下标签的值不合法时不影响下载, 按未指定处理并将标签作为未知标签保留, 由Validate报告
 		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE"):
-			pos := strings.Index(line, ":")
-			if pos < 0 {
-				return nil, fmt.Errorf("line:%d, EXT-X-MEDIA-SEQUENCE %s is illegal", i, line)
+			v, _ := tagValue(line)
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				seq, ret.MediaSequence = n, n
+			} else {
+				ignore(line)
 			}
-			line = line[pos+1:]
-			seq, err = strconv.ParseInt(line, 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION"):
+			// 部分CDN输出小数形式的目标时长
+			v, _ := tagValue(line)
+			if d, err := parseSeconds(v); err == nil {
+				ret.TargetDuration = d
+			} else {
+				ignore(line)
+			}
+		case strings.HasPrefix(line, "#EXT-X-VERSION"):
+			v, _ := tagValue(line)
+			if ver, err := strconv.Atoi(v); err == nil {
+				ret.Version = ver
+			} else {
+				ignore(line)
+			}
+		case strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE"):
+			v, _ := tagValue(line)
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				ret.DiscontinuitySequence = n
+			} else {
+				ignore(line)
+			}
+		case strings.HasPrefix(line, "#EXT-X-DISCONTINUITY"):
+			if line != "#EXT-X-DISCONTINUITY" {
+				return fmt.Errorf("line:%d, EXT-X-DISCONTINUITY %s is illegal", i, line)
+			}
+			discontinuity = true
+		case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME"):
+			v, _ := tagValue(line)
+			if t, err := parseDateTime(v); err == nil {
+				pdt = t
+			} else {
+				ignore(line)
+			}
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE"):
+			v, ok := tagValue(line)
+			if !ok {
+				return fmt.Errorf("line:%d, EXT-X-BYTERANGE %s is illegal", i, line)
+			}
+			if byteRange, err = parseByteRange(v); err != nil {
+				return fmt.Errorf("line:%d, EXT-X-BYTERANGE %s is illegal, %w", i, v, err)
+			}
+		case strings.HasPrefix(line, "#EXT-X-INDEPENDENT-SEGMENTS"):
+			ret.IndependentSegments = true
+		case strings.HasPrefix(line, "#EXT-X-I-FRAMES-ONLY"):
+			ret.IFramesOnly = true
+		case strings.HasPrefix(line, "#EXT-X-START"):
+			params := toParam(line)
+			offset, err := strconv.ParseFloat(params["TIME-OFFSET"], 64)
 			if err != nil {
-				return nil, fmt.Errorf("line:%d, EXT-X-MEDIA-SEQUENCE %s is illegal", i, line)
+				ignore(line)
+				break
+			}
+			ret.Start = &Start{
+				TimeOffset: offset,
+				Precise:    params["PRECISE"] == "YES",
+			}
+		case strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:"):
+			params := toParam(line)
+			sc := &ServerControl{
+				CanSkipDateRanges: params["CAN-SKIP-DATERANGES"] == "YES",
+			}
+			for name, d := range map[string]*time.Duration{
+				"CAN-SKIP-UNTIL": &sc.CanSkipUntil,
+				"HOLD-BACK":      &sc.HoldBack,
+			} {
+				if v, ok := params[name]; ok {
+					if *d, err = parseSeconds(v); err != nil {
+						return fmt.Errorf("line:%d, %s %s is illegal, %w", i, name, v, err)
+					}
+				}
+			}
+			ret.ServerControl = sc
+		case strings.HasPrefix(line, "#EXT-X-DEFINE:"):
+			name, value, err := define(toParam(line), query, cfg.imports)
+			if err != nil {
+				return fmt.Errorf("line:%d, %w", i, err)
+			}
+			if _, ok := ret.Variables[name]; ok {
+				return fmt.Errorf("line:%d, variable %s is defined more than once", i, name)
+			}
+			if ret.Variables == nil {
+				ret.Variables = make(map[string]string)
+			}
+			ret.Variables[name] = value
+		case strings.HasPrefix(line, "#EXT-X-SKIP:"):
+			if len(ret.Segments) > 0 || ret.Skip != nil {
+				return fmt.Errorf("line:%d, EXT-X-SKIP must appear once before all segments", i)
+			}
+			params := toParam(line)
+			v, ok := params["SKIPPED-SEGMENTS"]
+			if !ok {
+				return fmt.Errorf("line:%d, EXT-X-SKIP %s has no SKIPPED-SEGMENTS", i, line)
+			}
+			if skipped, err = strconv.ParseInt(v, 10, 64); err != nil || skipped < 0 {
+				return fmt.Errorf("line:%d, SKIPPED-SEGMENTS %s is illegal", i, v)
+			}
+			ret.Skip = &Skip{SkippedSegments: skipped}
+			if v = params["RECENTLY-REMOVED-DATERANGES"]; v != "" {
+				ret.Skip.RecentlyRemovedDateRanges = strings.Split(v, "\t")
 			}
 		case strings.HasPrefix(line, "#EXT-X-ENDLIST"):
 			if line != "#EXT-X-ENDLIST" {
-				return nil, fmt.Errorf("line:%d, EXT-X-ENDLIST %s is illegal", i, line)
+				return fmt.Errorf("line:%d, EXT-X-ENDLIST %s is illegal", i, line)
 			}
 			ret.EndList = true
+		default:
+			unknownTags = append(unknownTags, line)
 		}
+		return nil
 	}
+
+	for i = 1; i < len(lines); i++ {
+		raw := util.TrimWhite(lines[i])
+		line, err := raw, error(nil)
+		// 变量引用只在地址和已知标签的quoted-string属性值中替换, 未知标签和EXT-X-DEFINE原样保留
+		switch {
+		case raw != "" && !strings.HasPrefix(raw, "#"):
+			line, err = substitute(raw, ret.Variables)
+		case hasVariableAttrs(raw):
+			line, err = substituteQuoted(raw, ret.Variables)
+		}
+		if err != nil {
+			err = fmt.Errorf("line:%d, %w", i, err)
+		} else {
+			err = parseLine(line)
+		}
+		if err != nil {
+			if cfg.report == nil {
+				return nil, err
+			}
+			// 宽松模式下出错的行作为未知标签保留, 继续解析之后的行
+			cfg.report(i, err)
+			unknownTags = append(unknownTags, raw)
+		}
+	}
+	ret.UnknownTags = unknownTags
 	return ret, nil
 }
 
-func toParam(l string) map[string]string {
-	r := attrReg.FindAllStringSubmatch(l, -1)
-	ret := make(map[string]string)
-	for _, v := range r {
-		ret[v[1]] = strings.Trim(v[2], "\"")
+// define 解析EXT-X-DEFINE的属性, 返回定义的变量名和值.
+// 变量的值由VALUE指定, 或者通过IMPORT从主播放列表导入, 或者通过QUERYPARAM取播放列表地址中的查询参数.
+func define(params map[string]string, query url.Values, imports map[string]string) (name, value string, err error) {
+	var ok bool
+	switch {
+	case params["NAME"] != "":
+		name = params["NAME"]
+		if value, ok = params["VALUE"]; !ok {
+			return "", "", fmt.Errorf("EXT-X-DEFINE NAME=%s has no VALUE", name)
+		}
+	case params["IMPORT"] != "":
+		name = params["IMPORT"]
+		if value, ok = imports[name]; !ok {
+			return "", "", fmt.Errorf("imported variable %s is not defined in master playlist", name)
+		}
+	case params["QUERYPARAM"] != "":
+		name = params["QUERYPARAM"]
+		if !query.Has(name) {
+			return "", "", fmt.Errorf("query parameter %s is not in playlist url", name)
+		}
+		value = query.Get(name)
+	default:
+		return "", "", errors.New("EXT-X-DEFINE has no NAME, IMPORT or QUERYPARAM")
 	}
-	return ret
+	if !varNameReg.MatchString(name) {
+		return "", "", fmt.Errorf("variable name %s is illegal", name)
+	}
+	return name, value, nil
+}
+
+// variableAttrTags 属性值中的变量引用会被替换的标签
+var variableAttrTags = []string{
+	"#EXT-X-STREAM-INF:", "#EXT-X-MEDIA:", "#EXT-X-KEY:", "#EXT-X-MAP:",
+	"#EXT-X-START:", "#EXT-X-SERVER-CONTROL:", "#EXT-X-SKIP:",
 }
 
-func toUrl(uri string, m3u8UrlStruct *url.URL) (ret string, err error) {
-	defer func() {
-		if _, err = url.Parse(uri); err != nil {
-			err = fmt.Errorf("uri %s is illegal, %w", uri, err)
-			return
+func hasVariableAttrs(line string) bool {
+	for _, v := range variableAttrTags {
+		if strings.HasPrefix(line, v) {
+			return true
 		}
-	}()
+	}
+	return false
+}
+
+// substituteQuoted 只替换标签中quoted-string属性值里的变量引用
+func substituteQuoted(line string, vars map[string]string) (string, error) {
+	var err error
+	ret := quotedReg.ReplaceAllStringFunc(line, func(v string) string {
+		s, e := substitute(v, vars)
+		if e != nil && err == nil {
+			err = e
+		}
+		return s
+	})
+	return ret, err
+}
+
+// substitute 将line中的变量引用{$name}替换为变量的值, 引用了未定义的变量时返回错误
+func substitute(line string, vars map[string]string) (string, error) {
+	if !strings.Contains(line, "{$") {
+		return line, nil
+	}
+	var err error
+	ret := varRefReg.ReplaceAllStringFunc(line, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		v, ok := vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("variable %s is not defined", name)
+		}
+		return v
+	})
+	return ret, err
+}
 
-	if strings.HasPrefix(uri, "https://") || strings.HasPrefix(uri, "http://") {
-		return uri, nil
+// parseSeconds 解析以秒为单位的浮点数
+func parseSeconds(v string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%s is not a non-negative number", v)
 	}
+	return time.Duration(f * float64(time.Second)), nil
+}
 
-	m3u8Url := m3u8UrlStruct.String()
-	if uri[0] == '/' {
-		return m3u8UrlStruct.Scheme + "://" + m3u8UrlStruct.Host + uri, nil
+// tagValue 返回形如#TAG:value的标签中冒号之后的部分
+func tagValue(line string) (string, bool) {
+	pos := strings.Index(line, ":")
+	if pos < 0 {
+		return "", false
 	}
+	return line[pos+1:], true
+}
 
-	if m3u8UrlStruct.Path == "" {
-		return m3u8UrlStruct.Host + "/" + uri, nil
+// parseByteRange 解析形如n[@o]的子区间, 省略偏移时Offset为-1
+func parseByteRange(v string) (*ByteRange, error) {
+	ret := &ByteRange{Offset: -1}
+	length := v
+	if pos := strings.Index(v, "@"); pos >= 0 {
+		length = v[:pos]
+		offset, err := strconv.ParseInt(v[pos+1:], 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("offset %s is illegal", v[pos+1:])
+		}
+		ret.Offset = offset
 	}
+	n, err := strconv.ParseInt(length, 10, 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("length %s is illegal", length)
+	}
+	ret.Length = n
+	return ret, nil
+}
 
-	return m3u8Url[0:strings.LastIndex(m3u8Url, "/")] + "/" + uri, nil
+// parseDateTime 解析ISO 8601格式的时间, 兼容时区中不带冒号的写法
+func parseDateTime(v string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err == nil {
+		return t, nil
+	}
+	if t, e := time.Parse("2006-01-02T15:04:05.999999999Z0700", v); e == nil {
+		return t, nil
+	}
+	return time.Time{}, err
+}
+
+func toParam(l string) map[string]string {
+	r := attrReg.FindAllStringSubmatch(l, -1)
+	ret := make(map[string]string)
+	for _, v := range r {
+		ret[v[1]] = strings.Trim(v[2], "\"")
+	}
+	return ret
 }
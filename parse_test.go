@@ -2,7 +2,9 @@ package m3u8
 
 import (
 	"github.com/gogokit/tostr"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -23,7 +25,7 @@ http://example.com/high/index.m3u8
 http://example.com/audio/index.m3u8`
 			m3u8, err := Parse([]byte(m3u8Content), "http://example.com/")
 			So(err, ShouldEqual, nil)
-			So(tostr.String(m3u8), ShouldEqual, `{Segments:nil, MastPlayList:[{M3u8Url:"http://example.com/low/index.m3u8", ProgramId:0, BandWidth:150000, Resolution:{Width:416, High:234}}, {M3u8Url:"https://example.com/lo_mid/index.m3u8", ProgramId:0, BandWidth:240000, Resolution:{Width:416, High:234}}, {M3u8Url:"http://example.com/hi_mid/index.m3u8", ProgramId:0, BandWidth:440000, Resolution:{Width:416, High:234}}, {M3u8Url:"http://example.com/high/index.m3u8", ProgramId:0, BandWidth:640000, Resolution:{Width:640, High:360}}, {M3u8Url:"http://example.com/audio/index.m3u8", ProgramId:0, BandWidth:64000, Resolution:{Width:0, High:0}}], PlayListType:"", EndList:false}`)
+			So(tostr.String(m3u8), ShouldEqual, `{Segments:nil, MastPlayList:[{M3u8Url:"http://example.com/low/index.m3u8", ProgramId:0, BandWidth:150000, AverageBandWidth:0, Resolution:{Width:416, High:234}, Codecs:"avc1.42e00a,mp4a.40.2", FrameRate:0, HdcpLevel:"", VideoRange:"", Audio:"", Video:"", Subtitles:"", ClosedCaptions:""}, {M3u8Url:"https://example.com/lo_mid/index.m3u8", ProgramId:0, BandWidth:240000, AverageBandWidth:0, Resolution:{Width:416, High:234}, Codecs:"avc1.42e00a,mp4a.40.2", FrameRate:0, HdcpLevel:"", VideoRange:"", Audio:"", Video:"", Subtitles:"", ClosedCaptions:""}, {M3u8Url:"http://example.com/hi_mid/index.m3u8", ProgramId:0, BandWidth:440000, AverageBandWidth:0, Resolution:{Width:416, High:234}, Codecs:"avc1.42e00a,mp4a.40.2", FrameRate:0, HdcpLevel:"", VideoRange:"", Audio:"", Video:"", Subtitles:"", ClosedCaptions:""}, {M3u8Url:"http://example.com/high/index.m3u8", ProgramId:0, BandWidth:640000, AverageBandWidth:0, Resolution:{Width:640, High:360}, Codecs:"avc1.42e00a,mp4a.40.2", FrameRate:0, HdcpLevel:"", VideoRange:"", Audio:"", Video:"", Subtitles:"", ClosedCaptions:""}, {M3u8Url:"http://example.com/audio/index.m3u8", ProgramId:0, BandWidth:64000, AverageBandWidth:0, Resolution:{Width:0, High:0}, Codecs:"mp4a.40.5", FrameRate:0, HdcpLevel:"", VideoRange:"", Audio:"", Video:"", Subtitles:"", ClosedCaptions:""}], MediaList:nil, PlayListType:"", EndList:false, TargetDuration:0, Version:0, MediaSequence:0, DiscontinuitySequence:0, IndependentSegments:false, IFramesOnly:false, Start:nil, ServerControl:nil, Skip:nil, Variables:nil, UnknownTags:nil}`)
 		})
 
 		Convey("Meida Playlist", func() {
@@ -43,7 +45,224 @@ http://example.com/20201008/ojroOJOt/1000kb/hls/uqvfZRwE.ts
 `
 			m3u8, err := Parse([]byte(m3u8Content), "http://example.com/")
 			So(err, ShouldEqual, nil)
-			So(tostr.String(m3u8), ShouldEqual, `{Segments:[{Idx:0, Url:"http://example.com/20201008/ojroOJOt/1000kb/hls/nfTcXY3x.ts", Duration:3000000000, Sequence:250, EncryptMeta:{SecretKeyUrl:"http://example.com/20201008/ojroOJOt/1000kb/hls/key.key", IV:"", Method:"AES-128", SecretKey:""}, ErrMsg:""}, {Idx:1, Url:"http://example.com/20201008/ojroOJOt/1000kb/hls/VtMpEYqz.ts", Duration:1520000000, Sequence:251, EncryptMeta:{SecretKeyUrl:"http://example.com/20201008/ojroOJOt/1000kb/hls/key.key", IV:"", Method:"AES-128", SecretKey:""}, ErrMsg:""}, {Idx:2, Url:"http://example.com/20201008/ojroOJOt/1000kb/hls/uqvfZRwE.ts", Duration:3000000000, Sequence:252, EncryptMeta:{SecretKeyUrl:"http://example.com/20201008/ojroOJOt/1000kb/hls/key.key", IV:"", Method:"AES-128", SecretKey:""}, ErrMsg:""}], MastPlayList:nil, PlayListType:"VOD", EndList:true}`)
+			So(tostr.String(m3u8), ShouldEqual, `{Segments:[{Idx:0, Url:"http://example.com/20201008/ojroOJOt/1000kb/hls/nfTcXY3x.ts", Duration:3000000000, Sequence:250, EncryptMeta:{SecretKeyUrl:"http://example.com/20201008/ojroOJOt/1000kb/hls/key.key", IV:"", Method:"AES-128", KeyFormat:"", KeyFormatVersions:"", SecretKey:""}, Discontinuity:false, ProgramDateTime:{time.Time:"0001-01-01 00:00:00.000"}, ByteRange:nil, Map:nil, Title:"", UnknownTags:nil, ErrMsg:""}, {Idx:1, Url:"http://example.com/20201008/ojroOJOt/1000kb/hls/VtMpEYqz.ts", Duration:1520000000, Sequence:251, EncryptMeta:{SecretKeyUrl:"http://example.com/20201008/ojroOJOt/1000kb/hls/key.key", IV:"", Method:"AES-128", KeyFormat:"", KeyFormatVersions:"", SecretKey:""}, Discontinuity:false, ProgramDateTime:{time.Time:"0001-01-01 00:00:00.000"}, ByteRange:nil, Map:nil, Title:"", UnknownTags:nil, ErrMsg:""}, {Idx:2, Url:"http://example.com/20201008/ojroOJOt/1000kb/hls/uqvfZRwE.ts", Duration:3000000000, Sequence:252, EncryptMeta:{SecretKeyUrl:"http://example.com/20201008/ojroOJOt/1000kb/hls/key.key", IV:"", Method:"AES-128", KeyFormat:"", KeyFormatVersions:"", SecretKey:""}, Discontinuity:false, ProgramDateTime:{time.Time:"0001-01-01 00:00:00.000"}, ByteRange:nil, Map:nil, Title:"", UnknownTags:nil, ErrMsg:""}], MastPlayList:nil, MediaList:nil, PlayListType:"VOD", EndList:true, TargetDuration:6000000000, Version:3, MediaSequence:250, DiscontinuitySequence:0, IndependentSegments:false, IFramesOnly:false, Start:nil, ServerControl:nil, Skip:nil, Variables:nil, UnknownTags:nil}`)
+		})
+
+		Convey("RFC 8216 Tags", func() {
+			const masterContent = `#EXTM3U
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,AVERAGE-BANDWIDTH=1000000,RESOLUTION=1280x720,FRAME-RATE=29.970,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aac",SUBTITLES="subs",CLOSED-CAPTIONS=NONE,HDCP-LEVEL=TYPE-0,VIDEO-RANGE=SDR
+720p.m3u8`
+			master, err := Parse([]byte(masterContent), "http://example.com/live/master.m3u8")
+			So(err, ShouldEqual, nil)
+			So(master.IndependentSegments, ShouldBeTrue)
+			So(master.MastPlayList, ShouldResemble, []PlayInfo{{
+				M3u8Url:          "http://example.com/live/720p.m3u8",
+				BandWidth:        1280000,
+				AverageBandWidth: 1000000,
+				Resolution:       Resolution{Width: 1280, High: 720},
+				Codecs:           "avc1.4d401f,mp4a.40.2",
+				FrameRate:        29.97,
+				HdcpLevel:        "TYPE-0",
+				VideoRange:       "SDR",
+				Audio:            "aac",
+				Subtitles:        "subs",
+				ClosedCaptions:   "NONE",
+			}})
+
+			const mediaContent = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-DISCONTINUITY-SEQUENCE:2
+#EXT-X-I-FRAMES-ONLY
+#EXT-X-START:TIME-OFFSET=-12.5,PRECISE=YES
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXT-X-PROGRAM-DATE-TIME:2021-01-02T03:04:05.678+08:00
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:1000@720
+media.mp4
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:2000
+media.mp4
+#EXT-X-DISCONTINUITY
+#EXTINF:3.5,
+other.mp4
+#EXT-X-ENDLIST`
+			media, err := Parse([]byte(mediaContent), "http://example.com/live/720p.m3u8")
+			So(err, ShouldEqual, nil)
+			So(media.Version, ShouldEqual, 7)
+			So(media.TargetDuration, ShouldEqual, 4*time.Second)
+			So(media.MediaSequence, ShouldEqual, 10)
+			So(media.DiscontinuitySequence, ShouldEqual, 2)
+			So(media.IFramesOnly, ShouldBeTrue)
+			So(*media.Start, ShouldResemble, Start{TimeOffset: -12.5, Precise: true})
+			So(len(media.Segments), ShouldEqual, 3)
+
+			initMap := &Map{Url: "http://example.com/live/init.mp4", ByteRange: &ByteRange{Length: 720, Offset: 0}}
+			So(media.Segments[0].Map, ShouldResemble, initMap)
+			So(media.Segments[0].ProgramDateTime.Equal(time.Date(2021, 1, 1, 19, 4, 5, 678e6, time.UTC)), ShouldBeTrue)
+			So(*media.Segments[0].ByteRange, ShouldResemble, ByteRange{Length: 1000, Offset: 720})
+			So(*media.Segments[1].ByteRange, ShouldResemble, ByteRange{Length: 2000, Offset: 1720})
+			So(media.Segments[1].ProgramDateTime.IsZero(), ShouldBeTrue)
+			So(media.Segments[1].Discontinuity, ShouldBeFalse)
+			So(media.Segments[2].Discontinuity, ShouldBeTrue)
+			So(media.Segments[2].ByteRange, ShouldEqual, nil)
+			So(media.Segments[2].Map, ShouldResemble, initMap)
+			So(media.IsFMP4(), ShouldBeTrue)
+
+			_, err = Parse([]byte("#EXTM3U\n#EXTINF:4,\n#EXT-X-BYTERANGE:100\na.ts"), "http://example.com/a.m3u8")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("lenient values", func() {
+			const content = `#EXTM3U
+#EXT-X-VERSION:three
+#EXT-X-TARGETDURATION:6.006
+#EXT-X-MEDIA-SEQUENCE:abc
+#EXT-X-DISCONTINUITY-SEQUENCE:
+#EXT-X-START:PRECISE=YES
+#EXT-X-PROGRAM-DATE-TIME:2021-01-02 03:04:05
+#EXTINF:6.006,
+a.ts
+#EXT-X-ENDLIST`
+			m3u8, err := Parse([]byte(content), "http://example.com/index.m3u8")
+			So(err, ShouldEqual, nil)
+			So(m3u8.TargetDuration, ShouldEqual, 6006*time.Millisecond)
+			So(m3u8.Version, ShouldEqual, 0)
+			So(m3u8.MediaSequence, ShouldEqual, 0)
+			So(m3u8.DiscontinuitySequence, ShouldEqual, 0)
+			So(m3u8.Start, ShouldBeNil)
+			So(len(m3u8.Segments), ShouldEqual, 1)
+			So(m3u8.Segments[0].ProgramDateTime.IsZero(), ShouldBeTrue)
+			// 不合法的标签作为未知标签保留
+			So(m3u8.Segments[0].UnknownTags, ShouldResemble, []string{
+				"#EXT-X-VERSION:three",
+				"#EXT-X-MEDIA-SEQUENCE:abc",
+				"#EXT-X-DISCONTINUITY-SEQUENCE:",
+				"#EXT-X-START:PRECISE=YES",
+				"#EXT-X-PROGRAM-DATE-TIME:2021-01-02 03:04:05",
+			})
+			So(string(m3u8.Encode()), ShouldContainSubstring, "#EXT-X-TARGETDURATION:7\n")
+		})
+
+		Convey("EXT-X-SERVER-CONTROL", func() {
+			const content = `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-VERSION:9
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=24,HOLD-BACK=12.5
+#EXT-X-PART-INF:PART-TARGET=1.004
+#EXT-X-MEDIA-SEQUENCE:266
+#EXT-X-PART:DURATION=1.004,URI="266.mp4",INDEPENDENT=YES
+#EXTINF:2.008,
+266.mp4
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="267.0.mp4"`
+			m3u8, err := Parse([]byte(content), "http://example.com/2M/index.m3u8")
+			So(err, ShouldEqual, nil)
+			So(*m3u8.ServerControl, ShouldResemble, ServerControl{
+				CanSkipUntil: 24 * time.Second,
+				HoldBack:     12500 * time.Millisecond,
+			})
+			// LL-HLS的标签不做解析, 作为未知标签保留
+			So(len(m3u8.Segments), ShouldEqual, 1)
+			So(m3u8.Segments[0].UnknownTags, ShouldResemble, []string{"#EXT-X-PART-INF:PART-TARGET=1.004", "#EXT-X-PART:DURATION=1.004,URI=\"266.mp4\",INDEPENDENT=YES"})
+			So(m3u8.UnknownTags, ShouldResemble, []string{"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"267.0.mp4\""})
+
+			_, err = Parse([]byte("#EXTM3U\n#EXT-X-SERVER-CONTROL:CAN-SKIP-UNTIL=abc\n"), "http://example.com/a.m3u8")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("EXT-X-DEFINE", func() {
+			const master = `#EXTM3U
+#EXT-X-DEFINE:NAME="cdn",VALUE="http://cdn.example.com"
+#EXT-X-DEFINE:QUERYPARAM="token"
+#EXT-X-STREAM-INF:BANDWIDTH=100
+{$cdn}/video/index.m3u8?token={$token}`
+			m, err := Parse([]byte(master), "http://example.com/master.m3u8?token=abc")
+			So(err, ShouldEqual, nil)
+			So(m.Variables, ShouldResemble, map[string]string{"cdn": "http://cdn.example.com", "token": "abc"})
+			So(m.MastPlayList[0].M3u8Url, ShouldEqual, "http://cdn.example.com/video/index.m3u8?token=abc")
+
+			const media = `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-DEFINE:IMPORT="token"
+#EXT-X-DEFINE:NAME="key",VALUE="key.bin"
+#EXT-X-KEY:METHOD=AES-128,URI="{$key}?token={$token}"
+#EXTINF:2,{$title}
+a.ts?token={$token}
+#EXT-X-ENDLIST`
+			media1, err := ParseWithImport([]byte(media), "http://cdn.example.com/video/index.m3u8", m.Variables)
+			So(err, ShouldEqual, nil)
+			So(media1.Segments[0].Url, ShouldEqual, "http://cdn.example.com/video/a.ts?token=abc")
+			So(media1.Segments[0].EncryptMeta.SecretKeyUrl, ShouldEqual, "http://cdn.example.com/video/key.bin?token=abc")
+			// EXTINF的标题不做替换
+			So(media1.Segments[0].Title, ShouldEqual, "{$title}")
+
+			// 不是从主播放列表加载时无法导入变量
+			_, err = Parse([]byte(media), "http://cdn.example.com/video/index.m3u8")
+			So(err, ShouldNotEqual, nil)
+			_, err = Parse([]byte("#EXTM3U\n#EXTINF:2,\n{$a}.ts"), "http://example.com/index.m3u8")
+			So(err, ShouldNotEqual, nil)
+			_, err = Parse([]byte(master), "http://example.com/master.m3u8")
+			So(err, ShouldNotEqual, nil)
+			_, err = Parse([]byte("#EXTM3U\n#EXT-X-DEFINE:NAME=\"a\",VALUE=\"1\"\n#EXT-X-DEFINE:NAME=\"a\",VALUE=\"2\""), "http://example.com/index.m3u8")
+			So(err, ShouldNotEqual, nil)
+
+			encoded, err := ParseWithImport(media1.Encode(), "http://cdn.example.com/video/index.m3u8", nil)
+			So(err, ShouldEqual, nil)
+			So(encoded, ShouldResemble, media1)
+
+			// 只替换地址和已知标签的quoted-string属性值, 未知标签原样保留, 其中未定义的变量也不报错
+			const tags = `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-DEFINE:NAME="n",VALUE="1"
+#EXT-X-MAP:URI="init{$n}.mp4",BYTERANGE=10@{$n}
+#EXT-X-DATERANGE:ID="{$n}",START-DATE="2020-01-01T00:00:00Z",X-REF="{$undefined}"
+#EXTINF:2,
+{$n}.m4s`
+			_, err = Parse([]byte(tags), "http://example.com/index.m3u8")
+			So(err, ShouldNotEqual, nil)
+			m, err = Parse([]byte(strings.Replace(tags, "10@{$n}", "10@0", 1)), "http://example.com/index.m3u8")
+			So(err, ShouldEqual, nil)
+			So(m.Segments[0].Map.Url, ShouldEqual, "http://example.com/init1.mp4")
+			So(m.Segments[0].Url, ShouldEqual, "http://example.com/1.m4s")
+			So(m.Segments[0].UnknownTags, ShouldResemble, []string{`#EXT-X-DATERANGE:ID="{$n}",START-DATE="2020-01-01T00:00:00Z",X-REF="{$undefined}"`})
+
+			// QUERYPARAM取实际获取播放列表的地址中的查询参数, 相对地址仍按m3u8Url解析
+			m, err = parse([]byte(master), "http://base.example.com/master.m3u8", parseConfig{queryUrl: "http://example.com/master.m3u8?token=def"})
+			So(err, ShouldEqual, nil)
+			So(m.Variables["token"], ShouldEqual, "def")
+		})
+
+		Convey("SAMPLE-AES", func() {
+			const content = `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://fairplay",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key.bin",IV=0x000102030405060708090a0b0c0d0e0f,KEYFORMAT="identity"
+#EXTINF:4.0,
+a.ts
+#EXT-X-KEY:METHOD=SAMPLE-AES-CTR,URI="skd://fairplay",KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"
+#EXTINF:4.0,
+b.ts
+#EXT-X-ENDLIST`
+			m3u8, err := Parse([]byte(content), "http://example.com/live/index.m3u8")
+			So(err, ShouldEqual, nil)
+			So(m3u8.Segments[0].IsEncrypted(), ShouldBeTrue)
+			So(m3u8.Segments[0].EncryptMeta, ShouldResemble, EncryptMeta{
+				SecretKeyUrl: "http://example.com/live/key.bin",
+				IV:           "0x000102030405060708090a0b0c0d0e0f",
+				Method:       CryptMethodSampleAES,
+				KeyFormat:    KeyFormatIdentity,
+			})
+			So(m3u8.Segments[1].EncryptMeta.Method, ShouldEqual, CryptMethodSampleAESCTR)
+			So(m3u8.Segments[1].EncryptMeta.IsClearKey(), ShouldBeFalse)
+			So(m3u8.Segments[1].EncryptMeta.KeyFormatVersions, ShouldEqual, "1")
+			md := &m3u8Downloader{}
+			So(md.unsupportedEncryption(m3u8.Segments[0].EncryptMeta), ShouldEqual, nil)
+			So(md.unsupportedEncryption(m3u8.Segments[1].EncryptMeta), ShouldNotEqual, nil)
+
+			_, err = Parse([]byte("#EXTM3U\n#EXT-X-KEY:METHOD=AES-256\n#EXTINF:4,\na.ts"), "http://example.com/a.m3u8")
+			So(err, ShouldNotEqual, nil)
 		})
 	})
 }
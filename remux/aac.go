@@ -0,0 +1,56 @@
+package remux
+
+import (
+	"errors"
+	"fmt"
+)
+
+const aacSamplesPerFrame = 1024
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+type adtsHeader struct {
+	objectType    byte // MPEG-4 Audio Object Type, 即profile+1
+	freqIdx       byte
+	channelConfig byte
+	headerLen     int
+	frameLen      int // 包含头部
+}
+
+func (h adtsHeader) sampleRate() int {
+	return aacSampleRates[h.freqIdx]
+}
+
+// audioSpecificConfig 生成esds中的AudioSpecificConfig
+func (h adtsHeader) audioSpecificConfig() []byte {
+	return []byte{
+		h.objectType<<3 | h.freqIdx>>1,
+		h.freqIdx<<7 | h.channelConfig<<3,
+	}
+}
+
+func parseADTS(b []byte) (adtsHeader, error) {
+	if len(b) < 7 {
+		return adtsHeader{}, errors.New("adts header too short")
+	}
+	if b[0] != 0xFF || b[1]&0xF6 != 0xF0 {
+		return adtsHeader{}, errors.New("adts sync word not found")
+	}
+	h := adtsHeader{
+		objectType:    (b[2]>>6)&3 + 1,
+		freqIdx:       (b[2] >> 2) & 0xF,
+		channelConfig: (b[2]&1)<<2 | b[3]>>6,
+		headerLen:     7,
+		frameLen:      int(b[3]&3)<<11 | int(b[4])<<3 | int(b[5])>>5,
+	}
+	if b[1]&1 == 0 {
+		h.headerLen = 9 // 带CRC
+	}
+	if int(h.freqIdx) >= len(aacSampleRates) {
+		return adtsHeader{}, fmt.Errorf("adts sampling frequency index %d is illegal", h.freqIdx)
+	}
+	if h.frameLen < h.headerLen {
+		return adtsHeader{}, fmt.Errorf("adts frame length %d is illegal", h.frameLen)
+	}
+	return h, nil
+}
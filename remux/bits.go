@@ -0,0 +1,104 @@
+package remux
+
+import "errors"
+
+var errBitsOverrun = errors.New("read bits overrun")
+
+// bitReader 按位读取RBSP数据, 支持指数哥伦布编码
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			r.err = errBitsOverrun
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.u(1) == 1
+}
+
+func (r *bitReader) skip(n int) {
+	r.pos += n
+	if r.pos > len(r.b)*8 {
+		r.err = errBitsOverrun
+	}
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.u(1) == 0 {
+		if r.err != nil || zeros >= 32 {
+			r.err = errBitsOverrun
+			return 0
+		}
+		zeros++
+	}
+	return 1<<uint(zeros) - 1 + r.u(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+// unescapeRBSP 去除NAL中的防竞争字节(0x000003中的03)
+func unescapeRBSP(b []byte) []byte {
+	ret := make([]byte, 0, len(b))
+	zeros := 0
+	for _, v := range b {
+		if zeros >= 2 && v == 3 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// splitNALUs 按起始码(0x000001或0x00000001)切分Annex B格式的数据
+func splitNALUs(b []byte) [][]byte {
+	var (
+		ret   [][]byte
+		start = -1
+	)
+	for i := 0; i+2 < len(b); {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && b[end-1] == 0 {
+				end--
+			}
+			if end > start {
+				ret = append(ret, b[start:end])
+			}
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 && start < len(b) {
+		ret = append(ret, b[start:])
+	}
+	return ret
+}
@@ -0,0 +1,424 @@
+package remux
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// senc可以以uuid box的形式出现(PIFF)
+var sencUUID = []byte{0xa2, 0x39, 0x4f, 0x52, 0x5a, 0x9b, 0x4f, 0x14, 0xa2, 0x44, 0x6c, 0x42, 0x7c, 0x64, 0x8d, 0xf4}
+
+// parsedBox 解析出的box, 各偏移均相对于整个输入
+type parsedBox struct {
+	typ     string
+	start   int // box的起始位置
+	payload int // box内容的起始位置
+	end     int
+}
+
+// parseBoxes 解析b[from:to]中依次排列的box
+func parseBoxes(b []byte, from, to int) ([]parsedBox, error) {
+	var ret []parsedBox
+	for pos := from; pos < to; {
+		if to-pos < 8 {
+			return nil, fmt.Errorf("box at %d is truncated", pos)
+		}
+		size := int64(binary.BigEndian.Uint32(b[pos:]))
+		v := parsedBox{typ: string(b[pos+4 : pos+8]), start: pos, payload: pos + 8}
+		switch size {
+		case 0:
+			size = int64(to - pos)
+		case 1:
+			if to-pos < 16 {
+				return nil, fmt.Errorf("box %s at %d is truncated", v.typ, pos)
+			}
+			size = int64(binary.BigEndian.Uint64(b[pos+8:]))
+			v.payload += 8
+		}
+		if size < int64(v.payload-pos) || size > int64(to-pos) {
+			return nil, fmt.Errorf("box %s at %d has illegal size %d", v.typ, pos, size)
+		}
+		v.end = pos + int(size)
+		ret = append(ret, v)
+		pos = v.end
+	}
+	return ret, nil
+}
+
+// rename 原地修改box的类型, box的大小不变
+func (v parsedBox) rename(b []byte, typ string) {
+	copy(b[v.start+4:v.start+8], typ)
+}
+
+// DecryptCENC 使用clear key原地解密按照ISO/IEC 23001-7 cenc方案(HLS SAMPLE-AES-CTR)加密的fMP4媒体分片.
+// 样本的IV和子样本信息来自每个traf中的senc, 解密后senc, saiz, saio和pssh被改写为free box, 分片的大小和各偏移均不变.
+// 没有senc的traf视为未加密.
+func DecryptCENC(fragment []byte, key []byte) error {
+	if len(key) != aes.BlockSize {
+		return fmt.Errorf("sample-aes-ctr key length must be %d, got %d", aes.BlockSize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("aes.NewCipher error, %w", err)
+	}
+
+	boxes, err := parseBoxes(fragment, 0, len(fragment))
+	if err != nil {
+		return err
+	}
+	for _, moof := range boxes {
+		if moof.typ != "moof" {
+			continue
+		}
+		children, err := parseBoxes(fragment, moof.payload, moof.end)
+		if err != nil {
+			return err
+		}
+		for _, v := range children {
+			switch v.typ {
+			case "traf":
+				if err = decryptTraf(fragment, block, moof, v); err != nil {
+					return err
+				}
+			case "pssh":
+				v.rename(fragment, "free")
+			}
+		}
+	}
+	return nil
+}
+
+// cencSample 一个样本在分片中的位置
+type cencSample struct {
+	offset, size int
+}
+
+// cencEntry senc中一个样本的IV和子样本
+type cencEntry struct {
+	iv         []byte
+	subsamples [][2]int // 明文字节数, 密文字节数
+}
+
+func decryptTraf(b []byte, block cipher.Block, moof, traf parsedBox) error {
+	children, err := parseBoxes(b, traf.payload, traf.end)
+	if err != nil {
+		return err
+	}
+
+	var (
+		base    = moof.start
+		samples []cencSample
+		senc    *parsedBox
+		tfhd    *parsedBox
+	)
+	for i := range children {
+		v := &children[i]
+		switch {
+		case v.typ == "tfhd":
+			tfhd = v
+		case v.typ == "senc":
+			senc = v
+		case v.typ == "uuid" && v.end-v.payload >= 16 && string(b[v.payload:v.payload+16]) == string(sencUUID):
+			// 跳过16字节的extended_type, 其后与senc相同
+			v.payload += 16
+			senc = v
+		}
+	}
+	if senc == nil {
+		return nil
+	}
+	if tfhd == nil {
+		return errors.New("traf has no tfhd")
+	}
+
+	defaultSize, err := parseTfhd(b, *tfhd, &base)
+	if err != nil {
+		return err
+	}
+	cursor := base
+	for _, v := range children {
+		if v.typ != "trun" {
+			continue
+		}
+		if samples, cursor, err = parseTrun(b, v, base, cursor, defaultSize, samples); err != nil {
+			return err
+		}
+	}
+
+	entries, err := parseSenc(b, *senc, len(samples))
+	if err != nil {
+		return err
+	}
+	for i, s := range samples {
+		if s.offset < 0 || s.offset+s.size > len(b) {
+			return fmt.Errorf("sample %d at %d with size %d is out of range", i, s.offset, s.size)
+		}
+		if err = decryptSample(block, b[s.offset:s.offset+s.size], entries[i]); err != nil {
+			return fmt.Errorf("decrypt sample %d error, %w", i, err)
+		}
+	}
+
+	for _, v := range children {
+		switch v.typ {
+		case "saiz", "saio":
+			v.rename(b, "free")
+		}
+	}
+	senc.rename(b, "free")
+	return nil
+}
+
+// parseTfhd 解析tfhd, 存在base_data_offset时写入base, 返回default_sample_size, 未指定时为-1
+func parseTfhd(b []byte, v parsedBox, base *int) (int, error) {
+	p := b[v.payload:v.end]
+	if len(p) < 8 {
+		return 0, errors.New("tfhd is truncated")
+	}
+	flags := binary.BigEndian.Uint32(p) & 0xffffff
+	pos := 8
+	need := func(n int) error {
+		if pos+n > len(p) {
+			return errors.New("tfhd is truncated")
+		}
+		return nil
+	}
+	if flags&0x1 != 0 {
+		if err := need(8); err != nil {
+			return 0, err
+		}
+		*base = int(binary.BigEndian.Uint64(p[pos:]))
+		pos += 8
+	}
+	if flags&0x2 != 0 {
+		pos += 4
+	}
+	if flags&0x8 != 0 {
+		pos += 4
+	}
+	size := -1
+	if flags&0x10 != 0 {
+		if err := need(4); err != nil {
+			return 0, err
+		}
+		size = int(binary.BigEndian.Uint32(p[pos:]))
+	}
+	return size, nil
+}
+
+// parseTrun 解析trun, 将其中样本的位置追加到samples, 返回追加后的samples和下一个trun没有data_offset时的起始位置
+func parseTrun(b []byte, v parsedBox, base, cursor, defaultSize int, samples []cencSample) ([]cencSample, int, error) {
+	p := b[v.payload:v.end]
+	if len(p) < 8 {
+		return nil, 0, errors.New("trun is truncated")
+	}
+	flags := binary.BigEndian.Uint32(p) & 0xffffff
+	count := int(binary.BigEndian.Uint32(p[4:]))
+	pos := 8
+	if flags&0x1 != 0 {
+		if pos+4 > len(p) {
+			return nil, 0, errors.New("trun is truncated")
+		}
+		cursor = base + int(int32(binary.BigEndian.Uint32(p[pos:])))
+		pos += 4
+	}
+	if flags&0x4 != 0 {
+		pos += 4
+	}
+
+	var fields []uint32
+	for _, f := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&f != 0 {
+			fields = append(fields, f)
+		}
+	}
+	if count < 0 || pos+count*4*len(fields) > len(p) {
+		return nil, 0, errors.New("trun is truncated")
+	}
+	if flags&0x200 == 0 && defaultSize < 0 {
+		return nil, 0, errors.New("sample size is not specified by trun or tfhd")
+	}
+	for i := 0; i < count; i++ {
+		size := defaultSize
+		for _, f := range fields {
+			if f == 0x200 {
+				size = int(binary.BigEndian.Uint32(p[pos:]))
+			}
+			pos += 4
+		}
+		samples = append(samples, cencSample{offset: cursor, size: size})
+		cursor += size
+	}
+	return samples, cursor, nil
+}
+
+// parseSenc 解析senc, senc中没有记录IV的长度, 依次尝试8和16字节, 取恰好能解析整个senc的长度
+func parseSenc(b []byte, v parsedBox, samples int) ([]cencEntry, error) {
+	p := b[v.payload:v.end]
+	if len(p) < 8 {
+		return nil, errors.New("senc is truncated")
+	}
+	subsample := binary.BigEndian.Uint32(p)&0x2 != 0
+	count := int(binary.BigEndian.Uint32(p[4:]))
+	if count != samples {
+		return nil, fmt.Errorf("senc has %d samples, but trun has %d", count, samples)
+	}
+
+	for _, ivSize := range []int{8, 16} {
+		if entries, ok := parseSencEntries(p[8:], count, ivSize, subsample); ok {
+			return entries, nil
+		}
+	}
+	return nil, errors.New("senc is illegal")
+}
+
+func parseSencEntries(p []byte, count, ivSize int, subsample bool) ([]cencEntry, bool) {
+	entries := make([]cencEntry, 0, count)
+	pos := 0
+	for i := 0; i < count; i++ {
+		if pos+ivSize > len(p) {
+			return nil, false
+		}
+		e := cencEntry{iv: p[pos : pos+ivSize]}
+		pos += ivSize
+		if subsample {
+			if pos+2 > len(p) {
+				return nil, false
+			}
+			n := int(binary.BigEndian.Uint16(p[pos:]))
+			pos += 2
+			if pos+6*n > len(p) {
+				return nil, false
+			}
+			for j := 0; j < n; j++ {
+				e.subsamples = append(e.subsamples, [2]int{int(binary.BigEndian.Uint16(p[pos:])), int(binary.BigEndian.Uint32(p[pos+2:]))})
+				pos += 6
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, pos == len(p)
+}
+
+// decryptSample 原地解密一个样本, 各子样本的密文视为连续的CTR密钥流
+func decryptSample(block cipher.Block, sample []byte, e cencEntry) error {
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, e.iv)
+	stream := cipher.NewCTR(block, counter)
+	if len(e.subsamples) == 0 {
+		stream.XORKeyStream(sample, sample)
+		return nil
+	}
+
+	pos := 0
+	for _, v := range e.subsamples {
+		pos += v[0]
+		if pos+v[1] > len(sample) {
+			return fmt.Errorf("subsamples exceed sample size %d", len(sample))
+		}
+		stream.XORKeyStream(sample[pos:pos+v[1]], sample[pos:pos+v[1]])
+		pos += v[1]
+	}
+	return nil
+}
+
+// ClearCENCInit 将加密的fMP4初始化分片中encv/enca样本描述的类型改写为sinf中frma记录的原始格式,
+// 并将sinf和pssh改写为free box, 使解密后的媒体分片可以作为明文播放. 初始化分片被原地修改, 大小不变.
+func ClearCENCInit(init []byte) error {
+	boxes, err := parseBoxes(init, 0, len(init))
+	if err != nil {
+		return err
+	}
+	for _, v := range boxes {
+		if v.typ == "moov" {
+			if err = clearContainer(init, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clearContainer 递归处理moov, trak, mdia, minf和stbl
+func clearContainer(b []byte, parent parsedBox) error {
+	children, err := parseBoxes(b, parent.payload, parent.end)
+	if err != nil {
+		return err
+	}
+	for _, v := range children {
+		switch v.typ {
+		case "trak", "mdia", "minf", "stbl":
+			err = clearContainer(b, v)
+		case "pssh":
+			v.rename(b, "free")
+		case "stsd":
+			err = clearStsd(b, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func clearStsd(b []byte, stsd parsedBox) error {
+	// version, flags和entry_count
+	if stsd.end-stsd.payload < 8 {
+		return errors.New("stsd is truncated")
+	}
+	entries, err := parseBoxes(b, stsd.payload+8, stsd.end)
+	if err != nil {
+		return err
+	}
+	for _, v := range entries {
+		var offset int // 样本描述中子box的起始位置
+		switch v.typ {
+		case "encv":
+			offset = v.payload + 78
+		case "enca":
+			// 8字节的SampleEntry头之后为2字节的version, version 1和2分别多出16和36字节
+			offset = v.payload + 28
+			if v.payload+10 <= v.end {
+				switch binary.BigEndian.Uint16(b[v.payload+8:]) {
+				case 1:
+					offset += 16
+				case 2:
+					offset += 36
+				}
+			}
+		default:
+			continue
+		}
+		if offset > v.end {
+			return fmt.Errorf("sample entry %s is truncated", v.typ)
+		}
+		children, err := parseBoxes(b, offset, v.end)
+		if err != nil {
+			return err
+		}
+
+		var format string
+		for _, sinf := range children {
+			if sinf.typ != "sinf" {
+				continue
+			}
+			items, err := parseBoxes(b, sinf.payload, sinf.end)
+			if err != nil {
+				return err
+			}
+			for _, frma := range items {
+				if frma.typ == "frma" && frma.end-frma.payload >= 4 {
+					format = string(b[frma.payload : frma.payload+4])
+				}
+			}
+			sinf.rename(b, "free")
+		}
+		if format == "" {
+			return fmt.Errorf("sample entry %s has no frma", v.typ)
+		}
+		v.rename(b, format)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	h264NalSlice = 1
+	h264NalIDR   = 5
+	h264NalSEI   = 6
+	h264NalSPS   = 7
+	h264NalPPS   = 8
+	h264NalAUD   = 9
+	h264NalFill  = 12
+)
+
+type videoInfo struct {
+	width  int
+	height int
+}
+
+// parseH264SPS 从SPS中解析出视频的宽高
+func parseH264SPS(nal []byte) (videoInfo, error) {
+	if len(nal) < 4 {
+		return videoInfo{}, errors.New("h264 sps too short")
+	}
+	r := &bitReader{b: unescapeRBSP(nal[1:])}
+	profileIdc := r.u(8)
+	r.skip(16) // constraint_set_flags, level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormatIdc := uint32(1)
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIdc = r.ue()
+		if chromaFormatIdc == 3 {
+			r.skip(1) // separate_colour_plane_flag
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if r.flag() {
+			cnt := 8
+			if chromaFormatIdc == 3 {
+				cnt = 12
+			}
+			for i := 0; i < cnt; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	frameMbsOnly := r.u(1)
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.flag() {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return videoInfo{}, fmt.Errorf("parse h264 sps error, %w", r.err)
+	}
+
+	cropUnitX, cropUnitY := uint32(1), 2-frameMbsOnly
+	switch chromaFormatIdc {
+	case 1:
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropUnitX = 2
+	}
+	return videoInfo{
+		width:  int(widthInMbs*16 - (cropLeft+cropRight)*cropUnitX),
+		height: int((2-frameMbsOnly)*heightInMapUnits*16 - (cropTop+cropBottom)*cropUnitY),
+	}, nil
+}
+
+// avcC 生成AVCDecoderConfigurationRecord
+func avcC(sps, pps [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{1, sps[0][1], sps[0][2], sps[0][3], 0xFF, 0xE0 | byte(len(sps))})
+	for _, v := range sps {
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(v)))
+		buf.Write(v)
+	}
+	buf.WriteByte(byte(len(pps)))
+	for _, v := range pps {
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(v)))
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,125 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	h265NalBLAWLP = 16 // 16到21为IRAP, 即关键帧
+	h265NalCRA    = 21
+	h265NalVPS    = 32
+	h265NalSPS    = 33
+	h265NalPPS    = 34
+	h265NalAUD    = 35
+	h265NalFD     = 38
+)
+
+func h265NalType(nal []byte) int {
+	return int(nal[0]>>1) & 0x3f
+}
+
+// h265SPS 生成hvcC所需的SPS信息
+type h265SPS struct {
+	videoInfo
+	ptl              [12]byte // general_profile_space到general_level_idc
+	chromaFormatIdc  uint32
+	bitDepthLuma     uint32
+	bitDepthChroma   uint32
+	maxSubLayers     uint32
+	temporalIdNested uint32
+}
+
+func parseH265SPS(nal []byte) (h265SPS, error) {
+	var ret h265SPS
+	if len(nal) < 15 {
+		return ret, errors.New("h265 sps too short")
+	}
+	rbsp := unescapeRBSP(nal[2:])
+	if len(rbsp) < 13 {
+		return ret, errors.New("h265 sps too short")
+	}
+	r := &bitReader{b: rbsp}
+	r.skip(4) // sps_video_parameter_set_id
+	ret.maxSubLayers = r.u(3) + 1
+	ret.temporalIdNested = r.u(1)
+	copy(ret.ptl[:], rbsp[1:13])
+	r.skip(96)
+
+	subLayers := int(ret.maxSubLayers) - 1
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i] = r.flag()
+		levelPresent[i] = r.flag()
+	}
+	if subLayers > 0 {
+		r.skip(2 * (8 - subLayers))
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	ret.chromaFormatIdc = r.ue()
+	if ret.chromaFormatIdc == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	width, height := r.ue(), r.ue()
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.flag() {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	ret.bitDepthLuma = r.ue() + 8
+	ret.bitDepthChroma = r.ue() + 8
+	if r.err != nil {
+		return ret, fmt.Errorf("parse h265 sps error, %w", r.err)
+	}
+
+	subWidth, subHeight := uint32(1), uint32(1)
+	switch ret.chromaFormatIdc {
+	case 1:
+		subWidth, subHeight = 2, 2
+	case 2:
+		subWidth = 2
+	}
+	ret.width = int(width - (cropLeft+cropRight)*subWidth)
+	ret.height = int(height - (cropTop+cropBottom)*subHeight)
+	return ret, nil
+}
+
+// hvcC 生成HEVCDecoderConfigurationRecord
+func hvcC(info h265SPS, vps, sps, pps [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(1)
+	buf.Write(info.ptl[:])
+	buf.Write([]byte{
+		0xF0, 0x00, // min_spatial_segmentation_idc
+		0xFC,                                // parallelismType
+		0xFC | byte(info.chromaFormatIdc&3), // chromaFormat
+		0xF8 | byte((info.bitDepthLuma-8)&7),
+		0xF8 | byte((info.bitDepthChroma-8)&7),
+		0x00, 0x00, // avgFrameRate
+		byte(info.maxSubLayers&7)<<3 | byte(info.temporalIdNested&1)<<2 | 3,
+		3, // numOfArrays
+	})
+	for _, arr := range []struct {
+		typ  int
+		nals [][]byte
+	}{{h265NalVPS, vps}, {h265NalSPS, sps}, {h265NalPPS, pps}} {
+		buf.WriteByte(0x80 | byte(arr.typ))
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(arr.nals)))
+		for _, v := range arr.nals {
+			_ = binary.Write(&buf, binary.BigEndian, uint16(len(v)))
+			buf.Write(v)
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,324 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const movieTimescale = 1000
+
+type sample struct {
+	size     uint32
+	duration uint32
+	cto      int32 // composition time offset
+	sync     bool
+}
+
+type chunk struct {
+	offset int64
+	count  uint32
+}
+
+// track mp4中的一个轨道, 样本数据直接写入mdat, 仅在内存中保存样本表
+type track struct {
+	id        uint32
+	handler   string // vide, soun或sbtl
+	timescale uint32
+	entry     []byte // stsd中的样本描述
+	width     int
+	height    int
+	samples   []sample
+	chunks    []chunk
+	startTime int64 // 首个样本的显示时间, 单位为1/timescale秒, 用于生成edts
+	mediaTime int64 // 首个样本的显示时间相对其解码时间的偏移
+	language  string
+}
+
+func (t *track) duration() uint64 {
+	var d uint64
+	for _, v := range t.samples {
+		d += uint64(v.duration)
+	}
+	return d
+}
+
+// mp4Writer 依次写入ftyp, mdat和moov, 生成渐进式mp4
+type mp4Writer struct {
+	w         io.WriteSeeker
+	mdatStart int64
+	pos       int64
+	tracks    []*track
+	last      *track
+}
+
+func newMP4Writer(w io.WriteSeeker) (*mp4Writer, error) {
+	ftyp := box("ftyp", []byte("isom"), u32(512), []byte("isomiso2avc1mp41"))
+	// mdat使用64位的largesize, 结束时回填
+	mdat := append(u32(1), []byte("mdat")...)
+	mdat = append(mdat, make([]byte, 8)...)
+	if _, err := w.Write(append(ftyp, mdat...)); err != nil {
+		return nil, fmt.Errorf("write mp4 header error, %w", err)
+	}
+	return &mp4Writer{
+		w:         w,
+		mdatStart: int64(len(ftyp)),
+		pos:       int64(len(ftyp) + len(mdat)),
+	}, nil
+}
+
+func (m *mp4Writer) addTrack(t *track) {
+	t.id = uint32(len(m.tracks) + 1)
+	m.tracks = append(m.tracks, t)
+}
+
+// writeSample 将样本数据追加到mdat, 同一轨道连续写入的样本合并为一个chunk
+func (m *mp4Writer) writeSample(t *track, data []byte, s sample) error {
+	if _, err := m.w.Write(data); err != nil {
+		return fmt.Errorf("write mp4 sample error, %w", err)
+	}
+	if m.last != t || len(t.chunks) == 0 {
+		t.chunks = append(t.chunks, chunk{offset: m.pos})
+	}
+	t.chunks[len(t.chunks)-1].count++
+	s.size = uint32(len(data))
+	t.samples = append(t.samples, s)
+	m.pos += int64(len(data))
+	m.last = t
+	return nil
+}
+
+func (m *mp4Writer) finish() error {
+	end := m.pos
+	if _, err := m.w.Seek(m.mdatStart+8, io.SeekStart); err != nil {
+		return fmt.Errorf("seek mp4 error, %w", err)
+	}
+	if _, err := m.w.Write(u64(uint64(end - m.mdatStart))); err != nil {
+		return fmt.Errorf("write mdat size error, %w", err)
+	}
+	if _, err := m.w.Seek(end, io.SeekStart); err != nil {
+		return fmt.Errorf("seek mp4 error, %w", err)
+	}
+	if _, err := m.w.Write(m.moov()); err != nil {
+		return fmt.Errorf("write moov error, %w", err)
+	}
+	return nil
+}
+
+func (m *mp4Writer) moov() []byte {
+	var (
+		traks    [][]byte
+		duration uint64
+	)
+	for _, t := range m.tracks {
+		d := t.movieDuration()
+		if d > duration {
+			duration = d
+		}
+		traks = append(traks, t.trak())
+	}
+	mvhd := fullBox("mvhd", 1, 0,
+		u64(0), u64(0), // creation_time, modification_time
+		u32(movieTimescale), u64(duration),
+		u32(0x00010000), []byte{1, 0}, // rate, volume
+		make([]byte, 10), matrix(), make([]byte, 24),
+		u32(uint32(len(m.tracks)+1)),
+	)
+	return box("moov", append([][]byte{mvhd}, traks...)...)
+}
+
+func (t *track) movieDuration() uint64 {
+	return (t.duration() + uint64(t.startTime)) * movieTimescale / uint64(t.timescale)
+}
+
+func (t *track) trak() []byte {
+	duration := t.duration()
+	volume := []byte{0, 0}
+	if t.handler == "soun" {
+		volume = []byte{1, 0}
+	}
+	tkhd := fullBox("tkhd", 1, 3,
+		u64(0), u64(0), u32(t.id), u32(0),
+		u64(t.movieDuration()),
+		make([]byte, 8), u16(0), u16(0), volume, u16(0),
+		matrix(),
+		u32(uint32(t.width)<<16), u32(uint32(t.height)<<16),
+	)
+
+	// edts: 轨道相对影片起点的延迟用空编辑表示, mediaTime跳过B帧引入的显示时间偏移
+	var elst [][]byte
+	if t.startTime > 0 {
+		elst = append(elst, u64(uint64(t.startTime)*movieTimescale/uint64(t.timescale)), u64(^uint64(0)), u32(0x00010000))
+	}
+	elst = append(elst, u64(duration*movieTimescale/uint64(t.timescale)), u64(uint64(t.mediaTime)), u32(0x00010000))
+	edts := box("edts", fullBox("elst", 1, 0, append([][]byte{u32(uint32(len(elst) / 3))}, elst...)...))
+
+	mdhd := fullBox("mdhd", 1, 0, u64(0), u64(0), u32(t.timescale), u64(duration), u16(packLanguage(t.language)), u16(0))
+	hdlrName := "VideoHandler"
+	mediaHeader := fullBox("vmhd", 0, 1, make([]byte, 8))
+	switch t.handler {
+	case "soun":
+		hdlrName = "SoundHandler"
+		mediaHeader = fullBox("smhd", 0, 0, make([]byte, 4))
+	case "sbtl":
+		hdlrName = "SubtitleHandler"
+		mediaHeader = fullBox("nmhd", 0, 0)
+	}
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(t.handler), make([]byte, 12), []byte(hdlrName+"\x00"))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	minf := box("minf", mediaHeader, dinf, t.stbl())
+	return box("trak", tkhd, edts, box("mdia", mdhd, hdlr, minf))
+}
+
+func (t *track) stbl() []byte {
+	stsd := fullBox("stsd", 0, 0, u32(1), t.entry)
+
+	var stts, ctts, stss, stsz bytes.Buffer
+	var sttsCnt, cttsCnt, stssCnt uint32
+	hasCtts, allSync := false, true
+	for i, v := range t.samples {
+		if i == 0 || v.duration != t.samples[i-1].duration {
+			stts.Write(u32(1))
+			stts.Write(u32(v.duration))
+			sttsCnt++
+		} else {
+			addCount(stts.Bytes()[stts.Len()-8:])
+		}
+		if i == 0 || v.cto != t.samples[i-1].cto {
+			ctts.Write(u32(1))
+			ctts.Write(u32(uint32(v.cto)))
+			cttsCnt++
+		} else {
+			addCount(ctts.Bytes()[ctts.Len()-8:])
+		}
+		if v.cto != 0 {
+			hasCtts = true
+		}
+		if v.sync {
+			stss.Write(u32(uint32(i + 1)))
+			stssCnt++
+		} else {
+			allSync = false
+		}
+		stsz.Write(u32(v.size))
+	}
+
+	var stsc bytes.Buffer
+	var stscCnt uint32
+	for i, v := range t.chunks {
+		if i == 0 || v.count != t.chunks[i-1].count {
+			stsc.Write(u32(uint32(i + 1)))
+			stsc.Write(u32(v.count))
+			stsc.Write(u32(1))
+			stscCnt++
+		}
+	}
+
+	co64 := false
+	for _, v := range t.chunks {
+		if v.offset > 0xFFFFFFFF {
+			co64 = true
+		}
+	}
+	var co bytes.Buffer
+	for _, v := range t.chunks {
+		if co64 {
+			co.Write(u64(uint64(v.offset)))
+		} else {
+			co.Write(u32(uint32(v.offset)))
+		}
+	}
+
+	boxes := [][]byte{
+		stsd,
+		fullBox("stts", 0, 0, u32(sttsCnt), stts.Bytes()),
+	}
+	if hasCtts {
+		boxes = append(boxes, fullBox("ctts", 1, 0, u32(cttsCnt), ctts.Bytes()))
+	}
+	if !allSync {
+		boxes = append(boxes, fullBox("stss", 0, 0, u32(stssCnt), stss.Bytes()))
+	}
+	boxes = append(boxes,
+		fullBox("stsc", 0, 0, u32(stscCnt), stsc.Bytes()),
+		fullBox("stsz", 0, 0, u32(0), u32(uint32(len(t.samples))), stsz.Bytes()),
+	)
+	if co64 {
+		boxes = append(boxes, fullBox("co64", 0, 0, u32(uint32(len(t.chunks))), co.Bytes()))
+	} else {
+		boxes = append(boxes, fullBox("stco", 0, 0, u32(uint32(len(t.chunks))), co.Bytes()))
+	}
+	return box("stbl", boxes...)
+}
+
+// addCount 将stts或ctts中最后一项的sample_count加1
+func addCount(entry []byte) {
+	binary.BigEndian.PutUint32(entry, binary.BigEndian.Uint32(entry)+1)
+}
+
+func visualSampleEntry(typ string, width, height int, config []byte) []byte {
+	compressor := make([]byte, 32)
+	return box(typ,
+		make([]byte, 6), u16(1), // reserved, data_reference_index
+		make([]byte, 16),
+		u16(uint16(width)), u16(uint16(height)),
+		u32(0x00480000), u32(0x00480000), u32(0),
+		u16(1), compressor, u16(0x0018), u16(0xFFFF),
+		config,
+	)
+}
+
+func audioSampleEntry(channels, sampleRate int, asc []byte) []byte {
+	decSpecific := descriptor(5, asc)
+	decConfig := descriptor(4, []byte{0x40, 0x15, 0, 0, 0}, u32(0), u32(0), decSpecific)
+	es := descriptor(3, u16(0), []byte{0}, decConfig, descriptor(6, []byte{2}))
+	return box("mp4a",
+		make([]byte, 6), u16(1),
+		make([]byte, 8),
+		u16(uint16(channels)), u16(16), u16(0), u16(0),
+		u32(uint32(sampleRate)<<16),
+		fullBox("esds", 0, 0, es),
+	)
+}
+
+func descriptor(tag byte, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	l := len(body)
+	return append([]byte{tag, 0x80 | byte(l>>21&0x7F), 0x80 | byte(l>>14&0x7F), 0x80 | byte(l>>7&0x7F), byte(l & 0x7F)}, body...)
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	return append(append(u32(uint32(8+len(body))), []byte(typ)...), body...)
+}
+
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	return box(typ, append([][]byte{{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}}, payload...)...)
+}
+
+func matrix() []byte {
+	return bytes.Join([][]byte{
+		u32(0x00010000), u32(0), u32(0),
+		u32(0), u32(0x00010000), u32(0),
+		u32(0), u32(0), u32(0x40000000),
+	}, nil)
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,329 @@
+// Package remux 在不依赖ffmpeg的情况下将MPEG-TS中的H.264/H.265视频和AAC音频重新封装为MP4
+package remux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	tsTimescale = 90000
+	tsWrap      = int64(1) << 33
+	// 无法根据相邻样本计算时长时使用的视频帧时长
+	defaultFrameDuration = tsTimescale / 25
+)
+
+var ErrNoSupportedStream = errors.New("no supported h264/h265/aac stream found")
+
+// TsToMP4 将一个或多个MPEG-TS流中的H.264/H.265视频和AAC音频重新封装为渐进式MP4写入w.
+// 多个输入(例如视频和独立的音频)的轨道写入同一个文件, 各轨道以所有轨道中最早的显示时间为起点对齐.
+func TsToMP4(w io.WriteSeeker, inputs ...io.Reader) error {
+	return TsToMP4WithSubtitles(w, nil, inputs...)
+}
+
+// TsToMP4WithSubtitles 与TsToMP4相同, 并将subtitles作为tx3g文本轨道写入mp4
+func TsToMP4WithSubtitles(w io.WriteSeeker, subtitles []Subtitle, inputs ...io.Reader) error {
+	m, err := newMP4Writer(w)
+	if err != nil {
+		return err
+	}
+
+	var streams []*esStream
+	for _, in := range inputs {
+		s, err := demux(m, in)
+		if err != nil {
+			return err
+		}
+		streams = append(streams, s...)
+	}
+
+	var used []*esStream
+	for _, s := range streams {
+		if err = s.finish(m); err != nil {
+			return err
+		}
+		if s.t != nil {
+			used = append(used, s)
+		}
+	}
+	if len(used) == 0 {
+		return ErrNoSupportedStream
+	}
+
+	align(used)
+	for _, v := range subtitles {
+		if err = writeSubtitle(m, v); err != nil {
+			return err
+		}
+	}
+	return m.finish()
+}
+
+func demux(m *mp4Writer, in io.Reader) ([]*esStream, error) {
+	var (
+		r       = NewTsReader(in)
+		streams = make(map[uint16]*esStream)
+		order   []*esStream
+	)
+	for {
+		pes, err := r.ReadPES()
+		if err == io.EOF {
+			return order, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !pes.HasPTS {
+			continue
+		}
+		s, ok := streams[pes.Pid]
+		if !ok {
+			switch pes.StreamType {
+			case StreamTypeH264, StreamTypeH265, StreamTypeAAC:
+			default:
+				continue
+			}
+			s = &esStream{streamType: pes.StreamType}
+			streams[pes.Pid] = s
+			order = append(order, s)
+		}
+		if err = s.write(m, pes); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// align 以所有轨道中最早的显示时间为起点, 计算各轨道在edts中的延迟
+func align(streams []*esStream) {
+	base := streams[0].firstPTS
+	for _, s := range streams[1:] {
+		if s.firstPTS < base {
+			base = s.firstPTS
+		}
+	}
+	for _, s := range streams {
+		s.t.startTime = (s.firstPTS - base) * int64(s.t.timescale) / tsTimescale
+	}
+}
+
+// esStream 一个基本流的封装状态, 时间戳单位均为1/90000秒且已处理33位回绕
+type esStream struct {
+	streamType byte
+	t          *track
+	started    bool
+	lastDTS    int64
+	firstPTS   int64 // 最早的显示时间
+	firstDTS   int64
+
+	// 视频
+	vps, sps, pps [][]byte
+	pending       []byte // 等待下一个样本以确定时长的样本
+	pendingDTS    int64
+	pendingPTS    int64
+	pendingSync   bool
+	lastDuration  uint32
+
+	// 音频
+	audioBuf []byte
+}
+
+func (s *esStream) unwrap(ts int64) int64 {
+	for ts < s.lastDTS-tsWrap/2 {
+		ts += tsWrap
+	}
+	for ts > s.lastDTS+tsWrap/2 {
+		ts -= tsWrap
+	}
+	return ts
+}
+
+func (s *esStream) write(m *mp4Writer, pes *PES) error {
+	pts, dts := pes.PTS, pes.DTS
+	if s.started {
+		dts = s.unwrap(dts)
+		pts = s.unwrap(pts)
+	} else {
+		// PTS可能已经回绕而DTS尚未回绕
+		if pts < dts-tsWrap/2 {
+			pts += tsWrap
+		}
+	}
+
+	if s.streamType == StreamTypeAAC {
+		return s.writeAudio(m, pes.Data, pts)
+	}
+	return s.writeVideo(m, pes.Data, pts, dts)
+}
+
+func (s *esStream) writeVideo(m *mp4Writer, data []byte, pts, dts int64) error {
+	var (
+		au   []byte
+		sync bool
+	)
+	for _, nal := range splitNALUs(data) {
+		if s.streamType == StreamTypeH264 {
+			switch nal[0] & 0x1F {
+			case h264NalSPS:
+				s.sps = keepFirst(s.sps, nal)
+				continue
+			case h264NalPPS:
+				s.pps = keepFirst(s.pps, nal)
+				continue
+			case h264NalAUD, h264NalFill:
+				continue
+			case h264NalIDR:
+				sync = true
+			}
+		} else {
+			if len(nal) < 2 {
+				continue
+			}
+			switch t := h265NalType(nal); {
+			case t == h265NalVPS:
+				s.vps = keepFirst(s.vps, nal)
+				continue
+			case t == h265NalSPS:
+				s.sps = keepFirst(s.sps, nal)
+				continue
+			case t == h265NalPPS:
+				s.pps = keepFirst(s.pps, nal)
+				continue
+			case t == h265NalAUD || t == h265NalFD:
+				continue
+			case t >= h265NalBLAWLP && t <= h265NalCRA:
+				sync = true
+			}
+		}
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(nal)))
+		au = append(append(au, size...), nal...)
+	}
+	if len(au) == 0 {
+		return nil
+	}
+
+	if !s.started {
+		// 丢弃第一个关键帧之前的样本
+		if !sync {
+			return nil
+		}
+		s.started = true
+		s.firstDTS, s.firstPTS = dts, pts
+		s.t = &track{handler: "vide", timescale: tsTimescale}
+		m.addTrack(s.t)
+	}
+	s.lastDTS = dts
+	if pts < s.firstPTS {
+		s.firstPTS = pts
+	}
+
+	if err := s.flushVideo(m, dts); err != nil {
+		return err
+	}
+	s.pending, s.pendingDTS, s.pendingPTS, s.pendingSync = au, dts, pts, sync
+	return nil
+}
+
+// flushVideo 写入等待中的样本, nextDTS为其下一个样本的解码时间
+func (s *esStream) flushVideo(m *mp4Writer, nextDTS int64) error {
+	if s.pending == nil {
+		return nil
+	}
+	d := nextDTS - s.pendingDTS
+	if d <= 0 {
+		d = int64(s.lastDuration)
+		if d == 0 {
+			d = defaultFrameDuration
+		}
+	}
+	s.lastDuration = uint32(d)
+	cto := s.pendingPTS - s.pendingDTS
+	if cto < 0 {
+		cto = 0
+	}
+	err := m.writeSample(s.t, s.pending, sample{duration: uint32(d), cto: int32(cto), sync: s.pendingSync})
+	s.pending = nil
+	return err
+}
+
+func (s *esStream) writeAudio(m *mp4Writer, data []byte, pts int64) error {
+	if !s.started {
+		s.started = true
+		s.firstPTS, s.firstDTS = pts, pts
+	}
+	s.lastDTS = pts
+
+	buf := append(s.audioBuf, data...)
+	for len(buf) > 0 {
+		h, err := parseADTS(buf)
+		if err != nil {
+			if len(buf) < 9 {
+				break
+			}
+			// 跳过无法识别的数据, 查找下一个同步字
+			buf = buf[1:]
+			continue
+		}
+		if h.frameLen > len(buf) {
+			break
+		}
+		if s.t == nil {
+			s.t = &track{
+				handler:   "soun",
+				timescale: uint32(h.sampleRate()),
+				entry:     audioSampleEntry(int(h.channelConfig), h.sampleRate(), h.audioSpecificConfig()),
+			}
+			m.addTrack(s.t)
+		}
+		if err = m.writeSample(s.t, buf[h.headerLen:h.frameLen], sample{duration: aacSamplesPerFrame, sync: true}); err != nil {
+			return err
+		}
+		buf = buf[h.frameLen:]
+	}
+	s.audioBuf = append([]byte{}, buf...)
+	return nil
+}
+
+func (s *esStream) finish(m *mp4Writer) error {
+	if s.streamType == StreamTypeAAC || s.t == nil {
+		return nil
+	}
+	if err := s.flushVideo(m, s.pendingDTS); err != nil {
+		return err
+	}
+	if len(s.sps) == 0 || len(s.pps) == 0 {
+		return fmt.Errorf("stream type 0x%x has no sps or pps", s.streamType)
+	}
+
+	s.t.mediaTime = s.firstPTS - s.firstDTS
+	if s.streamType == StreamTypeH264 {
+		info, err := parseH264SPS(s.sps[0])
+		if err != nil {
+			return err
+		}
+		s.t.width, s.t.height = info.width, info.height
+		s.t.entry = visualSampleEntry("avc1", info.width, info.height, box("avcC", avcC(s.sps, s.pps)))
+		return nil
+	}
+
+	if len(s.vps) == 0 {
+		return errors.New("h265 stream has no vps")
+	}
+	info, err := parseH265SPS(s.sps[0])
+	if err != nil {
+		return err
+	}
+	s.t.width, s.t.height = info.width, info.height
+	s.t.entry = visualSampleEntry("hvc1", info.width, info.height, box("hvcC", hvcC(info, s.vps, s.sps, s.pps)))
+	return nil
+}
+
+// keepFirst 只保留第一次出现的参数集, 参数集中途变化时仍使用第一个
+func keepFirst(sets [][]byte, nal []byte) [][]byte {
+	if len(sets) > 0 {
+		return sets
+	}
+	return [][]byte{append([]byte{}, nal...)}
+}
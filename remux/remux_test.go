@@ -0,0 +1,534 @@
+package remux
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type bitWriter struct {
+	b   []byte
+	pos int
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << (7 - uint(w.pos%8))
+		w.pos++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v)
+}
+
+// testSPS 生成640x360的H.264 Baseline SPS
+func testSPS() []byte {
+	w := &bitWriter{}
+	w.u(8, 0x67)
+	w.u(8, 66) // profile_idc
+	w.u(8, 0)
+	w.u(8, 30) // level_idc
+	w.ue(0)    // sps_id
+	w.ue(0)    // log2_max_frame_num_minus4
+	w.ue(2)    // pic_order_cnt_type
+	w.ue(1)    // max_num_ref_frames
+	w.u(1, 0)
+	w.ue(39) // pic_width_in_mbs_minus1
+	w.ue(22) // pic_height_in_map_units_minus1
+	w.u(1, 1)
+	w.u(1, 1)
+	w.u(1, 1) // frame_cropping_flag
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(4)
+	w.u(1, 0) // vui
+	w.u(1, 1) // rbsp_stop_one_bit
+	return w.b
+}
+
+func adtsFrame(payload []byte) []byte {
+	l := 7 + len(payload)
+	h := []byte{0xFF, 0xF1, 1<<6 | 4<<2, 2<<6 | byte(l>>11), byte(l >> 3), byte(l<<5) | 0x1F, 0xFC}
+	return append(h, payload...)
+}
+
+func timestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0E | 1,
+		byte(ts >> 22), byte(ts>>14) | 1,
+		byte(ts >> 7), byte(ts<<1) | 1,
+	}
+}
+
+func pesPacket(streamId byte, pts, dts int64, data []byte) []byte {
+	header := timestamp(2, pts)
+	flags := byte(0x80)
+	if dts != pts {
+		header = append(timestamp(3, pts), timestamp(1, dts)...)
+		flags = 0xC0
+	}
+	ret := []byte{0, 0, 1, streamId, 0, 0, 0x80, flags, byte(len(header))}
+	return append(append(ret, header...), data...)
+}
+
+type tsBuilder struct {
+	buf bytes.Buffer
+	cc  map[uint16]byte
+}
+
+func (b *tsBuilder) packets(pid uint16, data []byte, isSection bool) {
+	first := true
+	if isSection {
+		data = append([]byte{0}, data...)
+	}
+	for len(data) > 0 || first {
+		pkt := make([]byte, TsPacketSize)
+		pkt[0] = tsSyncByte
+		pkt[1] = byte(pid >> 8)
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+		pkt[3] = 0x10 | b.cc[pid]&0x0F
+		b.cc[pid]++
+		n := copy(pkt[4:], data)
+		if n < TsPacketSize-4 && !isSection {
+			// 使用自适应域填充
+			copy(pkt[4+TsPacketSize-4-n:], data[:n])
+			pkt[3] |= 0x20
+			pkt[4] = byte(TsPacketSize - 4 - n - 1)
+			if pkt[4] > 0 {
+				pkt[5] = 0
+				for i := 6; i < 4+TsPacketSize-4-n; i++ {
+					pkt[i] = 0xFF
+				}
+			}
+		} else if n < TsPacketSize-4 {
+			for i := 4 + n; i < TsPacketSize; i++ {
+				pkt[i] = 0xFF
+			}
+		}
+		data = data[n:]
+		first = false
+		b.buf.Write(pkt)
+	}
+}
+
+func (b *tsBuilder) tables() {
+	pat := []byte{0x00, 0xB0, 13, 0, 1, 0xC1, 0, 0, 0, 1, 0xF0, 0x00, 0, 0, 0, 0}
+	b.packets(0, pat, true)
+	pmt := []byte{0x02, 0xB0, 23, 0, 1, 0xC1, 0, 0, 0xE1, 0x00, 0xF0, 0,
+		StreamTypeH264, 0xE1, 0x00, 0xF0, 0,
+		StreamTypeAAC, 0xE1, 0x01, 0xF0, 0,
+		0, 0, 0, 0}
+	b.packets(0x1000, pmt, true)
+}
+
+type mp4Box struct {
+	typ  string
+	body []byte
+}
+
+func readBoxes(b []byte) []mp4Box {
+	var ret []mp4Box
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b))
+		header := uint64(8)
+		if size == 1 {
+			size = binary.BigEndian.Uint64(b[8:])
+			header = 16
+		}
+		ret = append(ret, mp4Box{typ: string(b[4:8]), body: b[header:size]})
+		b = b[size:]
+	}
+	return ret
+}
+
+func findBox(b []byte, path ...string) []mp4Box {
+	boxes := readBoxes(b)
+	var ret []mp4Box
+	for _, v := range boxes {
+		if v.typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			ret = append(ret, v)
+			continue
+		}
+		ret = append(ret, findBox(v.body, path[1:]...)...)
+	}
+	return ret
+}
+
+func TestTsToMP4(t *testing.T) {
+	Convey("TestTsToMP4", t, func() {
+		sps := testSPS()
+		info, err := parseH264SPS(sps)
+		So(err, ShouldEqual, nil)
+		So(info, ShouldResemble, videoInfo{width: 640, height: 360})
+
+		pps := []byte{0x68, 0xCE, 0x38, 0x80}
+		startCode := []byte{0, 0, 0, 1}
+		b := &tsBuilder{cc: make(map[uint16]byte)}
+		b.tables()
+
+		const frames = 10
+		base := int64(1<<33) - 3000*4 // 时间戳在中途回绕
+		for i := 0; i < frames; i++ {
+			var au []byte
+			au = append(append(au, startCode...), 0x09, 0xF0)
+			nal := []byte{0x41, 0x9A, byte(i)}
+			if i == 0 {
+				au = append(append(append(au, startCode...), sps...), startCode...)
+				au = append(au, pps...)
+				nal = []byte{0x65, 0x88, 0x84}
+			}
+			au = append(append(au, startCode...), nal...)
+			dts := (base + int64(i)*3000) % (1 << 33)
+			pts := (dts + 6000) % (1 << 33)
+			b.packets(0x100, pesPacket(0xE0, pts, dts, au), false)
+
+			audio := append(adtsFrame(bytes.Repeat([]byte{byte(i)}, 300)), adtsFrame(bytes.Repeat([]byte{byte(i)}, 200))...)
+			b.packets(0x101, pesPacket(0xC0, (base+int64(i)*4180)%(1<<33), (base+int64(i)*4180)%(1<<33), audio), false)
+		}
+
+		path := filepath.Join(t.TempDir(), "out.mp4")
+		f, err := os.Create(path)
+		So(err, ShouldEqual, nil)
+		So(TsToMP4(f, bytes.NewReader(b.buf.Bytes())), ShouldEqual, nil)
+		So(f.Close(), ShouldEqual, nil)
+
+		out, err := os.ReadFile(path)
+		So(err, ShouldEqual, nil)
+		top := readBoxes(out)
+		So(len(top), ShouldEqual, 3)
+		So(top[0].typ, ShouldEqual, "ftyp")
+		So(top[1].typ, ShouldEqual, "mdat")
+		So(top[2].typ, ShouldEqual, "moov")
+
+		traks := findBox(out, "moov", "trak")
+		So(len(traks), ShouldEqual, 2)
+
+		tkhd := findBox(traks[0].body, "tkhd")[0].body
+		So(binary.BigEndian.Uint32(tkhd[len(tkhd)-8:])>>16, ShouldEqual, 640)
+		So(binary.BigEndian.Uint32(tkhd[len(tkhd)-4:])>>16, ShouldEqual, 360)
+
+		stsd := findBox(traks[0].body, "mdia", "minf", "stbl", "stsd")[0].body
+		So(string(stsd[12:16]), ShouldEqual, "avc1")
+		So(bytes.Contains(stsd, sps), ShouldBeTrue)
+
+		videoStsz := findBox(traks[0].body, "mdia", "minf", "stbl", "stsz")[0].body
+		So(binary.BigEndian.Uint32(videoStsz[8:]), ShouldEqual, frames)
+		// 长度前缀(4) + nal(3), 参数集和AUD被移除
+		So(binary.BigEndian.Uint32(videoStsz[12:]), ShouldEqual, 7)
+
+		stts := findBox(traks[0].body, "mdia", "minf", "stbl", "stts")[0].body
+		So(binary.BigEndian.Uint32(stts[4:]), ShouldEqual, 1)
+		So(binary.BigEndian.Uint32(stts[8:]), ShouldEqual, frames)
+		So(binary.BigEndian.Uint32(stts[12:]), ShouldEqual, 3000)
+		So(len(findBox(traks[0].body, "mdia", "minf", "stbl", "ctts")), ShouldEqual, 1)
+		So(len(findBox(traks[0].body, "mdia", "minf", "stbl", "stss")), ShouldEqual, 1)
+
+		audioStsd := findBox(traks[1].body, "mdia", "minf", "stbl", "stsd")[0].body
+		So(string(audioStsd[12:16]), ShouldEqual, "mp4a")
+		So(bytes.Contains(audioStsd, []byte{0x12, 0x10}), ShouldBeTrue) // AAC LC, 44100Hz, 2声道
+		audioStsz := findBox(traks[1].body, "mdia", "minf", "stbl", "stsz")[0].body
+		So(binary.BigEndian.Uint32(audioStsz[8:]), ShouldEqual, 2*frames)
+		So(binary.BigEndian.Uint32(audioStsz[12:]), ShouldEqual, 300)
+
+		// 样本偏移指向mdat中的数据
+		stco := findBox(traks[0].body, "mdia", "minf", "stbl", "stco")[0].body
+		first := binary.BigEndian.Uint32(stco[8:])
+		So(out[first:first+7], ShouldResemble, []byte{0, 0, 0, 3, 0x65, 0x88, 0x84})
+
+		So(TsToMP4(&seekBuffer{}, bytes.NewReader(nil)), ShouldEqual, ErrNoSupportedStream)
+
+		firstPTS, err := FirstPTS(bytes.NewReader(b.buf.Bytes()))
+		So(err, ShouldEqual, nil)
+		So(firstPTS, ShouldEqual, base)
+
+		// 字幕之间的空白使用空样本填充, 重叠的字幕被截断
+		sb := &seekBuffer{}
+		So(TsToMP4WithSubtitles(sb, []Subtitle{{Language: "en-US", Cues: []TextCue{
+			{Start: 100 * time.Millisecond, End: 500 * time.Millisecond, Text: "hi"},
+			{Start: 400 * time.Millisecond, End: 600 * time.Millisecond, Text: "there"},
+		}}}, bytes.NewReader(b.buf.Bytes())), ShouldEqual, nil)
+		traks = findBox(sb.b, "moov", "trak")
+		So(len(traks), ShouldEqual, 3)
+		So(string(findBox(traks[2].body, "mdia", "hdlr")[0].body[8:12]), ShouldEqual, "sbtl")
+		mdhd := findBox(traks[2].body, "mdia", "mdhd")[0].body
+		So(binary.BigEndian.Uint16(mdhd[len(mdhd)-4:]), ShouldEqual, packLanguage("eng"))
+		textStsz := findBox(traks[2].body, "mdia", "minf", "stbl", "stsz")[0].body
+		So(binary.BigEndian.Uint32(textStsz[8:]), ShouldEqual, 3)
+		So(binary.BigEndian.Uint32(textStsz[12:]), ShouldEqual, 2)
+		So(binary.BigEndian.Uint32(textStsz[16:]), ShouldEqual, 4)
+		textStts := findBox(traks[2].body, "mdia", "minf", "stbl", "stts")[0].body
+		So(binary.BigEndian.Uint32(textStts[4:]), ShouldEqual, 3)
+		So(binary.BigEndian.Uint32(textStts[12:]), ShouldEqual, 100)
+		So(binary.BigEndian.Uint32(textStts[20:]), ShouldEqual, 300)
+		So(binary.BigEndian.Uint32(textStts[28:]), ShouldEqual, 200)
+	})
+
+	Convey("TestParseH265SPS", t, func() {
+		w := &bitWriter{}
+		w.u(16, 0x4201)
+		w.u(4, 0)
+		w.u(3, 0) // sps_max_sub_layers_minus1
+		w.u(1, 1)
+		ptl := []byte{0x01, 0x60, 0, 0, 0, 0x90, 0, 0, 0, 0, 0, 93}
+		for _, v := range ptl {
+			w.u(8, uint32(v))
+		}
+		w.ue(0)    // sps_seq_parameter_set_id
+		w.ue(1)    // chroma_format_idc
+		w.ue(1920) // pic_width_in_luma_samples
+		w.ue(1088) // pic_height_in_luma_samples
+		w.u(1, 1)  // conformance_window_flag
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(4)
+		w.ue(2) // bit_depth_luma_minus8
+		w.ue(2)
+		w.u(1, 1)
+
+		info, err := parseH265SPS(w.b)
+		So(err, ShouldEqual, nil)
+		So(info.videoInfo, ShouldResemble, videoInfo{width: 1920, height: 1080})
+		So(info.ptl[:], ShouldResemble, ptl)
+		So(info.bitDepthLuma, ShouldEqual, 10)
+
+		conf := hvcC(info, [][]byte{{0x40, 0x01}}, [][]byte{w.b}, [][]byte{{0x44, 0x01}})
+		So(conf[1:13], ShouldResemble, ptl)
+		So(conf[16], ShouldEqual, 0xFD) // chroma_format_idc为1
+		So(conf[17], ShouldEqual, 0xFA) // 10bit
+		So(conf[22], ShouldEqual, 3)
+	})
+}
+
+type seekBuffer struct {
+	b   []byte
+	pos int
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if need := s.pos + len(p); need > len(s.b) {
+		s.b = append(s.b, make([]byte, need-len(s.b))...)
+	}
+	copy(s.b[s.pos:], p)
+	s.pos += len(p)
+	return len(p), nil
+}
+
+func (s *seekBuffer) Seek(offset int64, _ int) (int64, error) {
+	s.pos = int(offset)
+	return offset, nil
+}
+
+// sampleAESEncrypt 按照decryptBlocks相同的方式加密b中从idx开始的分组
+func sampleAESEncrypt(block cipher.Block, iv []byte, b []byte, idx []int) {
+	buf := make([]byte, 0, len(idx)*16)
+	for _, i := range idx {
+		buf = append(buf, b[i:i+16]...)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(buf, buf)
+	for j, i := range idx {
+		copy(b[i:i+16], buf[j*16:])
+	}
+}
+
+func TestDecryptSampleAES(t *testing.T) {
+	Convey("TestDecryptSampleAES", t, func() {
+		key := bytes.Repeat([]byte{0x11}, 16)
+		iv := bytes.Repeat([]byte{0x22}, 16)
+		block, err := aes.NewCipher(key)
+		So(err, ShouldEqual, nil)
+
+		// 明文slice, 包含需要防竞争字节的序列
+		slice := append([]byte{0x65}, bytes.Repeat([]byte{0x01, 0x02, 0x03, 0x04, 0x05}, 80)...)
+		copy(slice[50:], []byte{0, 0, 1})
+		encSlice := append([]byte{}, slice...)
+		var idx []int
+		for i := 32; i+16 <= len(encSlice); i += 160 {
+			idx = append(idx, i)
+		}
+		sampleAESEncrypt(block, iv, encSlice, idx)
+
+		sps := testSPS()
+		startCode := []byte{0, 0, 0, 1}
+		clearAU := append(append(append(append([]byte{}, startCode...), sps...), startCode...), escapeRBSP(slice)...)
+		encAU := append(append(append(append([]byte{}, startCode...), sps...), startCode...), escapeRBSP(encSlice)...)
+
+		audioPayload := bytes.Repeat([]byte{0x33, 0x44}, 150)
+		clearAudio := append(adtsFrame(audioPayload), adtsFrame(audioPayload[:20])...)
+		encAudio := append([]byte{}, clearAudio...)
+		idx = nil
+		for i := 16; i+16 <= len(audioPayload); i += 16 {
+			idx = append(idx, 7+i)
+		}
+		sampleAESEncrypt(block, iv, encAudio, idx)
+		So(encAudio, ShouldNotResemble, clearAudio)
+
+		b := &tsBuilder{cc: make(map[uint16]byte)}
+		b.packets(0, []byte{0x00, 0xB0, 13, 0, 1, 0xC1, 0, 0, 0, 1, 0xF0, 0x00, 0, 0, 0, 0}, true)
+		b.packets(0x1000, []byte{0x02, 0xB0, 23, 0, 1, 0xC1, 0, 0, 0xE1, 0x00, 0xF0, 0,
+			StreamTypeH264SampleAES, 0xE1, 0x00, 0xF0, 0,
+			StreamTypeAACSampleAES, 0xE1, 0x01, 0xF0, 0,
+			0, 0, 0, 0}, true)
+		b.packets(0x100, pesPacket(0xE0, 9000, 9000, encAU), false)
+		b.packets(0x101, pesPacket(0xC0, 9000, 9000, encAudio), false)
+
+		out, err := DecryptSampleAES(b.buf.Bytes(), key, iv)
+		So(err, ShouldEqual, nil)
+		So(len(out)%TsPacketSize, ShouldEqual, 0)
+		// 改写后的PMT的CRC仍然正确
+		So(crc32MPEG2(out[TsPacketSize+5:TsPacketSize+5+26]), ShouldEqual, 0)
+
+		r := NewTsReader(bytes.NewReader(out))
+		var got []*PES
+		for {
+			pes, err := r.ReadPES()
+			if err != nil {
+				break
+			}
+			got = append(got, pes)
+		}
+		So(r.Streams(), ShouldResemble, map[uint16]byte{0x100: StreamTypeH264, 0x101: StreamTypeAAC})
+		So(len(got), ShouldEqual, 2)
+		So(got[0].PTS, ShouldEqual, 9000)
+		So(got[0].Data, ShouldResemble, clearAU)
+		So(got[1].Data, ShouldResemble, clearAudio)
+
+		_, err = DecryptSampleAES(b.buf.Bytes(), key[:8], iv)
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+// cencFragment 生成cenc加密的fMP4媒体分片, 返回分片和其中的明文样本.
+// 第一个分片使用8字节IV和子样本, 第二个分片使用16字节IV, 样本整体加密且大小由tfhd指定
+func cencFragment(block cipher.Block, ivSize int) ([]byte, [][]byte) {
+	samples := [][]byte{bytes.Repeat([]byte{0x41}, 48), bytes.Repeat([]byte{0x42}, 48)}
+	subsamples := [][][2]int{{{10, 20}, {3, 15}}, {{0, 16}, {4, 28}}}
+	ivs := [][]byte{bytes.Repeat([]byte{1}, ivSize), bytes.Repeat([]byte{2}, ivSize)}
+
+	var mdat []byte
+	senc := u32(uint32(len(samples)))
+	for i, s := range samples {
+		enc := append([]byte{}, s...)
+		counter := make([]byte, aes.BlockSize)
+		copy(counter, ivs[i])
+		stream := cipher.NewCTR(block, counter)
+		senc = append(senc, ivs[i]...)
+		if ivSize == 8 {
+			// 各子样本的密文使用连续的密钥流
+			var protected []byte
+			pos := 0
+			for _, v := range subsamples[i] {
+				protected = append(protected, enc[pos+v[0]:pos+v[0]+v[1]]...)
+				pos += v[0] + v[1]
+			}
+			stream.XORKeyStream(protected, protected)
+			pos = 0
+			senc = append(senc, u16(uint16(len(subsamples[i])))...)
+			for _, v := range subsamples[i] {
+				pos += v[0]
+				copy(enc[pos:], protected[:v[1]])
+				protected = protected[v[1]:]
+				pos += v[1]
+				senc = append(senc, append(u16(uint16(v[0])), u32(uint32(v[1]))...)...)
+			}
+		} else {
+			stream.XORKeyStream(enc, enc)
+		}
+		mdat = append(mdat, enc...)
+	}
+
+	moof := func(dataOffset uint32) []byte {
+		tfhd := fullBox("tfhd", 0, 0x020000, u32(1))
+		trun := fullBox("trun", 0, 0x000201, u32(2), u32(dataOffset), u32(48), u32(48))
+		sencBox := fullBox("senc", 0, 0x2, senc)
+		if ivSize == 16 {
+			tfhd = fullBox("tfhd", 0, 0x020010, u32(1), u32(48))
+			trun = fullBox("trun", 0, 0x000001, u32(2), u32(dataOffset))
+			sencBox = box("uuid", sencUUID, []byte{0, 0, 0, 0}, senc)
+		}
+		return box("moof",
+			fullBox("mfhd", 0, 0, u32(1)),
+			box("traf", tfhd, box("tfdt", u32(0), u32(0)), trun, sencBox,
+				fullBox("saiz", 0, 0, []byte{0}, u32(2)), fullBox("saio", 0, 0, u32(1), u32(0))),
+		)
+	}
+	head := moof(0)
+	fragment := append(append(box("styp", []byte("msdh")), moof(uint32(len(head)+8))...), box("mdat", mdat)...)
+	return fragment, samples
+}
+
+func TestDecryptCENC(t *testing.T) {
+	Convey("TestDecryptCENC", t, func() {
+		key := bytes.Repeat([]byte{0x11}, 16)
+		block, err := aes.NewCipher(key)
+		So(err, ShouldEqual, nil)
+
+		for _, ivSize := range []int{8, 16} {
+			fragment, samples := cencFragment(block, ivSize)
+			size := len(fragment)
+			So(DecryptCENC(fragment, key), ShouldEqual, nil)
+			So(len(fragment), ShouldEqual, size)
+			So(bytes.HasSuffix(fragment, bytes.Join(samples, nil)), ShouldBeTrue)
+			// senc, saiz和saio被改写为free, 再次解密时不做任何处理
+			for _, typ := range []string{"senc", "uuid", "saiz", "saio"} {
+				So(bytes.Contains(fragment, []byte(typ)), ShouldBeFalse)
+			}
+			So(DecryptCENC(fragment, key), ShouldEqual, nil)
+			So(bytes.HasSuffix(fragment, bytes.Join(samples, nil)), ShouldBeTrue)
+		}
+
+		fragment, _ := cencFragment(block, 8)
+		So(DecryptCENC(fragment, key[:8]), ShouldNotEqual, nil)
+		So(DecryptCENC(fragment[:len(fragment)-10], key), ShouldNotEqual, nil)
+	})
+
+	Convey("TestClearCENCInit", t, func() {
+		sinf := box("sinf",
+			box("frma", []byte("avc1")),
+			fullBox("schm", 0, 0, []byte("cenc"), u32(0x10000)),
+			box("schi", fullBox("tenc", 0, 0, []byte{0, 0, 1, 8}, bytes.Repeat([]byte{9}, 16))),
+		)
+		encv := box("encv", make([]byte, 78), box("avcC", []byte{1, 2, 3}), sinf)
+		enca := box("enca", make([]byte, 28), box("esds", []byte{4}), box("sinf", box("frma", []byte("mp4a"))))
+		trak := func(entry []byte) []byte {
+			return box("trak", box("mdia", box("minf", box("stbl", fullBox("stsd", 0, 0, u32(1), entry)))))
+		}
+		init := append(box("ftyp", []byte("iso6")), box("moov", fullBox("pssh", 0, 0, make([]byte, 20)), trak(encv), trak(enca))...)
+		size := len(init)
+
+		So(ClearCENCInit(init), ShouldEqual, nil)
+		So(len(init), ShouldEqual, size)
+		for _, typ := range []string{"encv", "enca", "sinf", "pssh"} {
+			So(bytes.Contains(init, []byte(typ)), ShouldBeFalse)
+		}
+		So(bytes.Contains(init, append(u32(uint32(len(encv))), []byte("avc1")...)), ShouldBeTrue)
+		So(bytes.Contains(init, append(u32(uint32(len(enca))), []byte("mp4a")...)), ShouldBeTrue)
+
+		broken := append(box("ftyp", []byte("iso6")), box("moov", trak(box("encv", make([]byte, 78))))...)
+		So(ClearCENCInit(broken), ShouldNotEqual, nil)
+	})
+}
@@ -0,0 +1,396 @@
+package remux
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+)
+
+const (
+	sampleAESBlock = 16
+	// H.264 slice NAL单元前32字节不加密, 之后每160字节中的前16字节加密
+	sampleAESVideoLeader  = 32
+	sampleAESVideoPattern = 160
+	// 音频帧前16字节不加密
+	sampleAESAudioLeader = 16
+)
+
+// 加密流的stream_type对应的明文stream_type
+var sampleAESClearType = map[byte]byte{
+	StreamTypeH264SampleAES: StreamTypeH264,
+	StreamTypeAACSampleAES:  StreamTypeAAC,
+	StreamTypeAC3SampleAES:  StreamTypeAC3,
+}
+
+// DecryptSampleAES 使用clear key解密按照HLS SAMPLE-AES加密的MPEG-TS分片, 返回明文的MPEG-TS.
+// 支持H.264视频以及AAC和AC-3音频, PMT中加密流的stream_type被改写为对应的明文类型, 其余的包按原样输出.
+func DecryptSampleAES(ts []byte, key, iv []byte) ([]byte, error) {
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("sample-aes key length must be %d, got %d", aes.BlockSize, len(key))
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("sample-aes iv length must be %d, got %d", aes.BlockSize, len(iv))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher error, %w", err)
+	}
+
+	d := &sampleAESDecrypter{
+		block:   block,
+		iv:      iv,
+		pmtPids: make(map[uint16]bool),
+		streams: make(map[uint16]byte),
+		pending: make(map[uint16]*pendingPES),
+		cc:      make(map[uint16]byte),
+	}
+	for i := 0; i+TsPacketSize <= len(ts); {
+		if ts[i] != tsSyncByte {
+			i++
+			continue
+		}
+		if err = d.handlePacket(append([]byte{}, ts[i:i+TsPacketSize]...)); err != nil {
+			return nil, err
+		}
+		i += TsPacketSize
+	}
+	for _, pid := range d.order {
+		if err = d.flush(pid); err != nil {
+			return nil, err
+		}
+	}
+	return d.out.Bytes(), nil
+}
+
+type sampleAESDecrypter struct {
+	block   cipher.Block
+	iv      []byte
+	pmtPids map[uint16]bool
+	streams map[uint16]byte // 加密流的pid -> 加密的stream_type
+	pending map[uint16]*pendingPES
+	order   []uint16
+	cc      map[uint16]byte // 重新打包后各pid的continuity_counter
+	out     bytes.Buffer
+}
+
+// pendingPES 等待解密的PES及其第一个TS包中的PCR和随机访问标志
+type pendingPES struct {
+	data      []byte
+	pcr       []byte
+	randomAcc bool
+}
+
+func (d *sampleAESDecrypter) handlePacket(pkt []byte) error {
+	pusi := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+	afc := (pkt[3] >> 4) & 3
+	payload := pkt[4:]
+	var af []byte
+	if afc&2 != 0 {
+		n := int(payload[0]) + 1
+		if n > len(payload) {
+			return nil
+		}
+		af = payload[1:n]
+		payload = payload[n:]
+	}
+
+	switch {
+	case pid == patPid:
+		if pusi && afc&1 != 0 {
+			d.parsePAT(payload)
+		}
+	case d.pmtPids[pid]:
+		if pusi && afc&1 != 0 {
+			d.rewritePMT(payload)
+		}
+	default:
+		if _, ok := d.streams[pid]; !ok {
+			break
+		}
+		if pusi {
+			if err := d.flush(pid); err != nil {
+				return err
+			}
+			p := &pendingPES{}
+			if len(af) > 0 {
+				p.randomAcc = af[0]&0x40 != 0
+				if af[0]&0x10 != 0 && len(af) >= 7 {
+					p.pcr = append([]byte{}, af[1:7]...)
+				}
+			}
+			if afc&1 != 0 {
+				p.data = append(p.data, payload...)
+			}
+			d.pending[pid] = p
+		} else if p, ok := d.pending[pid]; ok && afc&1 != 0 {
+			p.data = append(p.data, payload...)
+		}
+		return nil
+	}
+	d.out.Write(pkt)
+	return nil
+}
+
+func (d *sampleAESDecrypter) parsePAT(payload []byte) {
+	s, ok := section(payload)
+	if !ok {
+		return
+	}
+	for i := 8; i+4 <= len(s)-4; i += 4 {
+		if program := uint16(s[i])<<8 | uint16(s[i+1]); program != 0 {
+			d.pmtPids[uint16(s[i+2]&0x1F)<<8|uint16(s[i+3])] = true
+		}
+	}
+}
+
+// rewritePMT 记录加密流并将其stream_type原地改写为明文类型, 然后重新计算CRC
+func (d *sampleAESDecrypter) rewritePMT(payload []byte) {
+	s, ok := section(payload)
+	if !ok || len(s) < 12 {
+		return
+	}
+	infoLen := int(s[10]&0x0F)<<8 | int(s[11])
+	changed := false
+	for i := 12 + infoLen; i+5 <= len(s)-4; {
+		pid := uint16(s[i+1]&0x1F)<<8 | uint16(s[i+2])
+		if clear, ok := sampleAESClearType[s[i]]; ok {
+			if _, ok := d.streams[pid]; !ok {
+				d.order = append(d.order, pid)
+			}
+			d.streams[pid] = s[i]
+			s[i] = clear
+			changed = true
+		}
+		i += 5 + (int(s[i+3]&0x0F)<<8 | int(s[i+4]))
+	}
+	if changed {
+		crc := crc32MPEG2(s[:len(s)-4])
+		s[len(s)-4], s[len(s)-3], s[len(s)-2], s[len(s)-1] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+	}
+}
+
+// flush 解密pid上等待中的PES并重新打包输出
+func (d *sampleAESDecrypter) flush(pid uint16) error {
+	p, ok := d.pending[pid]
+	if !ok {
+		return nil
+	}
+	delete(d.pending, pid)
+
+	b := p.data
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 || 9+int(b[8]) > len(b) {
+		return errors.New("sample-aes pes start code not found")
+	}
+	headerLen := 9 + int(b[8])
+	es := b[headerLen:]
+	if l := int(b[4])<<8 | int(b[5]); l > 0 && 6+l <= len(b) {
+		es = b[headerLen : 6+l]
+	}
+
+	var (
+		clear []byte
+		err   error
+	)
+	switch d.streams[pid] {
+	case StreamTypeH264SampleAES:
+		clear, err = d.decryptH264(es)
+	case StreamTypeAACSampleAES:
+		clear, err = d.decryptAudio(es, aacFrameLen)
+	case StreamTypeAC3SampleAES:
+		clear, err = d.decryptAudio(es, ac3FrameLen)
+	}
+	if err != nil {
+		return err
+	}
+
+	pes := append(append([]byte{}, b[:headerLen]...), clear...)
+	if l := len(pes) - 6; b[4] == 0 && b[5] == 0 || l > 0xFFFF {
+		pes[4], pes[5] = 0, 0
+	} else {
+		pes[4], pes[5] = byte(l>>8), byte(l)
+	}
+	d.packetize(pid, pes, p)
+	return nil
+}
+
+// decryptH264 解密类型为1和5且长度大于48字节的NAL单元, 解密前去除防竞争字节, 解密后重新插入
+func (d *sampleAESDecrypter) decryptH264(es []byte) ([]byte, error) {
+	var ret []byte
+	for _, nal := range splitNALUs(es) {
+		if t := nal[0] & 0x1F; (t == h264NalSlice || t == h264NalIDR) && len(nal) > sampleAESVideoLeader+sampleAESBlock {
+			nal = unescapeRBSP(nal)
+			var idx []int
+			for i := sampleAESVideoLeader; i+sampleAESBlock <= len(nal); i += sampleAESVideoPattern {
+				idx = append(idx, i)
+			}
+			d.decryptBlocks(nal, idx)
+			nal = escapeRBSP(nal)
+		}
+		ret = append(append(ret, 0, 0, 0, 1), nal...)
+	}
+	return ret, nil
+}
+
+// escapeRBSP 在连续两个0x00之后且不大于0x03的字节前插入防竞争字节0x03
+func escapeRBSP(b []byte) []byte {
+	ret := make([]byte, 0, len(b)+len(b)/64)
+	zeros := 0
+	for _, v := range b {
+		if zeros >= 2 && v <= 3 {
+			ret = append(ret, 3)
+			zeros = 0
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// decryptAudio 依次解密每个音频帧, 帧的前16字节之后的完整分组被加密
+func (d *sampleAESDecrypter) decryptAudio(es []byte, frameLen func([]byte) (int, int, error)) ([]byte, error) {
+	ret := append([]byte{}, es...)
+	for pos := 0; pos < len(ret); {
+		headerLen, n, err := frameLen(ret[pos:])
+		if err != nil {
+			return nil, err
+		}
+		if pos+n > len(ret) {
+			// 不完整的帧保持原样
+			break
+		}
+		frame := ret[pos+headerLen : pos+n]
+		var idx []int
+		for i := sampleAESAudioLeader; i+sampleAESBlock <= len(frame); i += sampleAESBlock {
+			idx = append(idx, i)
+		}
+		d.decryptBlocks(frame, idx)
+		pos += n
+	}
+	return ret, nil
+}
+
+// decryptBlocks 将b中从idx开始的16字节分组视为一条CBC链原地解密, IV在每个NAL单元或音频帧开始时重置
+func (d *sampleAESDecrypter) decryptBlocks(b []byte, idx []int) {
+	if len(idx) == 0 {
+		return
+	}
+	buf := make([]byte, 0, len(idx)*sampleAESBlock)
+	for _, i := range idx {
+		buf = append(buf, b[i:i+sampleAESBlock]...)
+	}
+	cipher.NewCBCDecrypter(d.block, d.iv).CryptBlocks(buf, buf)
+	for j, i := range idx {
+		copy(b[i:i+sampleAESBlock], buf[j*sampleAESBlock:])
+	}
+}
+
+// aacFrameLen 返回ADTS帧的头部长度和帧长度, AAC帧的ADTS头部不参与加密
+func aacFrameLen(b []byte) (int, int, error) {
+	h, err := parseADTS(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	return h.headerLen, h.frameLen, nil
+}
+
+// ac3FrameLen 返回AC-3同步帧的长度, 同步帧从同步字开始计算不加密的前16字节
+func ac3FrameLen(b []byte) (int, int, error) {
+	if len(b) < 5 || b[0] != 0x0B || b[1] != 0x77 {
+		return 0, 0, errors.New("ac-3 sync word not found")
+	}
+	fscod, frmsizecod := int(b[4]>>6), int(b[4]&0x3F)
+	if fscod > 2 || frmsizecod >= len(ac3FrameSizes) {
+		return 0, 0, fmt.Errorf("ac-3 frame size code 0x%x is illegal", b[4])
+	}
+	return 0, ac3FrameSizes[frmsizecod][fscod] * 2, nil
+}
+
+// AC-3同步帧的长度, 单位为16位字, 按frmsizecod和fscod(48k, 44.1k, 32k)索引
+var ac3FrameSizes = [][3]int{
+	{64, 69, 96}, {64, 70, 96}, {80, 87, 120}, {80, 88, 120}, {96, 104, 144}, {96, 105, 144},
+	{112, 121, 168}, {112, 122, 168}, {128, 139, 192}, {128, 140, 192}, {160, 174, 240}, {160, 175, 240},
+	{192, 208, 288}, {192, 209, 288}, {224, 243, 336}, {224, 244, 336}, {256, 278, 384}, {256, 279, 384},
+	{320, 348, 480}, {320, 349, 480}, {384, 417, 576}, {384, 418, 576}, {448, 487, 672}, {448, 488, 672},
+	{512, 557, 768}, {512, 558, 768}, {640, 696, 960}, {640, 697, 960}, {768, 835, 1152}, {768, 836, 1152},
+	{896, 975, 1344}, {896, 976, 1344}, {1024, 1114, 1536}, {1024, 1115, 1536}, {1152, 1253, 1728},
+	{1152, 1254, 1728}, {1280, 1393, 1920}, {1280, 1394, 1920},
+}
+
+// packetize 将PES重新切分为TS包, 第一个包中保留原有的PCR和随机访问标志, 最后一个包使用自适应字段填充
+func (d *sampleAESDecrypter) packetize(pid uint16, pes []byte, p *pendingPES) {
+	first := true
+	for len(pes) > 0 {
+		var af []byte
+		if first && (p.pcr != nil || p.randomAcc) {
+			flags := byte(0)
+			if p.randomAcc {
+				flags |= 0x40
+			}
+			af = []byte{flags}
+			if p.pcr != nil {
+				af[0] |= 0x10
+				af = append(af, p.pcr...)
+			}
+		}
+
+		room := TsPacketSize - 4
+		if af != nil {
+			room -= 1 + len(af)
+		}
+		if len(pes) < room {
+			// 使用自适应字段填充剩余空间
+			stuffing := room - len(pes)
+			if af == nil {
+				af = []byte{}
+				stuffing--
+				if stuffing > 0 {
+					af = append(af, 0)
+					stuffing--
+				}
+			}
+			af = append(af, bytes.Repeat([]byte{0xFF}, stuffing)...)
+			room = len(pes)
+		}
+
+		pkt := make([]byte, 4, TsPacketSize)
+		pkt[0] = tsSyncByte
+		pkt[1] = byte(pid>>8) & 0x1F
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+		pkt[3] = 0x10 | d.cc[pid]&0x0F
+		d.cc[pid]++
+		if af != nil {
+			pkt[3] |= 0x20
+			pkt = append(append(pkt, byte(len(af))), af...)
+		}
+		pkt = append(pkt, pes[:room]...)
+		d.out.Write(pkt)
+		pes = pes[room:]
+		first = false
+	}
+}
+
+// crc32MPEG2 计算PSI使用的CRC-32/MPEG-2
+func crc32MPEG2(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,157 @@
+package remux
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+const textTimescale = 1000
+
+// Subtitle 嵌入mp4的文本字幕轨道
+type Subtitle struct {
+	Language string    // ISO 639-1或639-2/T语言代码, 无法识别时写入und
+	Cues     []TextCue // 按开始时间排序, 时间相对影片起点
+}
+
+// TextCue 一条纯文本字幕
+type TextCue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// writeSubtitle 写入tx3g轨道, 字幕之间的空白使用空样本填充, 重叠的字幕在下一条开始时截断
+func writeSubtitle(m *mp4Writer, s Subtitle) error {
+	var (
+		t   *track
+		pos int64 // 单位为毫秒
+	)
+	for i, v := range s.Cues {
+		start, end := int64(v.Start/time.Millisecond), int64(v.End/time.Millisecond)
+		if start < pos {
+			start = pos
+		}
+		if i+1 < len(s.Cues) {
+			if next := int64(s.Cues[i+1].Start / time.Millisecond); next > start && next < end {
+				end = next
+			}
+		}
+		if end <= start {
+			continue
+		}
+
+		if t == nil {
+			t = &track{handler: "sbtl", timescale: textTimescale, entry: tx3gSampleEntry(), language: s.Language}
+			m.addTrack(t)
+		}
+		if start > pos {
+			if err := m.writeSample(t, u16(0), sample{duration: uint32(start - pos), sync: true}); err != nil {
+				return err
+			}
+		}
+		text := []byte(v.Text)
+		if err := m.writeSample(t, append(u16(uint16(len(text))), text...), sample{duration: uint32(end - start), sync: true}); err != nil {
+			return err
+		}
+		pos = end
+	}
+	return nil
+}
+
+func tx3gSampleEntry() []byte {
+	return box("tx3g",
+		make([]byte, 6), u16(1), // reserved, data_reference_index
+		u32(0),                                                                // displayFlags
+		[]byte{1, 0xFF},                                                       // 水平居中, 垂直居底
+		make([]byte, 4),                                                       // background-color-rgba
+		make([]byte, 8),                                                       // BoxRecord
+		u16(0), u16(0), u16(1), []byte{0, 18}, []byte{0xFF, 0xFF, 0xFF, 0xFF}, // StyleRecord
+		box("ftab", u16(1), u16(1), []byte{5}, []byte("Serif")),
+	)
+}
+
+// ISO 639-1到ISO 639-2/T
+var iso6391 = map[string]string{
+	"ar": "ara", "de": "deu", "en": "eng", "es": "spa", "fr": "fra", "hi": "hin", "id": "ind", "it": "ita",
+	"ja": "jpn", "ko": "kor", "nl": "nld", "pl": "pol", "pt": "por", "ru": "rus", "sv": "swe", "th": "tha",
+	"tr": "tur", "uk": "ukr", "vi": "vie", "zh": "zho",
+}
+
+// packLanguage 将语言代码打包为mdhd中的3个5位字符, 例如en-US打包为eng
+func packLanguage(lang string) uint16 {
+	lang = strings.ToLower(lang)
+	if pos := strings.IndexAny(lang, "-_"); pos >= 0 {
+		lang = lang[:pos]
+	}
+	if v, ok := iso6391[lang]; ok {
+		lang = v
+	}
+	if len(lang) != 3 || strings.Trim(lang, "abcdefghijklmnopqrstuvwxyz") != "" {
+		lang = "und"
+	}
+	return uint16(lang[0]-0x60)<<10 | uint16(lang[1]-0x60)<<5 | uint16(lang[2]-0x60)
+}
+
+// FirstPTS 返回所有输入中H.264/H.265视频和AAC音频最早的显示时间, 单位为1/90000秒, 与TsToMP4中轨道对齐的起点一致.
+// 每个输入只检查开始1秒内的PES.
+func FirstPTS(inputs ...io.Reader) (int64, error) {
+	var (
+		ret   int64
+		found bool
+	)
+	for _, in := range inputs {
+		var (
+			r        = NewTsReader(in)
+			first    int64
+			firstDTS int64
+			ok       bool
+		)
+		for {
+			pes, err := r.ReadPES()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+			switch pes.StreamType {
+			case StreamTypeH264, StreamTypeH265, StreamTypeAAC:
+			default:
+				continue
+			}
+			if !pes.HasPTS {
+				continue
+			}
+			if !ok {
+				first, firstDTS, ok = pes.PTS, pes.DTS, true
+				continue
+			}
+			if tsDiff(pes.DTS, firstDTS) > tsTimescale {
+				break
+			}
+			if tsDiff(pes.PTS, first) < 0 {
+				first = pes.PTS
+			}
+		}
+		if ok && (!found || tsDiff(first, ret) < 0) {
+			ret, found = first, true
+		}
+	}
+	if !found {
+		return 0, ErrNoSupportedStream
+	}
+	return ret, nil
+}
+
+// tsDiff 返回考虑33位回绕后a-b的值
+func tsDiff(a, b int64) int64 {
+	d := (a - b) % tsWrap
+	if d < 0 {
+		d += tsWrap
+	}
+	if d > tsWrap/2 {
+		d -= tsWrap
+	}
+	return d
+}
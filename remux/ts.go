@@ -0,0 +1,240 @@
+package remux
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	TsPacketSize = 188
+	tsSyncByte   = 0x47
+	patPid       = 0
+)
+
+// PMT中的stream_type
+const (
+	StreamTypeAAC           = 0x0F
+	StreamTypeH264          = 0x1B
+	StreamTypeH265          = 0x24
+	StreamTypeAC3           = 0x81
+	StreamTypeEAC3          = 0x87
+	StreamTypeH264SampleAES = 0xDB
+	StreamTypeAACSampleAES  = 0xCF
+	StreamTypeAC3SampleAES  = 0xC1
+)
+
+// PES 一个完整的PES包, PTS和DTS的单位为1/90000秒, 未携带DTS时DTS等于PTS
+type PES struct {
+	Pid        uint16
+	StreamType byte
+	StreamId   byte
+	PTS        int64
+	DTS        int64
+	HasPTS     bool
+	Data       []byte
+}
+
+// TsReader 从MPEG-TS流中依次读出各个基本流的PES包
+type TsReader struct {
+	r        *bufio.Reader
+	pmtPids  map[uint16]bool
+	streams  map[uint16]byte // pid -> stream_type
+	pending  map[uint16][]byte
+	order    []uint16 // 按首次出现顺序保存的pid
+	ready    []*PES
+	finished bool
+}
+
+func NewTsReader(r io.Reader) *TsReader {
+	return &TsReader{
+		r:       bufio.NewReaderSize(r, 64*TsPacketSize),
+		pmtPids: make(map[uint16]bool),
+		streams: make(map[uint16]byte),
+		pending: make(map[uint16][]byte),
+	}
+}
+
+// Streams 返回已经从PMT中解析出的基本流, key为pid, value为stream_type
+func (t *TsReader) Streams() map[uint16]byte {
+	return t.streams
+}
+
+// ReadPES 返回下一个完整的PES包, 流结束时返回io.EOF
+func (t *TsReader) ReadPES() (*PES, error) {
+	for len(t.ready) == 0 {
+		if t.finished {
+			return nil, io.EOF
+		}
+		pkt, err := t.readPacket()
+		if err == io.EOF {
+			t.finished = true
+			for _, pid := range t.order {
+				t.flush(pid)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.handlePacket(pkt)
+	}
+	ret := t.ready[0]
+	t.ready = t.ready[1:]
+	return ret, nil
+}
+
+func (t *TsReader) readPacket() ([]byte, error) {
+	pkt := make([]byte, TsPacketSize)
+	for {
+		b, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != tsSyncByte {
+			continue // 失去同步时逐字节查找同步字节
+		}
+		pkt[0] = b
+		if _, err = io.ReadFull(t.r, pkt[1:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		return pkt, nil
+	}
+}
+
+func (t *TsReader) handlePacket(pkt []byte) {
+	pusi := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+	afc := (pkt[3] >> 4) & 3
+	payload := pkt[4:]
+	if afc&2 != 0 {
+		n := int(payload[0]) + 1
+		if n > len(payload) {
+			return
+		}
+		payload = payload[n:]
+	}
+	if afc&1 == 0 {
+		return
+	}
+
+	switch {
+	case pid == patPid:
+		if pusi {
+			t.parsePAT(payload)
+		}
+	case t.pmtPids[pid]:
+		if pusi {
+			t.parsePMT(payload)
+		}
+	default:
+		if _, ok := t.streams[pid]; !ok {
+			return
+		}
+		if pusi {
+			t.flush(pid)
+			t.pending[pid] = append([]byte{}, payload...)
+			return
+		}
+		if buf, ok := t.pending[pid]; ok {
+			t.pending[pid] = append(buf, payload...)
+		}
+	}
+}
+
+// section 跳过pointer_field, 返回section及其长度是否合法
+func section(payload []byte) ([]byte, bool) {
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil, false
+	}
+	s := payload[int(payload[0])+1:]
+	if len(s) < 3 {
+		return nil, false
+	}
+	l := int(s[1]&0x0F)<<8 | int(s[2])
+	if 3+l > len(s) || l < 9 {
+		return nil, false
+	}
+	return s[:3+l], true
+}
+
+func (t *TsReader) parsePAT(payload []byte) {
+	s, ok := section(payload)
+	if !ok {
+		return
+	}
+	// 跳过8字节头部和4字节CRC
+	for i := 8; i+4 <= len(s)-4; i += 4 {
+		program := uint16(s[i])<<8 | uint16(s[i+1])
+		if program == 0 {
+			continue
+		}
+		t.pmtPids[uint16(s[i+2]&0x1F)<<8|uint16(s[i+3])] = true
+	}
+}
+
+func (t *TsReader) parsePMT(payload []byte) {
+	s, ok := section(payload)
+	if !ok || len(s) < 12 {
+		return
+	}
+	infoLen := int(s[10]&0x0F)<<8 | int(s[11])
+	for i := 12 + infoLen; i+5 <= len(s)-4; {
+		streamType := s[i]
+		pid := uint16(s[i+1]&0x1F)<<8 | uint16(s[i+2])
+		esInfoLen := int(s[i+3]&0x0F)<<8 | int(s[i+4])
+		if _, ok := t.streams[pid]; !ok {
+			t.order = append(t.order, pid)
+		}
+		t.streams[pid] = streamType
+		i += 5 + esInfoLen
+	}
+}
+
+func (t *TsReader) flush(pid uint16) {
+	buf, ok := t.pending[pid]
+	if !ok {
+		return
+	}
+	delete(t.pending, pid)
+	pes, err := parsePES(buf)
+	if err != nil {
+		return
+	}
+	pes.Pid = pid
+	pes.StreamType = t.streams[pid]
+	t.ready = append(t.ready, pes)
+}
+
+func parsePES(b []byte) (*PES, error) {
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return nil, errors.New("pes start code not found")
+	}
+	ret := &PES{StreamId: b[3]}
+	headerLen := int(b[8])
+	if 9+headerLen > len(b) {
+		return nil, fmt.Errorf("pes header length %d is illegal", headerLen)
+	}
+	flags := b[7] >> 6
+	if flags&2 != 0 && headerLen >= 5 {
+		ret.PTS = readTimestamp(b[9:])
+		ret.DTS = ret.PTS
+		ret.HasPTS = true
+	}
+	if flags == 3 && headerLen >= 10 {
+		ret.DTS = readTimestamp(b[14:])
+	}
+	ret.Data = b[9+headerLen:]
+	if l := int(b[4])<<8 | int(b[5]); l > 0 && 6+l <= len(b) {
+		ret.Data = b[9+headerLen : 6+l]
+	}
+	return ret, nil
+}
+
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
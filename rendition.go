@@ -0,0 +1,205 @@
+package m3u8
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Rendition 选中并下载的备选媒体及其媒体播放列表
+type Rendition struct {
+	Media
+	M3u8 *M3u8
+}
+
+// RenditionResult 一个备选媒体的下载结果
+type RenditionResult struct {
+	Media
+	Segments       []Segment
+	MergedFilePath string
+}
+
+// DefaultRenditions Option.ChooseMedia为nil时使用, 选择码流音频组中DEFAULT=YES的音频,
+// 没有时依次选择AUTOSELECT=YES的音频和音频组中的第一个音频
+func DefaultRenditions(play PlayInfo, medias []Media) []Media {
+	group := groupMedias(play.Audio, MediaTypeAudio, medias)
+	for _, v := range group {
+		if v.Default {
+			return []Media{v}
+		}
+	}
+	for _, v := range group {
+		if v.AutoSelect {
+			return []Media{v}
+		}
+	}
+	if len(group) > 0 {
+		return group[:1]
+	}
+	return nil
+}
+
+// AllAudioRenditions 选择码流音频组中的所有音频
+func AllAudioRenditions(play PlayInfo, medias []Media) []Media {
+	return groupMedias(play.Audio, MediaTypeAudio, medias)
+}
+
+// AudioRenditionsByLanguage 返回按照LANGUAGE选择码流音频组中音频的ChooseMedia, 语言不区分大小写,
+// 没有音频匹配时使用DefaultRenditions
+func AudioRenditionsByLanguage(langs ...string) func(PlayInfo, []Media) []Media {
+	return func(play PlayInfo, medias []Media) []Media {
+		var ret []Media
+		for _, v := range groupMedias(play.Audio, MediaTypeAudio, medias) {
+			for _, lang := range langs {
+				if strings.EqualFold(v.Language, lang) {
+					ret = append(ret, v)
+					break
+				}
+			}
+		}
+		if len(ret) == 0 {
+			return DefaultRenditions(play, medias)
+		}
+		return ret
+	}
+}
+
+// AllSubtitleRenditions 选择码流字幕组中的所有字幕
+func AllSubtitleRenditions(play PlayInfo, medias []Media) []Media {
+	return groupMedias(play.Subtitles, MediaTypeSubtitles, medias)
+}
+
+// CombineRenditions 返回依次使用fns选择备选媒体并合并结果的ChooseMedia,
+// 例如CombineRenditions(DefaultRenditions, AllSubtitleRenditions)选择默认音频和所有字幕
+func CombineRenditions(fns ...func(PlayInfo, []Media) []Media) func(PlayInfo, []Media) []Media {
+	return func(play PlayInfo, medias []Media) []Media {
+		var ret []Media
+		for _, fn := range fns {
+			ret = append(ret, fn(play, medias)...)
+		}
+		return ret
+	}
+}
+
+// groupMedias 返回组内带有URI的备选媒体, 没有URI的媒体包含在码流中无需单独下载
+func groupMedias(groupId string, typ string, medias []Media) []Media {
+	if groupId == "" {
+		return nil
+	}
+	var ret []Media
+	for _, v := range medias {
+		if v.Type == typ && v.GroupId == groupId && v.Url != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// newRendition 创建下载备选媒体的子下载器, 子下载器与主下载器共享协程池, 限流器, 停止信号和事件chan
+func (md *m3u8Downloader) newRendition(media Media, idx int) *m3u8Downloader {
+	return &m3u8Downloader{
+		gp:                  md.gp,
+		qpsLimit:            md.qpsLimit,
+		doMerge:             true,
+		mirror:              md.mirror,
+		mirrorDecrypt:       md.mirrorDecrypt,
+		removeSubTs:         md.removeSubTs,
+		subtitleFormat:      md.subtitleFormat,
+		fileDir:             md.fileDir,
+		tsFilePrefix:        fmt.Sprintf("%s_%s_%d", md.tsFilePrefix, strings.ToLower(media.Type), idx),
+		stopSignalChan:      md.stopSignalChan,
+		httpRequestCallback: md.httpRequestCallback,
+		retry:               md.retry,
+		client:              md.client,
+		allowFile:           md.allowFile,
+		live:                md.live,
+		imports:             md.imports,
+		resume:              md.resume,
+		cp:                  &checkpointWriter{},
+		keys:                md.keys,
+		keyProvider:         md.keyProvider,
+		inits:               make(map[string]*initSegment),
+		media:               &media,
+	}
+}
+
+// loadRenditions 获取并解析选中的备选媒体的媒体播放列表
+func (md *m3u8Downloader) loadRenditions(ctx context.Context) error {
+	var (
+		wg         sync.WaitGroup
+		renditions = make([]*m3u8Downloader, len(md.medias))
+		errs       = make([]error, len(md.medias))
+	)
+	// 通过协程池并发获取备选媒体的媒体播放列表
+	for i, v := range md.medias {
+		i, v := i, v
+		renditions[i] = md.newRendition(v, i)
+		wg.Add(1)
+		if _, err := md.gp.AddTask(func() {
+			defer wg.Done()
+			if err := renditions[i].load(ctx, v.Url); err != nil {
+				errs[i] = fmt.Errorf("load %s rendition %s error, %w", v.Type, v.Name, err)
+			}
+		}, nil, true); err != nil {
+			wg.Done()
+			errs[i] = err
+			break
+		}
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	md.renditions = renditions
+	return nil
+}
+
+// fmp4Mux 返回转换为mp4时是否需要将fMP4与其他输入合并, 内置remux只支持ts, 此时只能使用ffmpeg
+func (md *m3u8Downloader) fmp4Mux() bool {
+	fmp4, inputs := md.fmp4, 1
+	for _, r := range md.renditions {
+		switch {
+		case r.muxable():
+			fmp4 = fmp4 || r.fmp4
+			inputs++
+		case r.isSubtitles() && md.embedSubtitles:
+			inputs++
+		}
+	}
+	return fmp4 && inputs > 1
+}
+
+// muxable 返回备选媒体是否需要与主码流合并到同一个mp4中
+func (md *m3u8Downloader) muxable() bool {
+	return md.media.Type == MediaTypeAudio || md.media.Type == MediaTypeVideo
+}
+
+func (md *m3u8Downloader) totalCnt() int {
+	ret := md.segmentCnt()
+	for _, r := range md.renditions {
+		ret += r.segmentCnt()
+	}
+	return ret
+}
+
+func (md *m3u8Downloader) completeCnt() int {
+	ret := int(atomic.LoadInt32(&md.doneCnt))
+	for _, r := range md.renditions {
+		ret += int(atomic.LoadInt32(&r.doneCnt))
+	}
+	return ret
+}
+
+func (md *m3u8Downloader) renditionList() []Rendition {
+	var ret []Rendition
+	for _, r := range md.renditions {
+		r.segLock.RLock()
+		ret = append(ret, Rendition{Media: *r.media, M3u8: r.m3u8Copy.Common.Copy()})
+		r.segLock.RUnlock()
+	}
+	return ret
+}
@@ -0,0 +1,118 @@
+package m3u8
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRenditions(t *testing.T) {
+	Convey("TestRenditions", t, func() {
+		p, err := Parse([]byte(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",AUTOSELECT=YES,URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="fr",NAME="Français",DEFAULT=YES,URI="audio/fr.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="de",NAME="Deutsch"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="ac3",LANGUAGE="en",NAME="English",URI="ac3/en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",LANGUAGE="en",NAME="English",URI="subs/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,AUDIO="aac",SUBTITLES="subs"
+720p.m3u8`), "http://example.com/master.m3u8")
+		So(err, ShouldEqual, nil)
+		So(len(p.MediaList), ShouldEqual, 5)
+		So(p.MediaList[1], ShouldResemble, Media{
+			Type:     MediaTypeAudio,
+			GroupId:  "aac",
+			Language: "fr",
+			Name:     "Français",
+			Default:  true,
+			Url:      "http://example.com/audio/fr.m3u8",
+		})
+		So(p.MediaList[2].Url, ShouldEqual, "")
+
+		play := p.MastPlayList[0]
+		names := func(medias []Media) []string {
+			var ret []string
+			for _, v := range medias {
+				ret = append(ret, v.Name)
+			}
+			return ret
+		}
+		So(names(DefaultRenditions(play, p.MediaList)), ShouldResemble, []string{"Français"})
+		So(names(AllAudioRenditions(play, p.MediaList)), ShouldResemble, []string{"English", "Français"})
+		So(names(AudioRenditionsByLanguage("EN")(play, p.MediaList)), ShouldResemble, []string{"English"})
+		So(names(AudioRenditionsByLanguage("ja")(play, p.MediaList)), ShouldResemble, []string{"Français"})
+		So(DefaultRenditions(PlayInfo{}, p.MediaList), ShouldBeEmpty)
+
+		_, err = Parse([]byte("#EXTM3U\n#EXT-X-MEDIA:TYPE=TEXT,GROUP-ID=\"a\",NAME=\"b\"\n"), "http://example.com/master.m3u8")
+		So(err, ShouldNotEqual, nil)
+		_, err = Parse([]byte("#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,NAME=\"b\"\n"), "http://example.com/master.m3u8")
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestLoadRenditions(t *testing.T) {
+	Convey("TestLoadRenditions", t, func() {
+		var (
+			requests int32
+			arrived  = make(chan struct{})
+			fmp4     bool
+		)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/master.m3u8":
+				fmt.Fprint(w, "#EXTM3U\n")
+				for _, lang := range []string{"en", "fr"} {
+					fmt.Fprintf(w, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",LANGUAGE=\"%s\",NAME=\"%s\",URI=\"audio/%s.m3u8\"\n", lang, lang, lang)
+				}
+				fmt.Fprint(w, "#EXT-X-STREAM-INF:BANDWIDTH=100,AUDIO=\"aac\"\nvideo.m3u8\n")
+			case r.URL.Path == "/video.m3u8":
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n")
+				if fmp4 {
+					fmt.Fprint(w, "#EXT-X-MAP:URI=\"init.mp4\"\n")
+				}
+				fmt.Fprint(w, "#EXTINF:2,\n0.ts\n#EXT-X-ENDLIST\n")
+			case strings.HasPrefix(r.URL.Path, "/audio/"):
+				// 两个备选媒体的播放列表都被请求后才返回, 串行获取时第一个请求超时
+				if atomic.AddInt32(&requests, 1) == 2 {
+					close(arrived)
+				}
+				select {
+				case <-arrived:
+				case <-time.After(5 * time.Second):
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\na.ts\n#EXT-X-ENDLIST\n")
+			default:
+				fmt.Fprint(w, r.URL.Path)
+			}
+		}))
+		defer s.Close()
+
+		opt := NewDefaultOption(s.URL+"/master.m3u8", ModelMerged, t.TempDir(), "out", 4)
+		opt.ChooseMedia = AllAudioRenditions
+		opt.RetryPolicy = RetryPolicy{MaxAttempts: 1}
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+		st.Shutdown()
+		<-st.Done()
+		renditions := st.M3u8().Renditions
+		So(len(renditions), ShouldEqual, 2)
+		// 保持ChooseMedia返回的顺序
+		So(renditions[0].Language, ShouldEqual, "en")
+		So(renditions[1].Language, ShouldEqual, "fr")
+
+		// 内置remux无法将fMP4与备选媒体合并, 下载前返回错误
+		fmp4, requests, arrived = true, 0, make(chan struct{})
+		opt = NewDefaultOption(s.URL+"/master.m3u8", ModelConvertToMP4, t.TempDir(), "out", 4)
+		opt.ChooseMedia, opt.MP4Backend = AllAudioRenditions, MP4BackendNative
+		_, err = DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, errFMP4NeedFFmpeg)
+	})
+}
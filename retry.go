@@ -0,0 +1,162 @@
+package m3u8
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxAttempts = 10
+	defaultBaseDelay   = 500 * time.Millisecond
+	defaultMaxDelay    = 10 * time.Second
+)
+
+// RetryPolicy 请求播放列表, 秘钥, 分片和初始化分片失败时的重试策略, 零值使用默认值.
+// 第n次重试前等待min(BaseDelay*2^(n-1), MaxDelay), 实际等待时间在其一半到全部之间随机,
+// 响应带有Retry-After时按Retry-After等待, Retry-After超出MaxDelay或剩余的MaxElapsed时不再重试, 直接返回*StatusError.
+type RetryPolicy struct {
+	// MaxAttempts 最多请求的次数, 包括第一次请求, 默认为10
+	MaxAttempts int
+	// BaseDelay 第一次重试前的等待时间, 默认为500ms
+	BaseDelay time.Duration
+	// MaxDelay 两次请求之间等待时间的上限, 默认为10s
+	MaxDelay time.Duration
+	// MaxElapsed 从第一次请求开始的最长重试时间, 下一次重试会超出时不再重试, 为0表示不限制
+	MaxElapsed time.Duration
+	// RetryStatus 判断响应状态码为statusCode时是否重试, 为nil时使用DefaultRetryStatus
+	RetryStatus func(statusCode int) bool
+}
+
+// DefaultRetryStatus 仅重试408, 425, 429和5xx, 其余状态码(如403, 404)视为永久失败
+func DefaultRetryStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	}
+	return statusCode >= 500
+}
+
+// StatusError 响应的状态码不是200或者206
+type StatusError struct {
+	Url        string
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // 响应头Retry-After指定的等待时间, 未指定时为0
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("http get %s response StatusCode is %d, Status is %s", e.Url, e.StatusCode, e.Status)
+}
+
+// PermanentError 不会被重试的错误, KeyProvider可以返回Permanent(err)使获取秘钥立即失败
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent 将err包装为PermanentError, err为nil时返回nil
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultMaxDelay
+	}
+	if p.RetryStatus == nil {
+		p.RetryStatus = DefaultRetryStatus
+	}
+	return p
+}
+
+// do 执行f直到成功, 遇到不可重试的错误, 次数或时间用尽, 或者ctx结束, 返回最后一次的错误
+func (p RetryPolicy) do(ctx context.Context, f func() error) error {
+	p = p.withDefaults()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= p.MaxAttempts || ctx.Err() != nil || !p.retryable(err) {
+			return err
+		}
+
+		wait := p.backoff(attempt, err)
+		// 只有Retry-After会超出MaxDelay, 此时服务端要求的等待时间过长, 由调用方决定何时再次请求
+		if wait > p.MaxDelay || (p.MaxElapsed > 0 && time.Since(start)+wait > p.MaxElapsed) {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	var pe *PermanentError
+	if errors.As(err, &pe) || isDecryptError(err) {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return p.RetryStatus(se.StatusCode)
+	}
+	return true
+}
+
+// backoff 返回第attempt次请求失败后的等待时间, 响应带有Retry-After时返回Retry-After
+func (p RetryPolicy) backoff(attempt int, err error) time.Duration {
+	var se *StatusError
+	if errors.As(err, &se) && se.RetryAfter > 0 {
+		return se.RetryAfter
+	}
+	d := p.MaxDelay
+	if attempt <= 30 && p.BaseDelay<<(attempt-1) < p.MaxDelay {
+		d = p.BaseDelay << (attempt - 1)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter 解析响应头Retry-After, 取值为秒数或者HTTP日期, 不合法时返回0
+func parseRetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+package m3u8
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	Convey("TestRetryPolicy", t, func() {
+		fast := RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+		Convey("status", func() {
+			var hits int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&hits, 1)
+				switch r.URL.Path {
+				case "/404":
+					w.WriteHeader(http.StatusNotFound)
+				case "/503":
+					if n == 1 {
+						w.Header().Set("Retry-After", "1")
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					_, _ = w.Write([]byte("ok"))
+				}
+			}))
+			defer s.Close()
+
+			md := &m3u8Downloader{retry: fast}
+			err := md.retryFetch(context.Background(), func() error {
+				_, err := md.httpGet(context.Background(), s.URL+"/404")
+				return err
+			})
+			var se *StatusError
+			So(errors.As(err, &se), ShouldBeTrue)
+			So(se.StatusCode, ShouldEqual, http.StatusNotFound)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+
+			// 按Retry-After等待后重试
+			atomic.StoreInt32(&hits, 0)
+			md.retry.MaxDelay = 2 * time.Second
+			start := time.Now()
+			var body []byte
+			err = md.retryFetch(context.Background(), func() (err error) {
+				body, err = md.httpGet(context.Background(), s.URL+"/503")
+				return err
+			})
+			So(err, ShouldEqual, nil)
+			So(string(body), ShouldEqual, "ok")
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+
+			// Retry-After超出MaxDelay时不再重试, 返回StatusError
+			atomic.StoreInt32(&hits, 0)
+			md.retry.MaxDelay = time.Millisecond
+			start = time.Now()
+			err = md.retryFetch(context.Background(), func() (err error) {
+				body, err = md.httpGet(context.Background(), s.URL+"/503")
+				return err
+			})
+			So(errors.As(err, &se), ShouldBeTrue)
+			So(se.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			So(se.RetryAfter, ShouldEqual, time.Second)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+
+			// Retry-After超出MaxElapsed时不再等待
+			atomic.StoreInt32(&hits, 0)
+			md.retry.MaxDelay = 2 * time.Second
+			md.retry.MaxElapsed = 100 * time.Millisecond
+			err = md.retryFetch(context.Background(), func() error {
+				_, err := md.httpGet(context.Background(), s.URL+"/503")
+				return err
+			})
+			So(errors.As(err, &se), ShouldBeTrue)
+			So(se.RetryAfter, ShouldEqual, time.Second)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+
+		Convey("attempts", func() {
+			var calls int
+			p := fast
+			p.MaxAttempts = 3
+			err := p.do(context.Background(), func() error {
+				calls++
+				return errors.New("timeout")
+			})
+			So(err, ShouldNotEqual, nil)
+			So(calls, ShouldEqual, 3)
+
+			calls = 0
+			err = p.do(context.Background(), func() error {
+				calls++
+				return Permanent(errors.New("no such key"))
+			})
+			So(err.Error(), ShouldEqual, "no such key")
+			So(calls, ShouldEqual, 1)
+
+			calls = 0
+			p.RetryStatus = func(int) bool { return true }
+			err = p.do(context.Background(), func() error {
+				calls++
+				return &StatusError{StatusCode: http.StatusNotFound}
+			})
+			So(calls, ShouldEqual, 3)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			calls = 0
+			_ = p.do(ctx, func() error {
+				calls++
+				return errors.New("timeout")
+			})
+			So(calls, ShouldEqual, 1)
+		})
+
+		Convey("backoff", func() {
+			p := RetryPolicy{}.withDefaults()
+			for attempt := 1; attempt <= 40; attempt++ {
+				d := p.backoff(attempt, errors.New("timeout"))
+				So(d, ShouldBeLessThanOrEqualTo, p.MaxDelay)
+				So(d, ShouldBeGreaterThanOrEqualTo, p.BaseDelay/2)
+			}
+			So(p.backoff(1, &StatusError{RetryAfter: time.Second}), ShouldEqual, time.Second)
+			So(p.backoff(1, &StatusError{RetryAfter: time.Hour}), ShouldEqual, time.Hour)
+		})
+
+		Convey("retry after", func() {
+			So(parseRetryAfter("120"), ShouldEqual, 2*time.Minute)
+			So(parseRetryAfter(""), ShouldEqual, 0)
+			So(parseRetryAfter("abc"), ShouldEqual, 0)
+			d := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+			So(d, ShouldBeGreaterThan, 59*time.Minute)
+			So(DefaultRetryStatus(http.StatusForbidden), ShouldBeFalse)
+			So(DefaultRetryStatus(http.StatusTooManyRequests), ShouldBeTrue)
+			So(DefaultRetryStatus(http.StatusBadGateway), ShouldBeTrue)
+		})
+	})
+}
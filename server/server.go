@@ -0,0 +1,435 @@
+// Package server 将上游的HLS代理为本地的HLS服务, 播放列表中的分片, 初始化分片, 秘钥和子播放列表的地址被改写为指向代理自身,
+// 上游请求复用m3u8.Fetcher的限流, HttpRequestCallback和解密逻辑, 分片和初始化分片缓存在磁盘上.
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gogokit/m3u8"
+)
+
+const (
+	// importsSize 最多记录的媒体播放列表导入的变量数, 地址中带有会变化的token时媒体播放列表的地址不断增加
+	importsSize = 1024
+
+	indexPath    = "index.m3u8"
+	playlistPath = "playlist.m3u8"
+	segmentPath  = "segment"
+	initPath     = "init.mp4"
+	keyPath      = "key"
+)
+
+type Option struct {
+	// M3u8Url 上游的播放列表地址, 通过index.m3u8访问
+	M3u8Url string
+	// CacheDir 分片和初始化分片的缓存目录, 为空时不缓存
+	CacheDir string
+	// Decrypt为true时代理返回解密后的分片, 播放列表中不再包含EXT-X-KEY
+	Decrypt bool
+	// Fetch 上游请求使用的选项, 其中的Qps, HttpRequestCallback, KeyProvider, KeyTTL, RetryPolicy和HTTPClient生效
+	Fetch m3u8.Option
+	// Secret 签名改写后的地址使用的秘钥, 为空时随机生成, 此时重启后之前返回的播放列表中的地址失效
+	Secret []byte
+}
+
+// Handler 代理上游HLS的http.Handler, 可以挂载在任意路径下, 改写后的地址都是相对地址.
+// 改写后的地址带有签名, 只代理Handler自身改写过的地址, 其他地址返回403.
+// 多个客户端同时请求同一个资源时只会请求一次上游.
+type Handler struct {
+	upstream string
+	secret   []byte
+	cacheDir string
+	decrypt  bool
+	fetcher  *m3u8.Fetcher
+	lock     sync.Mutex
+	calls    map[string]*call
+	imports  *importCache // 媒体播放列表地址 -> 主播放列表定义的变量, 供EXT-X-DEFINE导入
+}
+
+// call 正在进行中的上游请求
+type call struct {
+	done    chan struct{}
+	body    []byte
+	err     error
+	waiters int // 等待结果的请求数, 全部取消后取消上游请求
+	cancel  context.CancelFunc
+}
+
+// importCache 按最近使用淘汰的媒体播放列表地址到主播放列表定义的变量的映射, 由Handler.lock保护
+type importCache struct {
+	lru     *list.List // 最近使用的在前
+	entries map[string]*list.Element
+}
+
+type importEntry struct {
+	url  string
+	vars map[string]string
+}
+
+func newImportCache() *importCache {
+	return &importCache{lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *importCache) get(u string) map[string]string {
+	e, ok := c.entries[u]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*importEntry).vars
+}
+
+func (c *importCache) set(u string, vars map[string]string) {
+	if e, ok := c.entries[u]; ok {
+		e.Value.(*importEntry).vars = vars
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[u] = c.lru.PushFront(&importEntry{url: u, vars: vars})
+	if c.lru.Len() > importsSize {
+		delete(c.entries, c.lru.Remove(c.lru.Back()).(*importEntry).url)
+	}
+}
+
+func NewHandler(opt Option) (*Handler, error) {
+	if opt.M3u8Url == "" {
+		return nil, errors.New("m3u8 url is empty")
+	}
+	if opt.CacheDir != "" {
+		if err := os.MkdirAll(opt.CacheDir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("os.MkdirAll %s error, %w", opt.CacheDir, err)
+		}
+	}
+	secret := opt.Secret
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generate secret error, %w", err)
+		}
+	}
+	return &Handler{
+		upstream: opt.M3u8Url,
+		secret:   secret,
+		cacheDir: opt.CacheDir,
+		decrypt:  opt.Decrypt,
+		fetcher:  m3u8.NewFetcher(opt.Fetch),
+		calls:    make(map[string]*call),
+		imports:  newImportCache(),
+	}, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	switch path.Base(r.URL.Path) {
+	case playlistPath, segmentPath, initPath, keyPath:
+		// 只代理改写时签名过的地址, 避免被当作任意地址的开放代理
+		if !h.verify(q) {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+	}
+	// 地址来自请求参数, 上游不是本地文件时不允许通过file:读取代理所在机器的文件
+	for _, k := range []string{"u", "k"} {
+		if isFileUrl(q.Get(k)) && !isFileUrl(h.upstream) {
+			http.Error(w, "file url is not allowed", http.StatusForbidden)
+			return
+		}
+	}
+	var (
+		body        []byte
+		contentType string
+		err         error
+	)
+	switch path.Base(r.URL.Path) {
+	case indexPath:
+		body, err = h.playlist(r.Context(), h.upstream)
+		contentType = "application/vnd.apple.mpegurl"
+	case playlistPath:
+		body, err = h.playlist(r.Context(), q.Get("u"))
+		contentType = "application/vnd.apple.mpegurl"
+	case segmentPath:
+		var seg m3u8.Segment
+		if seg, err = decodeSegment(q); err == nil {
+			body, err = h.cached(r.Context(), segmentPath, q, func(ctx context.Context) ([]byte, error) {
+				return h.fetcher.Segment(ctx, seg, h.decrypt)
+			})
+		}
+		contentType = segmentContentType(q)
+	case initPath:
+		var seg m3u8.Segment
+		if seg, err = decodeSegment(q); err == nil {
+			body, err = h.cached(r.Context(), initPath, q, func(ctx context.Context) ([]byte, error) {
+				return h.fetcher.Init(ctx, seg, h.decrypt)
+			})
+		}
+		contentType = "video/mp4"
+	case keyPath:
+		var seg m3u8.Segment
+		if seg, err = decodeSegment(q); err == nil {
+			body, err = h.fetcher.Key(r.Context(), seg.EncryptMeta)
+		}
+		contentType = "application/octet-stream"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(body)
+	}
+}
+
+// playlist 获取并改写播放列表, 播放列表可能是直播, 不做缓存
+func (h *Handler) playlist(ctx context.Context, u string) ([]byte, error) {
+	if u == "" {
+		return nil, errors.New("playlist url is empty")
+	}
+	return h.share(ctx, "playlist:"+u, func(ctx context.Context) ([]byte, error) {
+		body, err := h.fetcher.Get(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		h.lock.Lock()
+		imports := h.imports.get(u)
+		h.lock.Unlock()
+		m, err := m3u8.ParseWithImport(body, u, imports)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s error, %w", u, err)
+		}
+		if m.Variables != nil {
+			h.lock.Lock()
+			for _, v := range m.MastPlayList {
+				h.imports.set(v.M3u8Url, m.Variables)
+			}
+			for _, v := range m.MediaList {
+				h.imports.set(v.Url, m.Variables)
+			}
+			h.lock.Unlock()
+		}
+		h.rewrite(m)
+		return m.Encode(), nil
+	})
+}
+
+// rewrite 将播放列表中的地址改写为指向代理的相对地址
+func (h *Handler) rewrite(m *m3u8.M3u8) {
+	for i := range m.MastPlayList {
+		m.MastPlayList[i].M3u8Url = playlistPath + "?" + h.sign(url.Values{"u": {m.MastPlayList[i].M3u8Url}})
+	}
+	for i := range m.MediaList {
+		if m.MediaList[i].Url != "" {
+			m.MediaList[i].Url = playlistPath + "?" + h.sign(url.Values{"u": {m.MediaList[i].Url}})
+		}
+	}
+
+	for i := range m.Segments {
+		seg := &m.Segments[i]
+		q := encodeSegment(*seg)
+		if seg.Map != nil {
+			// 加密的初始化分片按RFC 8216必须在EXT-X-KEY中指定IV, 不依赖分片的媒体序列号
+			mq := encodeSegment(m3u8.Segment{Url: seg.Map.Url, ByteRange: seg.Map.ByteRange, EncryptMeta: seg.EncryptMeta})
+			seg.Map = &m3u8.Map{Url: initPath + "?" + h.sign(mq)}
+		}
+		seg.Url, seg.ByteRange = segmentPath+"?"+h.sign(q), nil
+
+		switch {
+		case h.decrypt:
+			seg.EncryptMeta = m3u8.EncryptMeta{}
+		case !seg.IsEncrypted():
+		default:
+			seg.EncryptMeta.SecretKeyUrl = keyPath + "?" + h.sign(url.Values{
+				"k":  {seg.EncryptMeta.SecretKeyUrl},
+				"m":  {seg.EncryptMeta.Method},
+				"kf": {seg.EncryptMeta.KeyFormat},
+			})
+		}
+	}
+}
+
+// sign 在查询参数中加入签名s并返回编码后的查询字符串
+func (h *Handler) sign(q url.Values) string {
+	q.Del("s")
+	q.Set("s", h.mac(q))
+	return q.Encode()
+}
+
+// verify 校验并移除查询参数中的签名s
+func (h *Handler) verify(q url.Values) bool {
+	sig := q.Get("s")
+	q.Del("s")
+	return sig != "" && hmac.Equal([]byte(sig), []byte(h.mac(q)))
+}
+
+func (h *Handler) mac(q url.Values) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(q.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encodeSegment 将下载和解密分片所需的信息编码为查询参数
+func encodeSegment(seg m3u8.Segment) url.Values {
+	q := url.Values{"u": {seg.Url}}
+	if seg.ByteRange != nil {
+		q.Set("br", fmt.Sprintf("%d@%d", seg.ByteRange.Length, seg.ByteRange.Offset))
+	}
+	if seg.Map != nil {
+		q.Set("fmp4", "1")
+	}
+	if seg.IsEncrypted() {
+		q.Set("m", seg.EncryptMeta.Method)
+		q.Set("k", seg.EncryptMeta.SecretKeyUrl)
+		q.Set("seq", strconv.FormatInt(seg.Sequence, 10))
+		if seg.EncryptMeta.IV != "" {
+			q.Set("iv", seg.EncryptMeta.IV)
+		}
+		if seg.EncryptMeta.KeyFormat != "" {
+			q.Set("kf", seg.EncryptMeta.KeyFormat)
+		}
+	}
+	return q
+}
+
+func decodeSegment(q url.Values) (m3u8.Segment, error) {
+	seg := m3u8.Segment{
+		Url: q.Get("u"),
+		EncryptMeta: m3u8.EncryptMeta{
+			Method:       q.Get("m"),
+			SecretKeyUrl: q.Get("k"),
+			IV:           q.Get("iv"),
+			KeyFormat:    q.Get("kf"),
+		},
+	}
+	if seg.Url == "" && seg.EncryptMeta.SecretKeyUrl == "" {
+		return seg, errors.New("url is empty")
+	}
+	if v := q.Get("br"); v != "" {
+		var br m3u8.ByteRange
+		if _, err := fmt.Sscanf(v, "%d@%d", &br.Length, &br.Offset); err != nil {
+			return seg, fmt.Errorf("byte range %s is illegal, %w", v, err)
+		}
+		seg.ByteRange = &br
+	}
+	if q.Get("fmp4") != "" {
+		seg.Map = &m3u8.Map{}
+	}
+	if v := q.Get("seq"); v != "" {
+		seq, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return seg, fmt.Errorf("sequence %s is illegal, %w", v, err)
+		}
+		seg.Sequence = seq
+	}
+	return seg, nil
+}
+
+func isFileUrl(u string) bool {
+	return strings.HasPrefix(strings.ToLower(u), "file:")
+}
+
+func segmentContentType(q url.Values) string {
+	if q.Get("fmp4") != "" {
+		return "video/mp4"
+	}
+	if u, err := url.Parse(q.Get("u")); err == nil {
+		if ext := strings.ToLower(path.Ext(u.Path)); ext == ".vtt" || ext == ".webvtt" {
+			return "text/vtt"
+		}
+	}
+	return "video/mp2t"
+}
+
+// cached 优先从磁盘缓存读取, 否则通过fetch获取并写入缓存
+func (h *Handler) cached(ctx context.Context, kind string, q url.Values, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	key := kind + "?" + q.Encode()
+	if h.decrypt {
+		key += "#decrypted"
+	}
+	return h.share(ctx, key, func(ctx context.Context) ([]byte, error) {
+		if h.cacheDir == "" {
+			return fetch(ctx)
+		}
+		sum := sha256.Sum256([]byte(key))
+		name := filepath.Join(h.cacheDir, hex.EncodeToString(sum[:]))
+		if body, err := os.ReadFile(name); err == nil {
+			return body, nil
+		}
+
+		body, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tmp := name + ".tmp"
+		if err = os.WriteFile(tmp, body, os.ModePerm); err == nil {
+			err = os.Rename(tmp, name)
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+		return body, nil
+	})
+}
+
+// share 合并同一个key上并发的请求, fn的结果由多个请求共享. fn使用的ctx在所有等待结果的请求都被取消后才取消,
+// 此时之后的请求重新调用fn.
+func (h *Handler) share(ctx context.Context, key string, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	h.lock.Lock()
+	c, ok := h.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.Background())
+		c = &call{done: make(chan struct{}), cancel: cancel}
+		h.calls[key] = c
+		go func() {
+			c.body, c.err = fn(callCtx)
+			cancel()
+			h.lock.Lock()
+			if h.calls[key] == c {
+				delete(h.calls, key)
+			}
+			h.lock.Unlock()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	h.lock.Unlock()
+
+	select {
+	case <-c.done:
+		return c.body, c.err
+	case <-ctx.Done():
+		h.lock.Lock()
+		if c.waiters--; c.waiters == 0 {
+			c.cancel()
+			if h.calls[key] == c {
+				delete(h.calls, key)
+			}
+		}
+		h.lock.Unlock()
+		return nil, ctx.Err()
+	}
+}
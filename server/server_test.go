@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogokit/m3u8"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func encrypt(plain, key, iv []byte) []byte {
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	plain = append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	b, _ := aes.NewCipher(key)
+	ret := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(b, iv).CryptBlocks(ret, plain)
+	return ret
+}
+
+func TestHandler(t *testing.T) {
+	Convey("TestHandler", t, func() {
+		key := []byte("0123456789abcdef")
+		iv := make([]byte, aes.BlockSize)
+		iv[15] = 1 // 未指定IV时使用媒体序列号
+		// 分片内容以TS同步字节G(0x47)开头, 解密后同步字节之前的数据会被丢弃
+		var (
+			segHits int32
+			gate    = make(chan struct{})
+		)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/live/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n")
+			fmt.Fprint(w, "#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXTINF:2,\nseg1.ts\n")
+			fmt.Fprint(w, "#EXT-X-KEY:METHOD=NONE\n#EXTINF:2,\nseg2.ts\n#EXT-X-ENDLIST\n")
+		})
+		mux.HandleFunc("/live/key.bin", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Token") != "t" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write(key)
+		})
+		mux.HandleFunc("/live/seg1.ts", func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&segHits, 1)
+			<-gate
+			_, _ = w.Write(encrypt([]byte("Gplain segment 1"), key, iv))
+		})
+		mux.HandleFunc("/live/seg2.ts", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "Gplain segment 2")
+		})
+		up := httptest.NewServer(mux)
+		defer up.Close()
+
+		newProxy := func(decrypt bool, cacheDir string) *httptest.Server {
+			opt := m3u8.NewDefaultOption(up.URL+"/live/index.m3u8", m3u8.ModelMerged, "", "", 1)
+			opt.HttpRequestCallback = func(req *http.Request) error {
+				req.Header.Set("X-Token", "t")
+				return nil
+			}
+			h, err := NewHandler(Option{M3u8Url: opt.M3u8Url, CacheDir: cacheDir, Decrypt: decrypt, Fetch: opt})
+			So(err, ShouldEqual, nil)
+			return httptest.NewServer(http.StripPrefix("/hls", h))
+		}
+		get := func(u string) (int, string) {
+			resp, err := http.Get(u)
+			So(err, ShouldEqual, nil)
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return resp.StatusCode, string(body)
+		}
+
+		Convey("decrypt", func() {
+			close(gate)
+			dir := t.TempDir()
+			p := newProxy(true, dir)
+			defer p.Close()
+
+			code, body := get(p.URL + "/hls/index.m3u8")
+			So(code, ShouldEqual, http.StatusOK)
+			So(body, ShouldNotContainSubstring, "EXT-X-KEY")
+			So(body, ShouldNotContainSubstring, up.URL)
+
+			m, err := m3u8.Parse([]byte(body), p.URL+"/hls/index.m3u8")
+			So(err, ShouldEqual, nil)
+			So(len(m.Segments), ShouldEqual, 2)
+			code, body = get(m.Segments[0].Url)
+			So(code, ShouldEqual, http.StatusOK)
+			So(body, ShouldEqual, "Gplain segment 1")
+			_, body = get(m.Segments[1].Url)
+			So(body, ShouldEqual, "Gplain segment 2")
+
+			// 第二次请求命中磁盘缓存
+			_, body = get(m.Segments[0].Url)
+			So(body, ShouldEqual, "Gplain segment 1")
+			So(atomic.LoadInt32(&segHits), ShouldEqual, 1)
+			files, _ := os.ReadDir(dir)
+			So(len(files), ShouldEqual, 2)
+		})
+
+		Convey("passthrough", func() {
+			p := newProxy(false, "")
+			defer p.Close()
+
+			_, body := get(p.URL + "/hls/index.m3u8")
+			m, err := m3u8.Parse([]byte(body), p.URL+"/hls/index.m3u8")
+			So(err, ShouldEqual, nil)
+			So(m.Segments[0].IsEncrypted(), ShouldBeTrue)
+			So(strings.HasPrefix(m.Segments[0].EncryptMeta.SecretKeyUrl, p.URL+"/hls/key?"), ShouldBeTrue)
+			So(m.Segments[1].IsEncrypted(), ShouldBeFalse)
+
+			code, body := get(m.Segments[0].EncryptMeta.SecretKeyUrl)
+			So(code, ShouldEqual, http.StatusOK)
+			So(body, ShouldEqual, string(key))
+
+			// 并发请求同一个分片只请求一次上游
+			var (
+				wg     sync.WaitGroup
+				bodies = make([]string, 5)
+			)
+			for i := range bodies {
+				i := i
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := http.Get(m.Segments[0].Url)
+					if err == nil {
+						b, _ := io.ReadAll(resp.Body)
+						resp.Body.Close()
+						bodies[i] = string(b)
+					}
+				}()
+			}
+			for atomic.LoadInt32(&segHits) == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			// 等待其他请求进入合并等待
+			time.Sleep(200 * time.Millisecond)
+			close(gate)
+			wg.Wait()
+			expect := string(encrypt([]byte("Gplain segment 1"), key, iv))
+			for _, v := range bodies {
+				So(v, ShouldEqual, expect)
+			}
+			So(atomic.LoadInt32(&segHits), ShouldEqual, 1)
+
+			code, _ = get(p.URL + "/hls/unknown")
+			So(code, ShouldEqual, http.StatusNotFound)
+			// 不允许通过代理读取本地文件
+			code, _ = get(p.URL + "/hls/segment?u=file%3A%2F%2F%2Fetc%2Fpasswd")
+			So(code, ShouldEqual, http.StatusForbidden)
+
+			// 只代理播放列表中改写过的地址, 未签名或者被篡改的地址返回403
+			for _, v := range []string{"segment", "init.mp4", "playlist.m3u8"} {
+				code, _ = get(p.URL + "/hls/" + v + "?u=" + url.QueryEscape(up.URL+"/live/seg2.ts"))
+				So(code, ShouldEqual, http.StatusForbidden)
+			}
+			code, _ = get(p.URL + "/hls/key?k=" + url.QueryEscape(up.URL+"/live/key.bin"))
+			So(code, ShouldEqual, http.StatusForbidden)
+			seg2, err := url.Parse(m.Segments[1].Url)
+			So(err, ShouldEqual, nil)
+			q := seg2.Query()
+			q.Set("u", "http://169.254.169.254/latest/meta-data")
+			seg2.RawQuery = q.Encode()
+			code, _ = get(seg2.String())
+			So(code, ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
+
+func TestHandlerCancel(t *testing.T) {
+	Convey("TestHandlerCancel", t, func() {
+		var (
+			hit       = make(chan struct{})
+			cancelled = make(chan struct{})
+		)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\nslow.ts\n#EXT-X-ENDLIST\n")
+		})
+		mux.HandleFunc("/slow.ts", func(w http.ResponseWriter, r *http.Request) {
+			close(hit)
+			<-r.Context().Done()
+			close(cancelled)
+		})
+		up := httptest.NewServer(mux)
+		defer up.Close()
+
+		opt := m3u8.NewDefaultOption(up.URL+"/index.m3u8", m3u8.ModelMerged, "", "", 1)
+		opt.RetryPolicy = m3u8.RetryPolicy{MaxAttempts: 1}
+		h, err := NewHandler(Option{M3u8Url: opt.M3u8Url, Fetch: opt})
+		So(err, ShouldEqual, nil)
+		p := httptest.NewServer(h)
+		defer p.Close()
+
+		resp, err := http.Get(p.URL + "/index.m3u8")
+		So(err, ShouldEqual, nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		m, err := m3u8.Parse(body, p.URL+"/index.m3u8")
+		So(err, ShouldEqual, nil)
+
+		// 客户端断开后取消上游请求
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.Segments[0].Url, nil)
+		So(err, ShouldEqual, nil)
+		go func() {
+			<-hit
+			cancel()
+		}()
+		_, err = http.DefaultClient.Do(req)
+		So(err, ShouldNotEqual, nil)
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			So("upstream request not cancelled", ShouldBeEmpty)
+		}
+	})
+}
+
+func TestImportCache(t *testing.T) {
+	Convey("TestImportCache", t, func() {
+		c := newImportCache()
+		for i := 0; i < importsSize; i++ {
+			c.set(fmt.Sprint(i), map[string]string{"i": fmt.Sprint(i)})
+		}
+		// 第0个最近被使用过, 超过容量时淘汰第1个
+		So(c.get("0"), ShouldResemble, map[string]string{"i": "0"})
+		c.set("new", nil)
+		So(len(c.entries), ShouldEqual, importsSize)
+		So(c.get("1"), ShouldBeNil)
+		So(c.get("0"), ShouldNotBeNil)
+		So(c.get("2"), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,215 @@
+package m3u8
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	copyBufSize = 64 * 1024
+	// poolBufSize bufPool中缓冲区的长度, 多出的一个分组供cbcReader保留最后一个已解密的分组
+	poolBufSize = copyBufSize + aes.BlockSize
+	// bufPoolSize bufPool最多保留的缓冲区数量
+	bufPoolSize = 64
+)
+
+// bufPool 复用复制和解密数据使用的缓冲区, 减少每个分片分配的内存.
+// 最多保留bufPoolSize个缓冲区, 为空时分配新的缓冲区, 已满时归还的缓冲区直接丢弃.
+var bufPool = make(chan []byte, bufPoolSize)
+
+func getBuf() []byte {
+	select {
+	case b := <-bufPool:
+		return b
+	default:
+		return make([]byte, poolBufSize)
+	}
+}
+
+func putBuf(b []byte) {
+	if cap(b) != poolBufSize {
+		return
+	}
+	select {
+	case bufPool <- b[:poolBufSize]:
+	default:
+	}
+}
+
+// copyBuffer 使用bufPool中的缓冲区将src复制到dst. dst实现了io.ReaderFrom(如*os.File)或src实现了io.WriterTo时,
+// io.CopyBuffer直接调用它们, 不使用该缓冲区
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := getBuf()
+	defer putBuf(buf)
+	return io.CopyBuffer(dst, src, buf[:copyBufSize])
+}
+
+// decryptError 解密失败, 通常是秘钥错误导致的填充不合法, 重新下载无法解决
+type decryptError struct {
+	err error
+}
+
+func (e *decryptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *decryptError) Unwrap() error {
+	return e.err
+}
+
+func isDecryptError(err error) bool {
+	var e *decryptError
+	return errors.As(err, &e)
+}
+
+// cbcReader 按分组流式解密AES-128-CBC, 最后一个分组在读到EOF后去除PKCS#7填充再输出.
+// in和buf从bufPool中取出, 读取结束或出错时归还.
+type cbcReader struct {
+	src  io.Reader
+	mode cipher.BlockMode
+	in   []byte // 尚未解密的密文
+	out  []byte // 已解密尚未读出的明文
+	held []byte // 最后一个已解密的分组
+	buf  []byte
+	eof  bool
+	err  error // 读取结束或出错后一直返回该错误
+}
+
+func newCBCReader(src io.Reader, key, iv []byte) (io.Reader, error) {
+	if len(key) != aes.BlockSize {
+		return nil, &decryptError{fmt.Errorf("aes-128 key length must be %d, got %d", aes.BlockSize, len(key))}
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("aes-128 iv length must be %d, got %d", aes.BlockSize, len(iv))
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, &decryptError{fmt.Errorf("aes.NewCipher error, %w", err)}
+	}
+	return &cbcReader{
+		src:  src,
+		mode: cipher.NewCBCDecrypter(b, iv),
+		in:   getBuf()[:0],
+		buf:  getBuf(),
+	}, nil
+}
+
+func (r *cbcReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err == nil && r.eof {
+			r.err = io.EOF
+		}
+		if r.err == nil {
+			r.err = r.fill()
+		}
+		if r.err != nil {
+			r.release()
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// release 将缓冲区归还到bufPool, 此时r.out已经读完, 不再引用buf
+func (r *cbcReader) release() {
+	if r.buf == nil {
+		return
+	}
+	putBuf(r.in[:cap(r.in)])
+	putBuf(r.buf)
+	r.in, r.buf, r.out = nil, nil, nil
+}
+
+func (r *cbcReader) fill() error {
+	n, err := r.src.Read(r.in[len(r.in):copyBufSize])
+	r.in = r.in[:len(r.in)+n]
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if err == io.EOF {
+		r.eof = true
+		if len(r.in)%aes.BlockSize != 0 {
+			return &decryptError{fmt.Errorf("encrypted data length is not a multiple of the block size")}
+		}
+	}
+
+	blocks := len(r.in) / aes.BlockSize * aes.BlockSize
+	if blocks > 0 {
+		// 保留上一次最后一个分组, 只有它可能包含填充
+		out := append(r.buf[:0], r.held...)
+		plain := r.buf[len(out) : len(out)+blocks]
+		r.mode.CryptBlocks(plain, r.in[:blocks])
+		out = out[:len(out)+blocks]
+		r.out, r.held = out[:len(out)-aes.BlockSize], append(r.held[:0], out[len(out)-aes.BlockSize:]...)
+		r.in = r.in[:copy(r.in, r.in[blocks:])]
+	}
+
+	if r.eof && len(r.held) > 0 {
+		last, err := pkcs7Unpad(r.held)
+		if err != nil {
+			return &decryptError{err}
+		}
+		r.out = append(r.out, last...)
+		r.held = nil
+	}
+	return nil
+}
+
+// exactReader 读取恰好n字节, 数据不足时返回io.ErrUnexpectedEOF, strict为true时数据超出也返回错误
+type exactReader struct {
+	r      io.Reader
+	n      int64
+	strict bool
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		if e.strict {
+			var b [1]byte
+			if n, _ := e.r.Read(b[:]); n > 0 {
+				return 0, errors.New("response body is longer than byte range")
+			}
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// tsSyncReader 丢弃第一个同步字节0x47之前的数据
+type tsSyncReader struct {
+	r      io.Reader
+	synced bool
+}
+
+func (t *tsSyncReader) Read(p []byte) (int, error) {
+	for !t.synced {
+		n, err := t.r.Read(p)
+		for i, v := range p[:n] {
+			if v == 0x47 {
+				t.synced = true
+				return copy(p, p[i:n]), nil
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return t.r.Read(p)
+}
@@ -0,0 +1,119 @@
+package m3u8
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStream(t *testing.T) {
+	Convey("TestStream", t, func() {
+		key := []byte("0123456789abcdef")
+		iv := []byte("fedcba9876543210")
+
+		Convey("cbc reader", func() {
+			for _, n := range []int{0, 1, 15, 16, 17, copyBufSize - 1, copyBufSize, 3*copyBufSize + 5} {
+				plain := bytes.Repeat([]byte{0x5A}, n)
+				r, err := newCBCReader(iotest.HalfReader(bytes.NewReader(encryptAES128(plain, key, iv))), key, iv)
+				So(err, ShouldEqual, nil)
+				got, err := io.ReadAll(r)
+				So(err, ShouldEqual, nil)
+				So(got, ShouldResemble, plain)
+			}
+
+			r, err := newCBCReader(bytes.NewReader(encryptAES128([]byte("hello"), key, iv)), []byte("fedcba9876543210"), iv)
+			So(err, ShouldEqual, nil)
+			_, err = io.ReadAll(r)
+			So(isDecryptError(err), ShouldBeTrue)
+
+			r, _ = newCBCReader(bytes.NewReader(make([]byte, 17)), key, iv)
+			_, err = io.ReadAll(r)
+			So(isDecryptError(err), ShouldBeTrue)
+		})
+
+		Convey("buf pool", func() {
+			// 最多保留bufPoolSize个缓冲区
+			for len(bufPool) > 0 {
+				<-bufPool
+			}
+			bufs := make([][]byte, 2*bufPoolSize)
+			for i := range bufs {
+				bufs[i] = getBuf()
+				So(len(bufs[i]), ShouldEqual, poolBufSize)
+			}
+			for _, v := range bufs {
+				putBuf(v)
+			}
+			So(len(bufPool), ShouldEqual, bufPoolSize)
+			putBuf(make([]byte, 16))
+			So(len(bufPool), ShouldEqual, bufPoolSize)
+
+			// cbcReader读取结束或出错后归还缓冲区
+			for len(bufPool) > 0 {
+				<-bufPool
+			}
+			r, err := newCBCReader(bytes.NewReader(encryptAES128([]byte("hello"), key, iv)), key, iv)
+			So(err, ShouldEqual, nil)
+			_, err = io.ReadAll(r)
+			So(err, ShouldEqual, nil)
+			So(len(bufPool), ShouldEqual, 2)
+			r, _ = newCBCReader(bytes.NewReader(make([]byte, 17)), key, iv)
+			_, err = io.ReadAll(r)
+			So(isDecryptError(err), ShouldBeTrue)
+			_, err = r.Read(make([]byte, 16))
+			So(isDecryptError(err), ShouldBeTrue)
+			So(len(bufPool), ShouldEqual, 2)
+		})
+
+		Convey("ts sync reader", func() {
+			got, err := io.ReadAll(&tsSyncReader{r: iotest.OneByteReader(bytes.NewReader([]byte{1, 2, 0x47, 3, 0x47}))})
+			So(err, ShouldEqual, nil)
+			So(got, ShouldResemble, []byte{0x47, 3, 0x47})
+		})
+
+		Convey("download segment", func() {
+			plain := append([]byte{0, 0}, bytes.Repeat([]byte{0x47, 1, 2, 3}, 50000)...)
+			encrypted := encryptAES128(plain, key, iv)
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(encrypted)
+			}))
+			defer s.Close()
+
+			meta := EncryptMeta{Method: CryptMethodAES, SecretKeyUrl: "key", IV: "0x" + hex.EncodeToString(iv)}
+			md := &m3u8Downloader{
+				fileDir:      t.TempDir(),
+				tsFilePrefix: "seg",
+				m3u8:         &M3u8{Segments: []Segment{{Url: s.URL + "/0.ts", EncryptMeta: meta}}},
+				keys: newKeyCache(KeyProviderFunc(func(context.Context, EncryptMeta) ([]byte, error) {
+					return key, nil
+				}), 0, RetryPolicy{}),
+			}
+			var (
+				size int64
+				sum  string
+			)
+			err := md.downloadSegment(context.Background(), 0, func(seg Segment, wrap segmentWrap) (err error) {
+				size, sum, err = md.saveSegment(context.Background(), md.fullPath(md.tsName(0)), seg, wrap)
+				return err
+			})
+			So(err, ShouldEqual, nil)
+			So(size, ShouldEqual, len(plain)-2)
+			expect := sha256.Sum256(plain[2:])
+			So(sum, ShouldEqual, hex.EncodeToString(expect[:]))
+
+			body, err := os.ReadFile(md.fullPath(md.tsName(0)))
+			So(err, ShouldEqual, nil)
+			So(body, ShouldResemble, plain[2:])
+			So(md.segment(0).EncryptMeta.SecretKey, ShouldEqual, string(key))
+		})
+	})
+}
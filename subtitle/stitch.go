@@ -0,0 +1,99 @@
+package subtitle
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	mpegTsTimescale = 90000
+	mpegTsWrap      = int64(1) << 33
+)
+
+// Stitcher 将一个字幕备选媒体的各个WebVTT分片拼接为一条完整的字幕.
+// 带有X-TIMESTAMP-MAP的分片按照其映射换算到MPEG-TS时间轴, 再减去媒体起点的时间;
+// 没有X-TIMESTAMP-MAP的分片中的时间视为相对媒体起点的时间. 相邻分片中重复出现的字幕只保留一条.
+type Stitcher struct {
+	base    int64 // 媒体起点的MPEG-TS时间, 单位为1/90000秒, 小于0表示尚未确定
+	last    int64 // 上一个X-TIMESTAMP-MAP的MPEG-TS时间, 用于处理33位回绕
+	hasLast bool
+	cues    []Cue
+	seen    map[cueKey]bool
+}
+
+type cueKey struct {
+	start time.Duration
+	end   time.Duration
+	text  string
+}
+
+// NewStitcher base为媒体起点的MPEG-TS时间(单位为1/90000秒), 通常为视频的第一个PTS;
+// 小于0时以第一个带有X-TIMESTAMP-MAP的分片的MPEGTS为起点.
+func NewStitcher(base int64) *Stitcher {
+	return &Stitcher{
+		base: base,
+		seen: make(map[cueKey]bool),
+	}
+}
+
+// Add 按顺序添加一个WebVTT分片
+func (s *Stitcher) Add(b []byte) error {
+	vtt, err := ParseWebVTT(b)
+	if err != nil {
+		return err
+	}
+
+	var offset time.Duration
+	if vtt.HasTimestampMap {
+		ts := vtt.MpegTs
+		if s.hasLast {
+			ts = unwrap(ts, s.last)
+		} else if s.base >= 0 {
+			ts = unwrap(ts, s.base)
+		}
+		s.last, s.hasLast = ts, true
+		if s.base < 0 {
+			s.base = ts
+		}
+		offset = time.Duration(ts-s.base)*time.Second/mpegTsTimescale - vtt.Local
+	}
+
+	for _, v := range vtt.Cues {
+		v.Start += offset
+		v.End += offset
+		if v.End <= 0 || v.End <= v.Start {
+			continue
+		}
+		if v.Start < 0 {
+			v.Start = 0
+		}
+		key := cueKey{start: v.Start, end: v.End, text: v.Text}
+		if s.seen[key] {
+			continue
+		}
+		s.seen[key] = true
+		s.cues = append(s.cues, v)
+	}
+	return nil
+}
+
+// Cues 返回按开始时间排序的字幕
+func (s *Stitcher) Cues() []Cue {
+	ret := make([]Cue, len(s.cues))
+	copy(ret, s.cues)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Start < ret[j].Start
+	})
+	return ret
+}
+
+// unwrap 返回与ref最接近的ts+k*2^33
+func unwrap(ts, ref int64) int64 {
+	for ts < ref-mpegTsWrap/2 {
+		ts += mpegTsWrap
+	}
+	for ts > ref+mpegTsWrap/2 {
+		ts -= mpegTsWrap
+	}
+	return ts
+}
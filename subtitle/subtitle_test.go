@@ -0,0 +1,77 @@
+package subtitle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseWebVTT(t *testing.T) {
+	Convey("TestParseWebVTT", t, func() {
+		vtt, err := ParseWebVTT([]byte("\xEF\xBB\xBFWEBVTT\r\nX-TIMESTAMP-MAP=LOCAL:00:00:01.000,MPEGTS:900000\r\n\r\nNOTE comment\r\n\r\nintro\r\n00:01.500 --> 00:00:03.000 line:90%\r\n<v Bob>Hello</v>\r\nworld\r\n"))
+		So(err, ShouldEqual, nil)
+		So(vtt.HasTimestampMap, ShouldBeTrue)
+		So(vtt.MpegTs, ShouldEqual, 900000)
+		So(vtt.Local, ShouldEqual, time.Second)
+		So(vtt.Cues, ShouldResemble, []Cue{{
+			Id:       "intro",
+			Start:    1500 * time.Millisecond,
+			End:      3 * time.Second,
+			Settings: "line:90%",
+			Text:     "<v Bob>Hello</v>\nworld",
+		}})
+
+		_, err = ParseWebVTT([]byte("00:01.000 --> 00:02.000\nhi\n"))
+		So(err, ShouldNotEqual, nil)
+		_, err = ParseWebVTT([]byte("WEBVTT\n\n00:01 --> 00:02.000\nhi\n"))
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestStitcher(t *testing.T) {
+	Convey("TestStitcher", t, func() {
+		segs := []string{
+			"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:05.000\nfirst\n",
+			// 跨分片的字幕在下一个分片中重复出现
+			"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:05.000\nfirst\n\n00:00:07.000 --> 00:00:08.000\nsecond\n",
+		}
+
+		Convey("base from media", func() {
+			s := NewStitcher(900000 + 90000)
+			for _, v := range segs {
+				So(s.Add([]byte(v)), ShouldEqual, nil)
+			}
+			cues := s.Cues()
+			So(len(cues), ShouldEqual, 2)
+			So(cues[0].Start, ShouldEqual, 0)
+			So(cues[0].End, ShouldEqual, 4*time.Second)
+			So(cues[1].Start, ShouldEqual, 6*time.Second)
+		})
+
+		Convey("base from first segment and 33 bit wrap", func() {
+			s := NewStitcher(-1)
+			So(s.Add([]byte("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:8589844592,LOCAL:00:00:10.000\n\n00:00:11.000 --> 00:00:12.000\na\n")), ShouldEqual, nil)
+			So(s.Add([]byte("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:90000,LOCAL:00:00:10.000\n\n00:00:11.000 --> 00:00:12.000\nb\n")), ShouldEqual, nil)
+			cues := s.Cues()
+			So(cues[0].Start, ShouldEqual, time.Second)
+			So(cues[1].Start, ShouldEqual, 3*time.Second)
+		})
+
+		Convey("write", func() {
+			cues := []Cue{
+				{Start: 1500 * time.Millisecond, End: 3723004 * time.Millisecond, Text: "<v Bob><i>Hi</i> &amp; bye</v>"},
+			}
+			var buf bytes.Buffer
+			So(WriteSRT(&buf, cues), ShouldEqual, nil)
+			So(buf.String(), ShouldEqual, "1\n00:00:01,500 --> 01:02:03,004\n<i>Hi</i> & bye\n\n")
+
+			buf.Reset()
+			So(WriteVTT(&buf, cues), ShouldEqual, nil)
+			So(buf.String(), ShouldEqual, "WEBVTT\n\n00:00:01.500 --> 01:02:03.004\n<v Bob><i>Hi</i> &amp; bye</v>\n")
+
+			So(PlainText(cues[0].Text), ShouldEqual, "Hi & bye")
+		})
+	})
+}
@@ -0,0 +1,163 @@
+// Package subtitle 解析HLS中分片的WebVTT字幕, 按照X-TIMESTAMP-MAP拼接为完整的字幕并输出为vtt或srt
+package subtitle
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cue WebVTT中的一条字幕
+type Cue struct {
+	Id       string
+	Start    time.Duration
+	End      time.Duration
+	Settings string // 时间行中的cue settings, 例如line:90%
+	Text     string
+}
+
+// WebVTT 一个WebVTT文件
+type WebVTT struct {
+	Cues []Cue
+	// HasTimestampMap为true时, 字幕的本地时间Local对应MPEG-TS时间MpegTs(单位为1/90000秒)
+	HasTimestampMap bool
+	MpegTs          int64
+	Local           time.Duration
+}
+
+// ParseWebVTT 解析WebVTT, 忽略NOTE, STYLE和REGION块
+func ParseWebVTT(b []byte) (*WebVTT, error) {
+	b = bytes.TrimPrefix(b, []byte("\xEF\xBB\xBF"))
+	text := strings.ReplaceAll(strings.ReplaceAll(string(b), "\r\n", "\n"), "\r", "\n")
+	blocks := splitBlocks(text)
+	if len(blocks) == 0 || !strings.HasPrefix(blocks[0][0], "WEBVTT") {
+		return nil, errors.New("webvtt signature not found")
+	}
+
+	ret := &WebVTT{}
+	for _, line := range blocks[0][1:] {
+		if !strings.HasPrefix(line, "X-TIMESTAMP-MAP=") {
+			continue
+		}
+		if err := ret.parseTimestampMap(strings.TrimPrefix(line, "X-TIMESTAMP-MAP=")); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, block := range blocks[1:] {
+		if strings.HasPrefix(block[0], "NOTE") || block[0] == "STYLE" || block[0] == "REGION" {
+			continue
+		}
+		cue := Cue{}
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			cue.Id = block[0]
+			timing = 1
+		}
+		if timing >= len(block) {
+			return nil, fmt.Errorf("cue %s has no timing", cue.Id)
+		}
+		if err := parseTiming(block[timing], &cue); err != nil {
+			return nil, err
+		}
+		cue.Text = strings.Join(block[timing+1:], "\n")
+		ret.Cues = append(ret.Cues, cue)
+	}
+	return ret, nil
+}
+
+// splitBlocks 按空行切分, 每个块为其非空的行
+func splitBlocks(text string) [][]string {
+	var (
+		ret   [][]string
+		block []string
+	)
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(block) > 0 {
+				ret = append(ret, block)
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if len(block) > 0 {
+		ret = append(ret, block)
+	}
+	return ret
+}
+
+// parseTimestampMap 解析X-TIMESTAMP-MAP的值, 例如MPEGTS:900000,LOCAL:00:00:00.000
+func (v *WebVTT) parseTimestampMap(s string) error {
+	for _, kv := range strings.Split(s, ",") {
+		pos := strings.Index(kv, ":")
+		if pos < 0 {
+			return fmt.Errorf("X-TIMESTAMP-MAP %s is illegal", s)
+		}
+		val := strings.TrimSpace(kv[pos+1:])
+		switch strings.TrimSpace(kv[:pos]) {
+		case "MPEGTS":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return fmt.Errorf("X-TIMESTAMP-MAP MPEGTS %s is illegal, %w", val, err)
+			}
+			v.MpegTs = n
+		case "LOCAL":
+			d, err := parseTimestamp(val)
+			if err != nil {
+				return fmt.Errorf("X-TIMESTAMP-MAP LOCAL %s is illegal, %w", val, err)
+			}
+			v.Local = d
+		}
+	}
+	v.HasTimestampMap = true
+	return nil
+}
+
+func parseTiming(line string, cue *Cue) error {
+	arr := strings.SplitN(line, "-->", 2)
+	start, err := parseTimestamp(strings.TrimSpace(arr[0]))
+	if err != nil {
+		return fmt.Errorf("cue timing %s is illegal, %w", line, err)
+	}
+	rest := strings.Fields(arr[1])
+	if len(rest) == 0 {
+		return fmt.Errorf("cue timing %s has no end time", line)
+	}
+	end, err := parseTimestamp(rest[0])
+	if err != nil {
+		return fmt.Errorf("cue timing %s is illegal, %w", line, err)
+	}
+	cue.Start, cue.End, cue.Settings = start, end, strings.Join(rest[1:], " ")
+	return nil
+}
+
+// parseTimestamp 解析[hh:]mm:ss.ttt格式的时间, 小时可以超过两位
+func parseTimestamp(s string) (time.Duration, error) {
+	arr := strings.Split(s, ":")
+	if len(arr) != 2 && len(arr) != 3 {
+		return 0, fmt.Errorf("timestamp %s is illegal", s)
+	}
+	sec := strings.Split(arr[len(arr)-1], ".")
+	if len(sec) != 2 || len(sec[1]) != 3 {
+		return 0, fmt.Errorf("timestamp %s is illegal", s)
+	}
+	fields := append(arr[:len(arr)-1], sec...)
+	var values []int64
+	for _, f := range fields {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("timestamp %s is illegal", s)
+		}
+		values = append(values, n)
+	}
+	if len(values) == 3 {
+		values = append([]int64{0}, values...)
+	}
+	return time.Duration(values[0])*time.Hour + time.Duration(values[1])*time.Minute +
+		time.Duration(values[2])*time.Second + time.Duration(values[3])*time.Millisecond, nil
+}
@@ -0,0 +1,68 @@
+package subtitle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	tagRegexp = regexp.MustCompile(`</?([a-zA-Z]*)[^>]*>`)
+	// srt支持的标签
+	srtTags = map[string]bool{"b": true, "i": true, "u": true}
+
+	entityReplacer = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", " ", "&lrm;", "‎", "&rlm;", "‏")
+)
+
+// WriteVTT 将字幕输出为WebVTT
+func WriteVTT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n")
+	for _, v := range cues {
+		bw.WriteString("\n")
+		if v.Id != "" {
+			bw.WriteString(v.Id + "\n")
+		}
+		fmt.Fprintf(bw, "%s --> %s", formatTime(v.Start, '.'), formatTime(v.End, '.'))
+		if v.Settings != "" {
+			bw.WriteString(" " + v.Settings)
+		}
+		bw.WriteString("\n" + v.Text + "\n")
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write vtt error, %w", err)
+	}
+	return nil
+}
+
+// WriteSRT 将字幕输出为SubRip, 仅保留b, i和u标签
+func WriteSRT(w io.Writer, cues []Cue) error {
+	bw := bufio.NewWriter(w)
+	for i, v := range cues {
+		text := tagRegexp.ReplaceAllStringFunc(v.Text, func(tag string) string {
+			if srtTags[tagRegexp.FindStringSubmatch(tag)[1]] {
+				return tag
+			}
+			return ""
+		})
+		fmt.Fprintf(bw, "%d\n%s --> %s\n%s\n\n", i+1, formatTime(v.Start, ','), formatTime(v.End, ','), entityReplacer.Replace(text))
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write srt error, %w", err)
+	}
+	return nil
+}
+
+// PlainText 返回去除所有标签并还原字符引用后的字幕文本
+func PlainText(text string) string {
+	return entityReplacer.Replace(tagRegexp.ReplaceAllString(text, ""))
+}
+
+// formatTime 格式化为hh:mm:ss.ttt, sep为秒和毫秒之间的分隔符
+func formatTime(d time.Duration, sep byte) string {
+	ms := int64(d / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
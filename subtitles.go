@@ -0,0 +1,146 @@
+package m3u8
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gogokit/m3u8/remux"
+	"github.com/gogokit/m3u8/subtitle"
+)
+
+// SubtitleFormat 字幕备选媒体合并后的文件格式
+type SubtitleFormat string
+
+const (
+	SubtitleFormatVTT SubtitleFormat = "vtt"
+	SubtitleFormatSRT SubtitleFormat = "srt"
+)
+
+// subtitleTrack 嵌入mp4的字幕
+type subtitleTrack struct {
+	path     string
+	language string
+	cues     []subtitle.Cue
+}
+
+func (t subtitleTrack) remux() remux.Subtitle {
+	ret := remux.Subtitle{Language: t.language}
+	for _, v := range t.cues {
+		ret.Cues = append(ret.Cues, remux.TextCue{Start: v.Start, End: v.End, Text: subtitle.PlainText(v.Text)})
+	}
+	return ret
+}
+
+func (md *m3u8Downloader) isSubtitles() bool {
+	return md.media != nil && md.media.Type == MediaTypeSubtitles
+}
+
+// mergeSubtitles 将字幕备选媒体拼接为字幕文件, 路径写入paths中对应的位置.
+// 字幕以主码流和音视频备选媒体中最早的显示时间为起点, 与转换得到的mp4对齐.
+func (md *m3u8Downloader) mergeSubtitles(ctx context.Context, mergedPath string, paths []string) error {
+	var (
+		base     = int64(-1)
+		computed bool
+		err      error
+	)
+	for i, r := range md.renditions {
+		if !r.isSubtitles() {
+			continue
+		}
+		if !computed {
+			base, computed = md.firstPTS(mergedPath, paths), true
+		}
+		if paths[i], err = r.stitchSubtitles(ctx, base); err != nil {
+			return fmt.Errorf("merge %s subtitles error, %w", r.media.Name, err)
+		}
+	}
+	return nil
+}
+
+// firstPTS 返回ts格式的主码流和音视频备选媒体最早的显示时间, 无法获取时返回-1
+func (md *m3u8Downloader) firstPTS(mergedPath string, paths []string) int64 {
+	if md.fmp4 {
+		return -1
+	}
+	tsPaths := []string{mergedPath}
+	for i, r := range md.renditions {
+		if r.muxable() && !r.fmp4 {
+			tsPaths = append(tsPaths, paths[i])
+		}
+	}
+
+	var inputs []io.Reader
+	for _, v := range tsPaths {
+		f, err := os.Open(v)
+		if err != nil {
+			return -1
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		inputs = append(inputs, bufio.NewReader(f))
+	}
+	ret, err := remux.FirstPTS(inputs...)
+	if err != nil {
+		return -1
+	}
+	return ret
+}
+
+// stitchSubtitles 按照X-TIMESTAMP-MAP拼接WebVTT分片并返回字幕文件路径, base为媒体起点的MPEG-TS时间, 小于0时以第一个分片为起点
+func (md *m3u8Downloader) stitchSubtitles(ctx context.Context, base int64) (path string, err error) {
+	// fMP4封装的字幕按原样合并
+	if md.fmp4 {
+		return md.mergeSegments(ctx)
+	}
+
+	s := subtitle.NewStitcher(base)
+	var files []string
+	for idx, v := range md.segments() {
+		if v.ErrMsg != "" {
+			continue
+		}
+		name := md.fullPath(md.tsName(idx))
+		body, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("os.ReadFile %s error, %w", name, err)
+		}
+		if err = s.Add(body); err != nil {
+			return "", fmt.Errorf("parse webvtt %s error, %w", v.Url, err)
+		}
+		files = append(files, name)
+	}
+	md.cues = s.Cues()
+
+	path = md.tsFilePrefix + md.mergedExt()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return "", fmt.Errorf("os.OpenFile %s error, %w", path, err)
+	}
+	defer func() {
+		if cErr := f.Close(); err == nil && cErr != nil {
+			err = fmt.Errorf("close %s error, %w", path, cErr)
+		}
+	}()
+
+	if md.subtitleFormat == SubtitleFormatSRT {
+		err = subtitle.WriteSRT(f, md.cues)
+	} else {
+		err = subtitle.WriteVTT(f, md.cues)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if md.removeSubTs {
+		for _, v := range files {
+			if err = os.Remove(v); err != nil {
+				return "", fmt.Errorf("os.Remove %s error, %w", v, err)
+			}
+		}
+	}
+	return path, nil
+}
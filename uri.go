@@ -0,0 +1,140 @@
+package m3u8
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// toUrl 按RFC 3986以播放列表的地址base解析uri, 绝对地址(包括data:)按原样返回, 避免改变签名地址
+func toUrl(uri string, base *url.URL) (string, error) {
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("uri %s is illegal, %w", uri, err)
+	}
+	if ref.IsAbs() {
+		return uri, nil
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// decodeDataUrl 解析RFC 2397的data:地址, 返回其中的数据, 常用于直接在EXT-X-KEY中携带秘钥
+func decodeDataUrl(u string) ([]byte, error) {
+	rest := strings.TrimPrefix(u, "data:")
+	pos := strings.IndexByte(rest, ',')
+	if pos < 0 {
+		return nil, fmt.Errorf("data url %s has no comma", u)
+	}
+	meta, data := rest[:pos], rest[pos+1:]
+	data, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("data url %s is illegal, %w", u, err)
+	}
+	if !strings.HasSuffix(meta, ";base64") {
+		return []byte(data), nil
+	}
+	ret, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		// 兼容省略了填充的编码
+		if ret, err = base64.RawStdEncoding.DecodeString(data); err != nil {
+			return nil, fmt.Errorf("data url %s is not base64, %w", u, err)
+		}
+	}
+	return ret, nil
+}
+
+func openDataUrl(u string, br *ByteRange) (io.ReadCloser, error) {
+	data, err := decodeDataUrl(u)
+	if err != nil {
+		return nil, err
+	}
+	if br != nil {
+		if br.Offset+br.Length > int64(len(data)) {
+			return nil, fmt.Errorf("byte range %d@%d out of data size %d", br.Length, br.Offset, len(data))
+		}
+		data = data[br.Offset : br.Offset+br.Length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// openFileUrl 打开file:地址对应的本地文件
+func openFileUrl(u string, br *ByteRange) (io.ReadCloser, error) {
+	path, err := filePath(u)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open %s error, %w", path, err)
+	}
+	if br == nil {
+		return f, nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("stat %s error, %w", path, err)
+	}
+	if br.Offset+br.Length > fi.Size() {
+		_ = f.Close()
+		return nil, fmt.Errorf("byte range %d@%d out of file size %d", br.Length, br.Offset, fi.Size())
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.NewSectionReader(f, br.Offset, br.Length),
+		Closer: f,
+	}, nil
+}
+
+// fileUrl 将本地路径转换为file:地址, 目录以/结尾, 带有scheme的地址按原样返回
+func fileUrl(p string) (string, error) {
+	// 单个字母的scheme是Windows的盘符
+	if u, err := url.Parse(p); err == nil && len(u.Scheme) > 1 {
+		return p, nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", fmt.Errorf("filepath.Abs %s error, %w", p, err)
+	}
+	if fi, err := os.Stat(abs); err == nil && fi.IsDir() {
+		abs += string(filepath.Separator)
+	}
+	abs = filepath.ToSlash(abs)
+	if !strings.HasPrefix(abs, "/") {
+		abs = "/" + abs
+	}
+	return (&url.URL{Scheme: "file", Path: abs}).String(), nil
+}
+
+func isFileUrl(u string) bool {
+	return strings.HasPrefix(strings.ToLower(u), "file:")
+}
+
+// filePath 返回file:地址对应的本地路径, 只支持本机的文件
+func filePath(u string) (string, error) {
+	v, err := url.Parse(u)
+	if err != nil {
+		return "", fmt.Errorf("file url %s is illegal, %w", u, err)
+	}
+	if v.Host != "" && v.Host != "localhost" {
+		return "", fmt.Errorf("file url %s is not on local host", u)
+	}
+	if v.Path == "" {
+		return "", errors.New("file url has no path")
+	}
+	// Windows下的路径形如/C:/dir
+	if runtime.GOOS == "windows" && len(v.Path) > 2 && v.Path[0] == '/' && v.Path[2] == ':' {
+		return filepath.FromSlash(v.Path[1:]), nil
+	}
+	return filepath.FromSlash(v.Path), nil
+}
@@ -0,0 +1,161 @@
+package m3u8
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestToUrl(t *testing.T) {
+	Convey("TestToUrl", t, func() {
+		cases := []struct {
+			base, uri, expect string
+		}{
+			{"http://a.com/b/c/index.m3u8", "seg.ts", "http://a.com/b/c/seg.ts"},
+			{"http://a.com/b/c/index.m3u8", "./seg.ts", "http://a.com/b/c/seg.ts"},
+			{"http://a.com/b/c/index.m3u8", "../seg.ts", "http://a.com/b/seg.ts"},
+			{"http://a.com/b/c/index.m3u8", "../../../seg.ts", "http://a.com/seg.ts"},
+			{"http://a.com/b/c/index.m3u8", "/seg.ts", "http://a.com/seg.ts"},
+			{"https://a.com/b/index.m3u8", "//cdn.com/seg.ts", "https://cdn.com/seg.ts"},
+			{"http://a.com/b/index.m3u8?sig=x/y", "seg.ts", "http://a.com/b/seg.ts"},
+			{"http://a.com/b/index.m3u8?sig=x/y", "seg.ts?sig=1", "http://a.com/b/seg.ts?sig=1"},
+			{"http://a.com/b/index.m3u8", "?page=2", "http://a.com/b/index.m3u8?page=2"},
+			{"http://a.com", "seg.ts", "http://a.com/seg.ts"},
+			{"http://a.com:8080/b/index.m3u8", "seg.ts", "http://a.com:8080/b/seg.ts"},
+			// 绝对地址按原样返回
+			{"http://a.com/b/index.m3u8", "https://c.com/x/../seg.ts?Signature=a%2Fb", "https://c.com/x/../seg.ts?Signature=a%2Fb"},
+			{"http://a.com/b/index.m3u8", "data:text/plain;base64,MDEyMzQ1Njc4OWFiY2RlZg==", "data:text/plain;base64,MDEyMzQ1Njc4OWFiY2RlZg=="},
+			{"file:///data/hls/index.m3u8", "seg.ts", "file:///data/hls/seg.ts"},
+			{"file:///data/hls/index.m3u8", "../key.bin", "file:///data/key.bin"},
+		}
+		for _, c := range cases {
+			base, err := url.Parse(c.base)
+			So(err, ShouldEqual, nil)
+			u, err := toUrl(c.uri, base)
+			So(err, ShouldEqual, nil)
+			So(u, ShouldEqual, c.expect)
+		}
+
+		base, _ := url.Parse("http://a.com/index.m3u8")
+		_, err := toUrl("http://a.com/%zz", base)
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("TestDataUrl", t, func() {
+		cases := []struct {
+			uri, expect string
+		}{
+			{"data:text/plain;base64,MDEyMzQ1Njc4OWFiY2RlZg==", "0123456789abcdef"},
+			{"data:;base64,MDEyMzQ1Njc4OWFiY2RlZg", "0123456789abcdef"},
+			{"data:,hello%20world", "hello world"},
+			{"data:text/plain,a,b", "a,b"},
+		}
+		for _, c := range cases {
+			body, err := decodeDataUrl(c.uri)
+			So(err, ShouldEqual, nil)
+			So(string(body), ShouldEqual, c.expect)
+		}
+		_, err := decodeDataUrl("data:text/plain")
+		So(err, ShouldNotEqual, nil)
+		_, err = decodeDataUrl("data:;base64,!!!")
+		So(err, ShouldNotEqual, nil)
+
+		md := &m3u8Downloader{}
+		body, err := md.httpGetRange(context.Background(), "data:,0123456789", &ByteRange{Offset: 2, Length: 3})
+		So(err, ShouldEqual, nil)
+		So(string(body), ShouldEqual, "234")
+		_, err = md.httpGetRange(context.Background(), "data:,0123456789", &ByteRange{Offset: 8, Length: 3})
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("TestFileUrl", t, func() {
+		path := filepath.Join(t.TempDir(), "seg.ts")
+		So(os.WriteFile(path, []byte("0123456789"), os.ModePerm), ShouldEqual, nil)
+		u := (&url.URL{Scheme: "file", Path: path}).String()
+
+		md := &m3u8Downloader{allowFile: true}
+		body, err := md.httpGet(context.Background(), u)
+		So(err, ShouldEqual, nil)
+		So(string(body), ShouldEqual, "0123456789")
+
+		r, err := md.httpOpen(context.Background(), u, &ByteRange{Offset: 7, Length: 3})
+		So(err, ShouldEqual, nil)
+		body, _ = io.ReadAll(r)
+		So(r.Close(), ShouldEqual, nil)
+		So(string(body), ShouldEqual, "789")
+
+		_, err = md.httpOpen(context.Background(), u, &ByteRange{Offset: 8, Length: 3})
+		So(err, ShouldNotEqual, nil)
+		_, err = md.httpGet(context.Background(), "file://remote-host"+path)
+		So(err, ShouldNotEqual, nil)
+
+		dir := filepath.Dir(path)
+		v, err := fileUrl(dir)
+		So(err, ShouldEqual, nil)
+		So(strings.HasPrefix(v, "file:///"), ShouldBeTrue)
+		So(strings.HasSuffix(v, "/"), ShouldBeTrue)
+		v, err = fileUrl("http://a.com/index.m3u8")
+		So(err, ShouldEqual, nil)
+		So(v, ShouldEqual, "http://a.com/index.m3u8")
+
+		So(os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte("#EXTM3U\n#EXTINF:2,\nseg.ts\n"), os.ModePerm), ShouldEqual, nil)
+		m, err := ParseFile(filepath.Join(dir, "index.m3u8"))
+		So(err, ShouldEqual, nil)
+		So(m.Segments[0].Url, ShouldEqual, u)
+	})
+
+	Convey("TestRemoteFileUrl", t, func() {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "secret.ts")
+		So(os.WriteFile(path, []byte("secret"), os.ModePerm), ShouldEqual, nil)
+		u := (&url.URL{Scheme: "file", Path: path}).String()
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/index.m3u8" {
+				fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\n/0.ts\n#EXTINF:2,\n%s\n#EXT-X-ENDLIST\n", u)
+				return
+			}
+			fmt.Fprint(w, r.URL.Path)
+		}))
+		defer s.Close()
+
+		// 远程的播放列表不能读取本机的文件, 该分片不重试直接失败
+		var out bytes.Buffer
+		opt := NewDefaultOption(s.URL+"/index.m3u8", ModelMerged, dir, "out", 2)
+		opt.Output = &out
+		st, err := DownloadWithOpt(context.Background(), opt)
+		So(err, ShouldEqual, nil)
+		<-st.Done()
+		ret := GenResult(st, false)
+		So(len(ret.Segments), ShouldEqual, 2)
+		for _, v := range ret.Segments {
+			if v.Idx == 0 {
+				So(v.ErrMsg, ShouldEqual, "")
+			} else {
+				So(v.ErrMsg, ShouldContainSubstring, "not allowed")
+			}
+		}
+		So(out.String(), ShouldNotContainSubstring, "secret")
+
+		f := NewFetcher(Option{M3u8Url: s.URL + "/index.m3u8"})
+		_, err = f.Get(context.Background(), u)
+		So(errors.As(err, new(*PermanentError)), ShouldBeTrue)
+
+		// 入口播放列表是本地文件或者由M3u8Content指定时允许
+		for _, opt := range []Option{{M3u8Url: filepath.Join(dir, "index.m3u8")}, {BaseUrl: u}, {M3u8Content: []byte("#EXTM3U\n")}} {
+			body, err := NewFetcher(opt).Get(context.Background(), u)
+			So(err, ShouldEqual, nil)
+			So(string(body), ShouldEqual, "secret")
+		}
+	})
+}
@@ -3,10 +3,13 @@ package m3u8
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/gogokit/util"
 	"os"
+	"strings"
 )
 
 func GenResult(status Status, withBar bool) (ret *Result) {
@@ -15,53 +18,127 @@ func GenResult(status Status, withBar bool) (ret *Result) {
 	if withBar {
 		bar = util.NewBar(uint64(status.TsTotal()))
 	}
-	for {
-		select {
-		case <-status.Done():
-			return
-		case v := <-status.Event():
-			if v.Segment != nil {
+
+	for _, v := range status.M3u8().Renditions {
+		ret.Renditions = append(ret.Renditions, RenditionResult{Media: v.Media})
+	}
+
+	handle := func(v Event) {
+		if v.CheckpointErr != "" {
+			ret.CheckpointErr = v.CheckpointErr
+		}
+		if v.Segment != nil {
+			if v.Rendition == nil {
 				ret.Segments = append(ret.Segments, *v.Segment)
-				if withBar {
-					bar.Update(uint64(status.TsComplete()))
+			}
+			for i := range ret.Renditions {
+				if v.Rendition != nil && ret.Renditions[i].Media == *v.Rendition {
+					ret.Renditions[i].Segments = append(ret.Renditions[i].Segments, *v.Segment)
+					break
 				}
-				continue
 			}
+			if withBar {
+				bar.Update(uint64(status.TsComplete()))
+			}
+			return
+		}
 
-			if v.Merged != nil {
-				ret.Merged = *v.Merged
-				ret.MergeErr = v.MergeErr
-				ret.MergedFilePath = v.MergedFilePath
-				continue
+		if v.Merged != nil {
+			ret.Merged = *v.Merged
+			ret.MergeErr = v.MergeErr
+			ret.MergedFilePath = v.MergedFilePath
+			for i, p := range v.RenditionFilePaths {
+				if i < len(ret.Renditions) {
+					ret.Renditions[i].MergedFilePath = p
+				}
 			}
+			return
+		}
 
-			if v.ConvToMP4 != nil {
-				ret.ConvToMP4 = *v.ConvToMP4
-				ret.ConvToMP4Err = v.ConvToMP4Err
-				ret.MP4FilePath = v.MP4FilePath
+		if v.ConvToMP4 != nil {
+			ret.ConvToMP4 = *v.ConvToMP4
+			ret.ConvToMP4Err = v.ConvToMP4Err
+			ret.MP4FilePath = v.MP4FilePath
+		}
+	}
+
+	for {
+		select {
+		case <-status.Done():
+			// Done关闭前写入的事件可能还未被读取
+			for {
+				select {
+				case v := <-status.Event():
+					handle(v)
+				default:
+					return
+				}
 			}
+		case v := <-status.Event():
+			handle(v)
 		}
 	}
 }
 
 func decryptByAES128(encrypted, key, iv []byte) ([]byte, error) {
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("aes-128 key length must be %d, got %d", aes.BlockSize, len(key))
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("aes-128 iv length must be %d, got %d", aes.BlockSize, len(iv))
+	}
+	if len(encrypted)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted data length %d is not a multiple of the block size", len(encrypted))
+	}
+
 	b, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("aes.NewCipher error, %w", err)
 	}
 
-	if len(iv) == 0 {
-		iv = key
-	}
-
 	origData := make([]byte, len(encrypted))
-	cipher.NewCBCDecrypter(b, iv[:b.BlockSize()]).CryptBlocks(origData, encrypted)
+	cipher.NewCBCDecrypter(b, iv).CryptBlocks(origData, encrypted)
+	return pkcs7Unpad(origData)
+}
 
-	l := len(origData)
+// pkcs7Unpad 校验并去除PKCS#7填充
+func pkcs7Unpad(data []byte) ([]byte, error) {
+	l := len(data)
 	if l == 0 {
-		return origData, nil
+		return data, nil
+	}
+	n := int(data[l-1])
+	if n == 0 || n > aes.BlockSize || n > l {
+		return nil, fmt.Errorf("invalid pkcs7 padding length %d", n)
+	}
+	for _, v := range data[l-n:] {
+		if int(v) != n {
+			return nil, errors.New("invalid pkcs7 padding")
+		}
 	}
-	return origData[:(l - int(origData[l-1]))], nil
+	return data[:l-n], nil
+}
+
+// decodeIV 解析EXT-X-KEY中IV属性的值, 其为0x或0X开头的128位十六进制整数
+func decodeIV(v string) ([]byte, error) {
+	if !strings.HasPrefix(v, "0x") && !strings.HasPrefix(v, "0X") {
+		return nil, fmt.Errorf("iv %s is not a hexadecimal-sequence", v)
+	}
+	iv, err := hex.DecodeString(v[2:])
+	if err != nil {
+		return nil, fmt.Errorf("iv %s is not a hexadecimal-sequence, %w", v, err)
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("iv %s is not 128 bits", v)
+	}
+	return iv, nil
+}
+
+// sequenceIV 未指定IV时, 使用分片的媒体序列号作为IV, 即序列号的128位大端表示
+func sequenceIV(seq int64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
 }
 
 func createIfNotExists(dir string) error {
@@ -80,3 +157,12 @@ func createIfNotExists(dir string) error {
 	}
 	return nil
 }
+
+// lastLines 返回output的最后n行, 用于在错误信息中附带命令的输出
+func lastLines(output []byte, n int) string {
+	lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
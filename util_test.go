@@ -0,0 +1,63 @@
+package m3u8
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDecryptByAES128(t *testing.T) {
+	Convey("TestDecryptByAES128", t, func() {
+		key := []byte("0123456789abcdef")
+		encrypt := func(plain, iv []byte) []byte {
+			n := aes.BlockSize - len(plain)%aes.BlockSize
+			plain = append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(n)}, n)...)
+			b, _ := aes.NewCipher(key)
+			ret := make([]byte, len(plain))
+			cipher.NewCBCEncrypter(b, iv).CryptBlocks(ret, plain)
+			return ret
+		}
+
+		Convey("IV from EXT-X-KEY", func() {
+			seg := Segment{Sequence: 7, EncryptMeta: EncryptMeta{IV: "0x000102030405060708090A0B0C0D0E0F"}}
+			iv, err := seg.aesIV()
+			So(err, ShouldEqual, nil)
+			So(iv, ShouldResemble, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15})
+
+			plain, err := decryptByAES128(encrypt([]byte("hello world"), iv), key, iv)
+			So(err, ShouldEqual, nil)
+			So(string(plain), ShouldEqual, "hello world")
+		})
+
+		Convey("IV from media sequence number", func() {
+			seg := Segment{Sequence: 0x0102}
+			iv, err := seg.aesIV()
+			So(err, ShouldEqual, nil)
+			So(iv, ShouldResemble, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2})
+
+			plain, err := decryptByAES128(encrypt(bytes.Repeat([]byte{0x47}, 32), iv), key, iv)
+			So(err, ShouldEqual, nil)
+			So(plain, ShouldResemble, bytes.Repeat([]byte{0x47}, 32))
+		})
+
+		Convey("Illegal input", func() {
+			iv := sequenceIV(1)
+			_, err := decryptByAES128(encrypt([]byte("x"), iv), []byte("short"), iv)
+			So(err, ShouldNotEqual, nil)
+
+			_, err = decryptByAES128(encrypt([]byte("x"), iv)[:15], key, iv)
+			So(err, ShouldNotEqual, nil)
+
+			_, err = decryptByAES128(encrypt([]byte("x"), iv), key, sequenceIV(2))
+			So(err, ShouldNotEqual, nil)
+
+			_, err = decodeIV("000102030405060708090A0B0C0D0E0F")
+			So(err, ShouldNotEqual, nil)
+			_, err = decodeIV("0x0001")
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
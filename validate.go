@@ -0,0 +1,361 @@
+package m3u8
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Severity 校验问题的严重程度
+type Severity int
+
+const (
+	SeverityError   Severity = 0 // 违反RFC 8216中的MUST, 播放器可能无法播放
+	SeverityWarning Severity = 1 // 违反SHOULD或者可能导致兼容性问题
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// 校验问题的代码, 取值保持稳定, 可以用于过滤
+const (
+	IssueIllegalValue          = "illegal-value"           // 标签或者地址不合法, 解析时被忽略, 仅由ValidateContent返回
+	IssueMixedPlaylist         = "mixed-playlist"          // 同时包含主播放列表和媒体播放列表的标签
+	IssueMissingTargetDuration = "missing-target-duration" // 媒体播放列表没有EXT-X-TARGETDURATION
+	IssueExceedTargetDuration  = "extinf-exceeds-target"   // 分片时长四舍五入后超过EXT-X-TARGETDURATION
+	IssueVersionTooLow         = "version-too-low"         // 使用的特性要求更高的EXT-X-VERSION
+	IssueSequence              = "non-monotonic-sequence"  // EXT-X-MEDIA-SEQUENCE重复或者出现在分片之后, 或者分片的媒体序列号不连续
+	IssuePlaylistType          = "playlist-type"           // EXT-X-PLAYLIST-TYPE与EXT-X-ENDLIST不一致
+	IssueDuplicateUri          = "duplicate-uri"           // 重复的分片或码流地址
+	IssueMissingBandwidth      = "missing-bandwidth"       // EXT-X-STREAM-INF没有BANDWIDTH
+	IssueUndefinedGroup        = "undefined-group"         // 码流引用了不存在的EXT-X-MEDIA组
+	IssueEmptyPlaylist         = "empty-playlist"          // 既没有分片也没有码流
+	IssueUpdate                = "invalid-update"          // 重新加载得到的播放列表与上一次的不一致, 仅由ValidateUpdate返回
+)
+
+// Issue 播放列表不符合RFC 8216的问题
+type Issue struct {
+	Severity Severity
+	Code     string
+	Line     int // 问题所在的行号, 从1开始, 为0表示无法确定
+	Message  string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("line %d: %s [%s] %s", i.Line, i.Severity, i.Code, i.Message)
+}
+
+// Validate 校验播放列表是否符合RFC 8216, 返回按发现顺序排列的问题, 没有问题时返回nil.
+// 播放列表没有保存行号, 返回的Issue.Line均为0, 需要行号时使用ValidateContent.
+func Validate(m *M3u8) []Issue {
+	v := &validator{m: m, lines: &lineIndex{}}
+	v.validate()
+	return v.issues
+}
+
+// ValidateContent 解析并校验m3u8文本, 返回的问题带有行号.
+// 不合法的标签和地址作为IssueIllegalValue返回, 并按未指定继续校验; 只有地址不合法或者内容不以#EXTM3U开头时返回错误.
+func ValidateContent(content []byte, m3u8Url string) ([]Issue, error) {
+	v := &validator{lines: newLineIndex(content)}
+	m, err := parse(content, m3u8Url, parseConfig{report: func(i int, err error) {
+		// parse的行索引从0开始
+		msg := strings.TrimPrefix(err.Error(), fmt.Sprintf("line:%d, ", i))
+		v.add(SeverityError, IssueIllegalValue, i+1, "%s", msg)
+	}})
+	if err != nil {
+		return nil, err
+	}
+	v.m = m
+	v.validate()
+	return v.issues, nil
+}
+
+// ValidateFile 校验本地的m3u8文件, 相对地址按文件所在目录解析
+func ValidateFile(path string) ([]Issue, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile %s error, %w", path, err)
+	}
+	u, err := fileUrl(path)
+	if err != nil {
+		return nil, err
+	}
+	return ValidateContent(content, u)
+}
+
+// ValidateUpdate 校验同一个媒体播放列表重新加载前后的变化是否符合RFC 8216 6.2.1,
+// 例如媒体序列号回退, 同一媒体序列号的分片地址改变, 或者出现EXT-X-ENDLIST之后播放列表又发生了变化.
+// 返回的Issue.Line均为0.
+func ValidateUpdate(prev, next *M3u8) []Issue {
+	v := &validator{m: next, lines: &lineIndex{}}
+	if next.MediaSequence < prev.MediaSequence {
+		v.add(SeverityError, IssueUpdate, 0, "media sequence decreased from %d to %d", prev.MediaSequence, next.MediaSequence)
+	}
+	if next.DiscontinuitySequence < prev.DiscontinuitySequence {
+		v.add(SeverityError, IssueUpdate, 0, "discontinuity sequence decreased from %d to %d", prev.DiscontinuitySequence, next.DiscontinuitySequence)
+	}
+	if prev.PlayListType == "EVENT" && next.MediaSequence != prev.MediaSequence {
+		v.add(SeverityError, IssueUpdate, 0, "segments are removed from EVENT playlist")
+	}
+	if prev.EndList && (!next.EndList || len(next.Segments) != len(prev.Segments)) {
+		v.add(SeverityError, IssueUpdate, 0, "playlist changed after EXT-X-ENDLIST")
+	}
+
+	segs := make(map[int64]Segment, len(prev.Segments))
+	for _, seg := range prev.Segments {
+		segs[seg.Sequence] = seg
+	}
+	for _, seg := range next.Segments {
+		old, ok := segs[seg.Sequence]
+		if !ok {
+			continue
+		}
+		if old.Url != seg.Url || !sameByteRange(old.ByteRange, seg.ByteRange) {
+			v.add(SeverityError, IssueUpdate, 0, "segment %d changed from %s to %s", seg.Sequence, old.Url, seg.Url)
+		}
+	}
+	return v.issues
+}
+
+func sameByteRange(a, b *ByteRange) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// lineIndex 记录m3u8文本中分片地址, EXT-X-STREAM-INF, EXT-X-MEDIA-SEQUENCE和各个标签第一次出现的行号
+type lineIndex struct {
+	segments  []int
+	variants  []int
+	mediaSeqs []int
+	tags      map[string]int
+}
+
+func newLineIndex(content []byte) *lineIndex {
+	ret := &lineIndex{tags: make(map[string]int)}
+	sc := bufio.NewScanner(bytes.NewReader(content))
+	var variantUri bool // 下一个地址是码流的地址
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "":
+		case !strings.HasPrefix(line, "#"):
+			if !variantUri {
+				ret.segments = append(ret.segments, n)
+			}
+			variantUri = false
+		case strings.HasPrefix(line, "#EXT"):
+			name := line
+			if pos := strings.IndexByte(line, ':'); pos >= 0 {
+				name = line[:pos]
+			}
+			if _, ok := ret.tags[name]; !ok {
+				ret.tags[name] = n
+			}
+			switch name {
+			case "#EXT-X-STREAM-INF":
+				ret.variants = append(ret.variants, n)
+				variantUri = true
+			case "#EXT-X-MEDIA-SEQUENCE":
+				ret.mediaSeqs = append(ret.mediaSeqs, n)
+			}
+		}
+	}
+	return ret
+}
+
+func (l *lineIndex) segment(idx int) int {
+	if idx < len(l.segments) {
+		return l.segments[idx]
+	}
+	return 0
+}
+
+func (l *lineIndex) variant(idx int) int {
+	if idx < len(l.variants) {
+		return l.variants[idx]
+	}
+	return 0
+}
+
+func (l *lineIndex) tag(name string) int {
+	return l.tags[name]
+}
+
+type validator struct {
+	m      *M3u8
+	lines  *lineIndex
+	issues []Issue
+}
+
+func (v *validator) add(severity Severity, code string, line int, format string, args ...interface{}) {
+	v.issues = append(v.issues, Issue{Severity: severity, Code: code, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) validate() {
+	m := v.m
+	master := len(m.MastPlayList) > 0 || len(m.MediaList) > 0
+	media := len(m.Segments) > 0 || m.TargetDuration > 0 || m.EndList || m.PlayListType != ""
+	switch {
+	case master && media:
+		v.add(SeverityError, IssueMixedPlaylist, v.lines.tag("#EXT-X-STREAM-INF"), "playlist contains both master playlist and media playlist tags")
+	case !master && !media:
+		v.add(SeverityWarning, IssueEmptyPlaylist, 0, "playlist has neither segments nor variant streams")
+	}
+	if master {
+		v.validateMaster()
+	}
+	if media {
+		v.validateMedia()
+	}
+	v.validateVersion()
+}
+
+func (v *validator) validateMaster() {
+	m := v.m
+	groups := make(map[string]bool)
+	for _, media := range m.MediaList {
+		groups[media.Type+"/"+media.GroupId] = true
+	}
+	uris := make(map[string]int)
+	for i, p := range m.MastPlayList {
+		line := v.lines.variant(i)
+		if p.BandWidth <= 0 {
+			v.add(SeverityError, IssueMissingBandwidth, line, "EXT-X-STREAM-INF of %s has no BANDWIDTH", p.M3u8Url)
+		}
+		if first, ok := uris[p.M3u8Url]; ok {
+			v.add(SeverityWarning, IssueDuplicateUri, line, "variant stream %s is the same as variant stream %d", p.M3u8Url, first)
+		} else {
+			uris[p.M3u8Url] = i
+		}
+		for typ, group := range map[string]string{
+			MediaTypeAudio:     p.Audio,
+			MediaTypeVideo:     p.Video,
+			MediaTypeSubtitles: p.Subtitles,
+		} {
+			if group != "" && !groups[typ+"/"+group] {
+				v.add(SeverityError, IssueUndefinedGroup, line, "%s group %s of %s is not defined by EXT-X-MEDIA", typ, group, p.M3u8Url)
+			}
+		}
+	}
+}
+
+func (v *validator) validateMedia() {
+	m := v.m
+	if m.TargetDuration <= 0 {
+		v.add(SeverityError, IssueMissingTargetDuration, 0, "media playlist has no EXT-X-TARGETDURATION")
+	}
+	// 解析时接受小数形式的目标时长, 但RFC 8216要求为整数
+	if m.TargetDuration%time.Second != 0 {
+		v.add(SeverityError, IssueIllegalValue, v.lines.tag("#EXT-X-TARGETDURATION"), "EXT-X-TARGETDURATION %s is not an integer", m.TargetDuration)
+	}
+	if m.PlayListType == "VOD" && !m.EndList {
+		v.add(SeverityError, IssuePlaylistType, v.lines.tag("#EXT-X-PLAYLIST-TYPE"), "PLAYLIST-TYPE is VOD but playlist has no EXT-X-ENDLIST")
+	}
+
+	// EXT-X-MEDIA-SEQUENCE只能出现一次且在所有分片之前, 否则之后的分片的媒体序列号发生跳变,
+	// 此时只报告标签所在的行, 不再逐个检查分片的媒体序列号
+	seqTagIssue := false
+	for n, line := range v.lines.mediaSeqs {
+		switch {
+		case n > 0:
+			v.add(SeverityError, IssueSequence, line, "EXT-X-MEDIA-SEQUENCE appears more than once")
+		case len(v.lines.segments) > 0 && line > v.lines.segments[0]:
+			v.add(SeverityError, IssueSequence, line, "EXT-X-MEDIA-SEQUENCE appears after the first segment")
+		default:
+			continue
+		}
+		seqTagIssue = true
+	}
+
+	type resource struct {
+		url string
+		br  ByteRange
+	}
+	seen := make(map[resource]int)
+	for i, seg := range m.Segments {
+		line := v.lines.segment(i)
+		// 时长四舍五入到整数秒后不能超过目标时长
+		if m.TargetDuration > 0 && seg.Duration.Round(time.Second) > m.TargetDuration {
+			v.add(SeverityError, IssueExceedTargetDuration, line, "duration %s of segment %d exceeds target duration %s", seg.Duration, seg.Sequence, m.TargetDuration)
+		}
+
+		expect := m.MediaSequence
+		if i > 0 {
+			expect = m.Segments[i-1].Sequence + 1
+		}
+		if !seqTagIssue && seg.Sequence != expect {
+			v.add(SeverityError, IssueSequence, line, "media sequence of segment %d is %d, expect %d", i, seg.Sequence, expect)
+		}
+
+		r := resource{url: seg.Url}
+		if seg.ByteRange != nil {
+			r.br = *seg.ByteRange
+		}
+		if first, ok := seen[r]; ok {
+			v.add(SeverityWarning, IssueDuplicateUri, line, "segment %s is the same as segment %d", seg.Url, first)
+		} else {
+			seen[r] = i
+		}
+	}
+}
+
+// validateVersion 检查播放列表使用的特性要求的兼容版本, 参考RFC 8216 7
+func (v *validator) validateVersion() {
+	m := v.m
+	version := m.Version
+	if version <= 0 {
+		version = 1
+	}
+	require := func(need int, tag, feature string) {
+		if version < need {
+			v.add(SeverityError, IssueVersionTooLow, v.lines.tag(tag), "%s requires EXT-X-VERSION %d, but version is %d", feature, need, version)
+		}
+	}
+
+	var iv, float, byteRange, keyFormat, segMap bool
+	for _, seg := range m.Segments {
+		iv = iv || seg.EncryptMeta.IV != ""
+		float = float || seg.Duration%time.Second != 0
+		byteRange = byteRange || seg.ByteRange != nil
+		keyFormat = keyFormat || seg.EncryptMeta.KeyFormat != "" || seg.EncryptMeta.KeyFormatVersions != ""
+		segMap = segMap || seg.Map != nil
+	}
+	if iv {
+		require(2, "#EXT-X-KEY", "IV attribute of EXT-X-KEY")
+	}
+	if float {
+		require(3, "#EXTINF", "floating-point EXTINF duration")
+	}
+	if byteRange {
+		require(4, "#EXT-X-BYTERANGE", "EXT-X-BYTERANGE")
+	}
+	if m.IFramesOnly {
+		require(4, "#EXT-X-I-FRAMES-ONLY", "EXT-X-I-FRAMES-ONLY")
+	}
+	if keyFormat {
+		require(5, "#EXT-X-KEY", "KEYFORMAT and KEYFORMATVERSIONS attributes of EXT-X-KEY")
+	}
+	if segMap && m.IFramesOnly {
+		require(5, "#EXT-X-MAP", "EXT-X-MAP")
+	} else if segMap {
+		require(6, "#EXT-X-MAP", "EXT-X-MAP in playlist without EXT-X-I-FRAMES-ONLY")
+	}
+	if len(m.Variables) > 0 {
+		require(8, "#EXT-X-DEFINE", "EXT-X-DEFINE")
+	}
+	if m.Skip != nil {
+		require(9, "#EXT-X-SKIP", "EXT-X-SKIP")
+		if len(m.Skip.RecentlyRemovedDateRanges) > 0 {
+			require(10, "#EXT-X-SKIP", "RECENTLY-REMOVED-DATERANGES attribute of EXT-X-SKIP")
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package m3u8
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidate(t *testing.T) {
+	validate := func(content string) []Issue {
+		issues, err := ValidateContent([]byte(content), "http://a.com/index.m3u8")
+		So(err, ShouldEqual, nil)
+		return issues
+	}
+	codes := func(issues []Issue) (ret []string) {
+		for _, v := range issues {
+			ret = append(ret, v.Code)
+		}
+		return ret
+	}
+
+	Convey("TestValidate", t, func() {
+		Convey("valid", func() {
+			So(validate("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:2.5,\n1.ts\n#EXTINF:3,\n2.ts\n#EXT-X-ENDLIST\n"), ShouldBeEmpty)
+			So(validate("#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"en\",URI=\"en.m3u8\"\n#EXT-X-STREAM-INF:BANDWIDTH=1280000,AUDIO=\"aac\"\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2560000,AUDIO=\"aac\"\nhigh.m3u8\n"), ShouldBeEmpty)
+		})
+
+		Convey("media", func() {
+			issues := validate("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:5\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:2.4,\n1.ts\n#EXTINF:2.6,\n2.ts\n#EXTINF:2,\n1.ts\n")
+			So(codes(issues), ShouldResemble, []string{IssuePlaylistType, IssueExceedTargetDuration, IssueDuplicateUri, IssueVersionTooLow})
+			So(issues[0].Line, ShouldEqual, 4)
+			So(issues[1].Line, ShouldEqual, 8)
+			So(issues[1].Severity, ShouldEqual, SeverityError)
+			So(issues[2].Line, ShouldEqual, 10)
+			So(issues[2].Severity, ShouldEqual, SeverityWarning)
+			So(issues[3].Line, ShouldEqual, 5)
+			So(issues[3].String(), ShouldEqual, "line 5: error [version-too-low] floating-point EXTINF duration requires EXT-X-VERSION 3, but version is 1")
+
+			// 同一资源的不同字节范围不算重复
+			So(validate("#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\n#EXT-X-BYTERANGE:10@0\na.ts\n#EXTINF:2,\n#EXT-X-BYTERANGE:10\na.ts\n"), ShouldBeEmpty)
+
+			m, err := Parse([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\n1.ts\n#EXTINF:2,\n2.ts\n"), "http://a.com/index.m3u8")
+			So(err, ShouldEqual, nil)
+			m.Segments[1].Sequence = 3
+			issues = Validate(m)
+			So(codes(issues), ShouldResemble, []string{IssueSequence})
+			So(issues[0].Line, ShouldEqual, 0)
+
+			m.Segments[1].Sequence = 1
+			m.TargetDuration = 0
+			So(codes(Validate(m)), ShouldResemble, []string{IssueMissingTargetDuration})
+		})
+
+		Convey("media sequence tag", func() {
+			// 出现在分片之后或者重复的EXT-X-MEDIA-SEQUENCE只在其所在行报告一次
+			issues := validate("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\n1.ts\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:2,\n2.ts\n#EXTINF:2,\n3.ts\n")
+			So(codes(issues), ShouldResemble, []string{IssueSequence})
+			So(issues[0].Line, ShouldEqual, 5)
+			So(issues[0].Message, ShouldContainSubstring, "after the first segment")
+
+			issues = validate("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n#EXT-X-MEDIA-SEQUENCE:7\n#EXTINF:2,\n1.ts\n#EXTINF:2,\n2.ts\n")
+			So(codes(issues), ShouldResemble, []string{IssueSequence})
+			So(issues[0].Line, ShouldEqual, 4)
+			So(issues[0].Message, ShouldContainSubstring, "more than once")
+
+			So(validate("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:9\n#EXTINF:2,\n1.ts\n#EXTINF:2,\n2.ts\n"), ShouldBeEmpty)
+		})
+
+		Convey("illegal value", func() {
+			// 不合法的标签不导致解析失败, 按未指定处理后继续校验
+			issues := validate("#EXTM3U\n#EXT-X-TARGETDURATION:6.006\n#EXT-X-PLAYLIST-TYPE:LIVE\n#EXT-X-MEDIA-SEQUENCE:abc\n#EXTINF:x,\n1.ts\n#EXTINF:6,\n2.ts\n#EXT-X-ENDLIST\n")
+			So(codes(issues), ShouldResemble, []string{IssueIllegalValue, IssueIllegalValue, IssueIllegalValue, IssueIllegalValue})
+			So(issues[0].Line, ShouldEqual, 3)
+			So(issues[0].Message, ShouldEqual, "EXT-X-PLAYLIST-TYPE #EXT-X-PLAYLIST-TYPE:LIVE is illegal")
+			So(issues[1].Line, ShouldEqual, 4)
+			So(issues[2].Line, ShouldEqual, 5)
+			So(issues[3].Line, ShouldEqual, 2)
+			So(issues[3].Message, ShouldContainSubstring, "not an integer")
+
+			// 不是m3u8时仍然返回错误
+			_, err := ValidateContent([]byte("<html></html>"), "http://a.com/index.m3u8")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("file", func() {
+			path := filepath.Join(t.TempDir(), "index.m3u8")
+			So(os.WriteFile(path, []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\n1.ts\n#EXTINF:2,\n1.ts\n"), os.ModePerm), ShouldEqual, nil)
+			issues, err := ValidateFile(path)
+			So(err, ShouldEqual, nil)
+			So(codes(issues), ShouldResemble, []string{IssueDuplicateUri})
+			So(issues[0].Line, ShouldEqual, 6)
+
+			_, err = ValidateFile(path + ".missing")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("update", func() {
+			parse := func(content string) *M3u8 {
+				m, err := Parse([]byte(content), "http://a.com/index.m3u8")
+				So(err, ShouldEqual, nil)
+				return m
+			}
+			prev := parse("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:5\n#EXTINF:2,\n5.ts\n#EXTINF:2,\n6.ts\n")
+			So(ValidateUpdate(prev, parse("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:6\n#EXTINF:2,\n6.ts\n#EXTINF:2,\n7.ts\n")), ShouldBeEmpty)
+
+			issues := ValidateUpdate(prev, parse("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:4\n#EXTINF:2,\n4.ts\n#EXTINF:2,\n5.ts\n#EXTINF:2,\nx.ts\n"))
+			So(codes(issues), ShouldResemble, []string{IssueUpdate, IssueUpdate})
+			So(issues[0].Message, ShouldContainSubstring, "media sequence decreased")
+			So(issues[1].Message, ShouldContainSubstring, "segment 6 changed")
+
+			prev = parse("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXTINF:2,\n0.ts\n#EXT-X-ENDLIST\n")
+			issues = ValidateUpdate(prev, parse("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n#EXTINF:2,\n1.ts\n"))
+			So(codes(issues), ShouldResemble, []string{IssueUpdate, IssueUpdate})
+			So(issues[0].Message, ShouldContainSubstring, "EVENT")
+			So(issues[1].Message, ShouldContainSubstring, "EXT-X-ENDLIST")
+		})
+
+		Convey("master", func() {
+			issues := validate("#EXTM3U\n#EXT-X-STREAM-INF:RESOLUTION=640x360\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=1280000,AUDIO=\"aac\"\nlow.m3u8\n")
+			So(codes(issues), ShouldResemble, []string{IssueMissingBandwidth, IssueDuplicateUri, IssueUndefinedGroup})
+			So(issues[0].Line, ShouldEqual, 2)
+			So(issues[1].Line, ShouldEqual, 4)
+			So(issues[2].Line, ShouldEqual, 4)
+
+			issues = validate("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\nlow.m3u8\n")
+			So(codes(issues), ShouldResemble, []string{IssueMixedPlaylist})
+			So(issues[0].Line, ShouldEqual, 3)
+		})
+
+		Convey("version", func() {
+			issues := validate("#EXTM3U\n#EXT-X-VERSION:5\n#EXT-X-TARGETDURATION:2\n#EXT-X-DEFINE:NAME=\"n\",VALUE=\"1\"\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2,\n{$n}.m4s\n")
+			So(codes(issues), ShouldResemble, []string{IssueVersionTooLow, IssueVersionTooLow})
+			So(issues[0].Line, ShouldEqual, 5)
+			So(issues[1].Line, ShouldEqual, 4)
+
+			issues = validate("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-KEY:METHOD=AES-128,URI=\"k.bin\",IV=0x00000000000000000000000000000001,KEYFORMAT=\"identity\"\n#EXTINF:2,\n1.ts\n")
+			So(codes(issues), ShouldResemble, []string{IssueVersionTooLow, IssueVersionTooLow})
+			So(issues[0].Message, ShouldContainSubstring, "EXT-X-VERSION 2")
+			So(issues[1].Message, ShouldContainSubstring, "EXT-X-VERSION 5")
+		})
+
+		Convey("empty", func() {
+			So(codes(validate("#EXTM3U\n")), ShouldResemble, []string{IssueEmptyPlaylist})
+		})
+	})
+}